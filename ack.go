@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// JSON protocol clients may give a message an "id" of their choosing. The
+// server then answers {"type":"ack","id":...} once the message is queued
+// for broadcast, or {"type":"nack","id":...,"reason":...} in place of the
+// usual notice if it is rejected by a rate limit or quota, so publishers
+// know what to retry. The id is echoed back verbatim and not relayed.
+
+// ackFrame acknowledges or rejects a message that carried an id.
+type ackFrame struct {
+	Type   string          `json:"type"`
+	ID     json.RawMessage `json:"id"`
+	Reason string          `json:"reason,omitempty"`
+}
+
+// envelopeID returns the id of a JSON protocol frame, or nil if it has
+// none. It is only needed for frames rejected before stampEnvelope parses
+// them.
+func envelopeID(data []byte) json.RawMessage {
+	if !bytes.Contains(data, []byte(`"id"`)) {
+		return nil
+	}
+	var in struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if json.Unmarshal(data, &in) != nil || isJSONNull(in.ID) {
+		return nil
+	}
+	return in.ID
+}
+
+// isJSONNull reports whether a raw value is absent or null.
+func isJSONNull(v json.RawMessage) bool {
+	return v == nil || bytes.Equal(v, []byte("null"))
+}
+
+// ack tells the client its message with id was queued for broadcast.
+func (c *Client) ack(id json.RawMessage) {
+	data, _ := json.Marshal(ackFrame{Type: "ack", ID: id})
+	c.sendDirect(data)
+}
+
+// reject tells the client its message was not relayed: with a nack for
+// reason if the message carried an id, otherwise with notice.
+func (c *Client) reject(id json.RawMessage, notice []byte, reason string) {
+	if id == nil {
+		c.sendDirect(notice)
+		return
+	}
+	data, _ := json.Marshal(ackFrame{Type: "nack", ID: id, Reason: reason})
+	c.sendDirect(data)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readAck reads the next frame from conn as an ack or nack.
+func readAck(tb testing.TB, conn *websocket.Conn) ackFrame {
+	tb.Helper()
+	_, data := readFrame(tb, conn)
+	var ack ackFrame
+	if err := json.Unmarshal(data, &ack); err != nil {
+		tb.Fatalf("invalid ack %s: %v", data, err)
+	}
+	return ack
+}
+
+func TestAckEchoesIDAndIsNotRelayed(t *testing.T) {
+	srv := newTestServer(t, nil)
+	receiver := srv.connect(t, "r", "bob", "protocol=json")
+	sender := srv.connect(t, "r", "alice", "protocol=json")
+
+	for _, id := range []string{`"m1"`, `7`, `{"batch":3,"n":1}`} {
+		sender.WriteMessage(websocket.TextMessage, []byte(`{"id":`+id+`,"payload":"hi"}`))
+		if ack := readAck(t, sender); ack.Type != "ack" || string(ack.ID) != id || ack.Reason != "" {
+			t.Errorf("sent id %s, got %+v", id, ack)
+		}
+		if _, data := readFrame(t, receiver); strings.Contains(string(data), `"id"`) {
+			t.Errorf("relayed envelope %s carries the id", data)
+		}
+	}
+
+	// Messages without an id, or with a null one, are not acknowledged
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"payload":"hi"}`))
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"id":null,"payload":"hi"}`))
+	readFrame(t, receiver)
+	readFrame(t, receiver)
+	expectSilence(t, sender, 100*time.Millisecond)
+}
+
+func TestNackReplacesRejectionNotice(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		reason    string
+	}{
+		{"rate limited", func(cfg *Config) { cfg.Hub.RateLimit, cfg.Hub.RateBurst = 0.1, 1 }, "rate_limited"},
+		{"over quota", func(cfg *Config) { cfg.Hub.Quota = Quota{Messages: 1} }, "quota_exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.configure)
+			sender := srv.connect(t, "r", "alice", "protocol=json")
+			sender.WriteMessage(websocket.TextMessage, []byte(`{"id":"m1","payload":1}`))
+			if ack := readAck(t, sender); ack.Type != "ack" {
+				t.Fatalf("first message got %+v, want an ack", ack)
+			}
+			sender.WriteMessage(websocket.TextMessage, []byte(`{"id":"m2","payload":2}`))
+			if nack := readAck(t, sender); nack.Type != "nack" || string(nack.ID) != `"m2"` || nack.Reason != tt.reason {
+				t.Fatalf("second message got %+v, want a nack for m2 with reason %s", nack, tt.reason)
+			}
+			// Without an id the usual notice is sent instead
+			sender.WriteMessage(websocket.TextMessage, []byte(`{"payload":3}`))
+			_, data := readFrame(t, sender)
+			var notice errorFrame
+			if err := json.Unmarshal(data, &notice); err != nil || notice.Type == "nack" || notice.Reason != tt.reason {
+				t.Fatalf("message without an id got %s, want a %s notice", data, tt.reason)
+			}
+		})
+	}
+}
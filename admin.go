@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// kickRequest asks Run to disconnect a client. Run replies on result with
+// whether the client was connected.
+type kickRequest struct {
+	room     string
+	username string
+	result   chan bool
+}
+
+// kick disconnects the named client through Run, which removes it from the
+// room and closes its send channel exactly once. WritePump then writes the
+// close frame and ReadPump's later unregister is a no-op.
+func (h *Hub) kick(room, username string) bool {
+	req := kickRequest{room: room, username: username, result: make(chan bool, 1)}
+	select {
+	case h.kicks <- req:
+	case <-h.done:
+		return false
+	}
+	select {
+	case kicked := <-req.result:
+		return kicked
+	case <-h.done:
+		return false
+	}
+}
+
+// handleKick processes a kick request. Called from Run only.
+func (h *Hub) handleKick(req kickRequest) {
+	client := h.lookup(req.room, req.username)
+	if client != nil {
+		client.closeWith(CloseKicked, "kicked", nil)
+	}
+	removed := client != nil && h.removeClient(client)
+	h.mu.RLock()
+	total := h.clientCount()
+	h.mu.RUnlock()
+
+	if removed {
+		slog.Info("User kicked", "event", "kick", "username", client.username, "room", client.room, "total_users", total)
+		h.announcePresence(client, "leave")
+	}
+	req.result <- removed
+}
+
+// replacedFrame is sent to a connection evicted by a reconnect with force=1
+var replacedFrame = newErrorFrame(http.StatusConflict, "replaced", "another connection took over this username")
+
+// evict disconnects the client connected as username in room so a forced
+// reconnect can take its place. Removal goes through removeClient like any
+// other disconnect, so the old send channel is closed exactly once and the
+// old ReadPump's later unregister is a no-op. The old client leaves the
+// room before evict returns, so the new one registers into a free slot,
+// while its WritePump gets EvictionGrace to flush what was queued for it.
+// Called from Run only.
+func (h *Hub) evict(room, username string) {
+	old := h.lookup(room, username)
+	if old == nil {
+		return
+	}
+	old.drainDeadline.Store(time.Now().Add(h.config.EvictionGrace).UnixNano())
+	old.closeWith(CloseDuplicateUsername, "duplicate username", replacedFrame)
+	if h.removeClient(old) {
+		slog.Info("User replaced by new connection", "event", "replace", "username", username, "room", room)
+		h.announcePresence(old, "leave")
+	}
+}
+
+// requireAdminToken guards operator endpoints. Unlike requireToken it
+// refuses every request when no token is configured, so the admin API is
+// never accidentally left open.
+func requireAdminToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "Admin API disabled: set ADMIN_TOKEN or AUTH_TOKEN", http.StatusForbidden)
+			return
+		}
+		requireToken(token, next)(w, r)
+	}
+}
+
+// HandleKick forcibly disconnects a user. The room defaults to the one used
+// by /ws/{username}.
+func HandleKick(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		username := vars["username"]
+		room := vars["room"]
+		if room == "" {
+			room = defaultRoom
+		}
+
+		if !hub.kick(room, username) {
+			http.Error(w, "User not connected", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "kicked",
+			"room":     room,
+			"username": username,
+		})
+	}
+}
+
+// HandleDrain starts draining the server, with drain set, or ends it.
+// While draining, new WebSocket and SSE connections get 503 and /ready
+// fails, so a load balancer moves new traffic elsewhere before a deploy,
+// while connected clients keep relaying until they leave.
+func HandleDrain(hub *Hub, drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hub.mu.Lock()
+		changed := hub.draining != drain
+		hub.draining = drain
+		connected := hub.clientCount()
+		hub.mu.Unlock()
+
+		status := "accepting"
+		if drain {
+			status = "draining"
+		}
+		if changed {
+			slog.Info("Drain mode changed", "event", "drain", "draining", drain, "total_users", connected)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":          status,
+			"connected_users": connected,
+		})
+	}
+}
+
+// connectionInfo describes one client for /admin/connections.
+type connectionInfo struct {
+	Username    string    `json:"username"`
+	Room        string    `json:"room"`
+	RemoteAddr  string    `json:"remote_addr"`
+	IP          string    `json:"ip"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Mode        string    `json:"mode"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// HandleConnections lists every connected client, oldest connection first.
+func HandleConnections(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		connections := []connectionInfo{}
+		hub.forEachClient(func(client *Client) {
+			connections = append(connections, connectionInfo{
+				Username:    client.username,
+				Room:        client.room,
+				RemoteAddr:  client.remoteAddr,
+				IP:          client.ip,
+				ConnectedAt: client.connectedAt,
+				Mode:        client.mode,
+
+				Metadata: client.metadata,
+			})
+		})
+		sort.Slice(connections, func(i, j int) bool {
+			return connections[i].ConnectedAt.Before(connections[j].ConnectedAt)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(connections)
+	}
+}
+
+// resetStats zeroes the cumulative statistics and restarts the uptime the
+// rates are computed over, returning the /stats figures from just before.
+// Gauges such as the connected and compressed client counts describe the
+// present and are kept; the peak restarts from the current count.
+func (h *Hub) resetStats() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	previous := h.statsReport(true)
+
+	now := time.Now()
+	h.stats = ServerStats{
+		PeakConnections:       h.connected,
+		CompressedConnections: h.stats.CompressedConnections,
+	}
+	if h.connected > 0 {
+		h.stats.PeakTime = now
+	}
+	h.startTime = now
+	return previous
+}
+
+// HandleStatsReset zeroes the server statistics, e.g. between benchmark
+// runs, and responds with the figures they had.
+func HandleStatsReset(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		previous := hub.resetStats()
+		slog.Info("Statistics reset", "event", "stats_reset",
+			"total_connections", previous["total_connections"], "total_messages", previous["total_messages"])
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "reset",
+			"previous": previous,
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// adminPost posts body to an admin endpoint of srv with token, if any,
+// and returns the response status and decoded JSON body.
+func adminPost(tb testing.TB, srv *testServer, path, token, body string) (int, map[string]interface{}) {
+	tb.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var decoded map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&decoded)
+	return resp.StatusCode, decoded
+}
+
+// readyStatus returns the status code of srv's /ready.
+func readyStatus(tb testing.TB, srv *testServer) int {
+	tb.Helper()
+	resp, err := http.Get(srv.URL + "/ready")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestDrainAndUndrain(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.AdminToken = "root" })
+	receiver := srv.connect(t, "r", "bob", "")
+	sender := srv.connect(t, "r", "alice", "")
+
+	if status, _ := adminPost(t, srv, "/admin/drain", "", ""); status != http.StatusUnauthorized {
+		t.Fatalf("drain without the admin token got HTTP %d, want 401", status)
+	}
+	if status, _ := adminPost(t, srv, "/admin/drain", "guess", ""); status != http.StatusUnauthorized {
+		t.Fatalf("drain with a wrong token got HTTP %d, want 401", status)
+	}
+	status, body := adminPost(t, srv, "/admin/drain", "root", "")
+	if status != http.StatusOK || body["status"] != "draining" || body["connected_users"] != 2.0 {
+		t.Fatalf("drain got HTTP %d %v, want 200 draining with 2 users", status, body)
+	}
+	if got := readyStatus(t, srv); got != http.StatusServiceUnavailable {
+		t.Errorf("/ready while draining got HTTP %d, want 503", got)
+	}
+	if got, _ := srv.dialStatus(t, "/ws/r/carol", nil); got != http.StatusServiceUnavailable {
+		t.Errorf("connection while draining got HTTP %d, want 503", got)
+	}
+	// Connected clients keep relaying
+	sender.WriteMessage(websocket.TextMessage, []byte("still here"))
+	if _, data := readFrame(t, receiver); string(data) != "still here" {
+		t.Fatalf("bob got %q while draining", data)
+	}
+	// Draining twice is harmless
+	if status, body := adminPost(t, srv, "/admin/drain", "root", ""); status != http.StatusOK || body["status"] != "draining" {
+		t.Fatalf("second drain got HTTP %d %v", status, body)
+	}
+
+	status, body = adminPost(t, srv, "/admin/undrain", "root", "")
+	if status != http.StatusOK || body["status"] != "accepting" {
+		t.Fatalf("undrain got HTTP %d %v, want 200 accepting", status, body)
+	}
+	if got := readyStatus(t, srv); got != http.StatusOK {
+		t.Errorf("/ready after undrain got HTTP %d, want 200", got)
+	}
+	srv.connect(t, "r", "carol", "")
+}
+
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	srv := newTestServer(t, nil)
+	if status, _ := adminPost(t, srv, "/admin/drain", "", ""); status != http.StatusForbidden {
+		t.Fatalf("drain without any admin token configured got HTTP %d, want 403", status)
+	}
+	if got := readyStatus(t, srv); got != http.StatusOK {
+		t.Errorf("/ready got HTTP %d, want 200", got)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Announcement levels accepted by /admin/announce.
+const (
+	AnnouncementInfo    = "info"
+	AnnouncementWarning = "warning"
+)
+
+// maxAnnouncementBytes bounds the /admin/announce request body.
+const maxAnnouncementBytes = 64 * 1024
+
+// announcementFrame is an operator notice sent to every client, e.g.
+// {"type":"announcement","level":"warning","message":"Maintenance at 22:00 UTC","ts":"..."}.
+type announcementFrame struct {
+	Type    string    `json:"type"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	TS      time.Time `json:"ts"`
+}
+
+// announceRequest asks Run to queue an announcement on every client. Run
+// replies on result with how many clients it was queued for.
+type announceRequest struct {
+	frame  frame
+	result chan int
+}
+
+// announce queues data, an announcement frame, on every connected client
+// through Run and returns how many it reached.
+func (h *Hub) announce(data []byte) int {
+	req := announceRequest{frame: textFrame(data), result: make(chan int, 1)}
+	select {
+	case h.announcements <- req:
+	case <-h.done:
+		return 0
+	}
+	select {
+	case reached := <-req.result:
+		return reached
+	case <-h.done:
+		return 0
+	}
+}
+
+// handleAnnounce queues an announcement on every client, on its priority
+// lane if it has one so the notice overtakes queued bulk data. Like other
+// server notices it is not subject to rate limits or the sender exclusion,
+// and clients whose queue is full miss it rather than being dropped.
+// Called from Run only.
+func (h *Hub) handleAnnounce(req announceRequest) {
+	reached := 0
+	h.forEachClient(func(client *Client) {
+		queue := client.send
+		if client.priority != nil {
+			queue = client.priority
+		}
+		select {
+		case queue <- req.frame:
+			client.enqueued(req.frame)
+			reached++
+		default:
+		}
+	})
+	req.result <- reached
+}
+
+// HandleAnnounce sends an operator announcement, given as
+// {"message":"...","type":"info"} with type info or warning, to every
+// connected client, and reports how many it reached.
+func HandleAnnounce(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAnnouncementBytes+1))
+		if err != nil {
+			http.Error(w, "Reading body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxAnnouncementBytes {
+			http.Error(w, "Announcement too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Message == "" {
+			http.Error(w, "message is required", http.StatusBadRequest)
+			return
+		}
+		if req.Type == "" {
+			req.Type = AnnouncementInfo
+		}
+		if req.Type != AnnouncementInfo && req.Type != AnnouncementWarning {
+			http.Error(w, fmt.Sprintf("type must be %s or %s", AnnouncementInfo, AnnouncementWarning), http.StatusBadRequest)
+			return
+		}
+
+		data, _ := json.Marshal(announcementFrame{Type: "announcement", Level: req.Type, Message: req.Message, TS: time.Now().UTC()})
+		reached := hub.announce(data)
+		slog.Info("Announcement sent", "event", "announce", "level", req.Type, "clients", reached)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "announced",
+			"type":    req.Type,
+			"clients": reached,
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAnnouncementReachesEveryClient(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.AdminToken = "root" })
+	clients := map[string]*websocket.Conn{
+		"raw":     srv.connect(t, "lobby", "alice", ""),
+		"json":    srv.connect(t, "support", "bob", "protocol=json"),
+		"binary":  srv.connect(t, "ops", "carol", "protocol=binary"),
+		"msgpack": srv.connect(t, "ops", "dave", "encoding=msgpack"),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/sse/dashboard/erin", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	waitFor(t, "the SSE stream to join", func() bool { return srv.hub.lookup("dashboard", "erin") != nil })
+
+	status, body := adminPost(t, srv, "/admin/announce", "root", `{"message":"Maintenance at 22:00 UTC","type":"warning"}`)
+	if status != http.StatusOK || body["status"] != "announced" || body["clients"] != 5.0 {
+		t.Fatalf("announce got HTTP %d %v, want 200 reaching 5 clients", status, body)
+	}
+
+	want := announcementFrame{Type: "announcement", Level: AnnouncementWarning, Message: "Maintenance at 22:00 UTC"}
+	check := func(name string, got announcementFrame) {
+		if got.TS.IsZero() || time.Since(got.TS) > time.Minute {
+			t.Errorf("%s: announcement ts = %s", name, got.TS)
+		}
+		got.TS = time.Time{}
+		if got != want {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+	for _, name := range []string{"raw", "json"} {
+		var got announcementFrame
+		if _, data := readFrame(t, clients[name]); json.Unmarshal(data, &got) != nil {
+			t.Errorf("%s: announcement %s is not JSON", name, data)
+		}
+		check(name, got)
+	}
+	if _, data := readFrame(t, clients["binary"]); data[0] != binaryControl || data[1] != controlJSON {
+		t.Errorf("binary: got % x, want a JSON control frame", data)
+	} else {
+		var got announcementFrame
+		json.Unmarshal(data[2:], &got)
+		check("binary", got)
+	}
+	_, data := readFrame(t, clients["msgpack"])
+	v, _, err := decodeMsgpack(data)
+	if m, ok := v.(map[string]interface{}); err != nil || !ok || m["type"] != "announcement" || m["message"] != want.Message {
+		t.Errorf("msgpack: decoded %v, %v", v, err)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			var got announcementFrame
+			if json.Unmarshal([]byte(line), &got) != nil {
+				t.Errorf("sse: announcement %s is not JSON", line)
+			}
+			check("sse", got)
+			return
+		}
+	}
+	t.Errorf("sse: stream ended without the announcement: %v", scanner.Err())
+}
+
+func TestAnnounceRejectsInvalidRequests(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.AdminToken = "root" })
+	alice := srv.connect(t, "r", "alice", "")
+	tests := []struct {
+		token, body string
+		want        int
+	}{
+		{"", `{"message":"hi"}`, http.StatusUnauthorized},
+		{"guess", `{"message":"hi"}`, http.StatusUnauthorized},
+		{"root", `{"message":""}`, http.StatusBadRequest},
+		{"root", `{"message":"hi","type":"critical"}`, http.StatusBadRequest},
+		{"root", `not json`, http.StatusBadRequest},
+		{"root", `{"message":"` + strings.Repeat("x", maxAnnouncementBytes) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		if status, _ := adminPost(t, srv, "/admin/announce", tt.token, tt.body); status != tt.want {
+			t.Errorf("token %q, body %.30s: got HTTP %d, want %d", tt.token, tt.body, status, tt.want)
+		}
+	}
+	expectSilence(t, alice, 100*time.Millisecond)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	tests := []struct {
+		name   string
+		token  string
+		target string
+		header string
+		want   int
+	}{
+		{"disabled", "", "/ws/alice", "", http.StatusNoContent},
+		{"bearer header", "s3cret", "/ws/alice", "Bearer s3cret", http.StatusNoContent},
+		{"lowercase scheme", "s3cret", "/ws/alice", "bearer s3cret", http.StatusNoContent},
+		{"query parameter", "s3cret", "/ws/alice?token=s3cret", "", http.StatusNoContent},
+		{"missing", "s3cret", "/ws/alice", "", http.StatusUnauthorized},
+		{"wrong header", "s3cret", "/ws/alice", "Bearer guess", http.StatusUnauthorized},
+		{"wrong query", "s3cret", "/ws/alice?token=guess", "", http.StatusUnauthorized},
+		{"other scheme", "s3cret", "/ws/alice", "Basic s3cret", http.StatusUnauthorized},
+		{"header wins over query", "s3cret", "/ws/alice?token=s3cret", "Bearer guess", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			requireToken(tt.token, ok)(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("got HTTP %d, want %d", w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestAuthTokenCheckedBeforeUsernameConflict(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.AuthToken = "s3cret" })
+	header := http.Header{"Authorization": {"Bearer s3cret"}}
+	srv.dial(t, "/ws/r/alice", header)
+	waitFor(t, "alice to register", func() bool { return srv.hub.lookup("r", "alice") != nil })
+
+	// Without the token, nothing about who is connected is revealed
+	if status, _ := srv.dialStatus(t, "/ws/r/alice", nil); status != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated duplicate got HTTP %d, want 401", status)
+	}
+	if status, _ := srv.dialStatus(t, "/ws/r/alice", header); status != http.StatusConflict {
+		t.Fatalf("authenticated duplicate got HTTP %d, want 409", status)
+	}
+}
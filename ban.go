@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A client that keeps hitting its rate limit collects strikes: one for
+// each run of throttled messages, however long. At BanStrikes it is
+// disconnected and both its username and IP address are refused for
+// BanCooldown, so an abusive publisher cannot simply reconnect.
+
+// banList holds the usernames and IP addresses in cooldown. ReadPumps add
+// to it while HandleWebSocket checks it, hence the mutex.
+type banList struct {
+	mu       sync.Mutex
+	cooldown time.Duration
+	until    map[string]time.Time // "user:<name>" or "ip:<addr>"
+}
+
+func newBanList(cooldown time.Duration) *banList {
+	return &banList{cooldown: cooldown, until: make(map[string]time.Time)}
+}
+
+// ban refuses username and ip until the cooldown has passed. An empty ip
+// is not banned.
+func (b *banList) ban(username, ip string) {
+	until := time.Now().Add(b.cooldown)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.until["user:"+username] = until
+	if ip != "" {
+		b.until["ip:"+ip] = until
+	}
+}
+
+// banned reports whether username or ip is in cooldown and, if so, until
+// when. Expired entries are dropped as they are found.
+func (b *banList) banned(username, ip string) (time.Time, bool) {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var latest time.Time
+	for _, key := range []string{"user:" + username, "ip:" + ip} {
+		until, ok := b.until[key]
+		if !ok {
+			continue
+		}
+		if !now.Before(until) {
+			delete(b.until, key)
+			continue
+		}
+		if until.After(latest) {
+			latest = until
+		}
+	}
+	return latest, !latest.IsZero()
+}
+
+// addrIP returns the IP address part of a host:port address, or addr
+// itself if it has no port.
+func addrIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// strike records a message rejected by a rate limit and reports whether
+// the client has now collected BanStrikes strikes. Only the first of
+// consecutive rejections counts as a strike.
+func (c *Client) strike() bool {
+	if c.throttled {
+		return false
+	}
+	c.throttled = true
+	c.strikes++
+	limit := c.hub.config.BanStrikes
+	return c.hub.bans != nil && limit > 0 && c.strikes >= limit
+}
+
+// checkBan answers 403 and reports false if username or ip is in cooldown.
+func checkBan(w http.ResponseWriter, hub *Hub, username, ip string) bool {
+	if hub.bans == nil {
+		return true
+	}
+	until, banned := hub.bans.banned(username, ip)
+	if !banned {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+	http.Error(w, "Temporarily banned for exceeding the rate limit", http.StatusForbidden)
+	return false
+}
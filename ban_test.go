@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBanListCooldown(t *testing.T) {
+	bans := newBanList(50 * time.Millisecond)
+	bans.ban("alice", "10.0.0.1")
+	for _, tt := range []struct {
+		username, ip string
+		banned       bool
+	}{
+		{"alice", "10.0.0.2", true},
+		{"bob", "10.0.0.1", true},
+		{"bob", "10.0.0.2", false},
+	} {
+		if _, banned := bans.banned(tt.username, tt.ip); banned != tt.banned {
+			t.Errorf("banned(%q, %q) = %t, want %t", tt.username, tt.ip, banned, tt.banned)
+		}
+	}
+	time.Sleep(60 * time.Millisecond)
+	if until, banned := bans.banned("alice", "10.0.0.1"); banned {
+		t.Errorf("still banned until %s after the cooldown", until)
+	}
+	if len(bans.until) != 0 {
+		t.Errorf("%d expired entries kept", len(bans.until))
+	}
+}
+
+func TestStrikeCountsRunsOfThrottledMessages(t *testing.T) {
+	config := DefaultHubConfig()
+	config.BanStrikes = 2
+	client := newTestClient(NewHub(config), "r", "alice", 1)
+	if client.strike() || client.strike() || client.strike() {
+		t.Fatal("one run of throttled messages reached two strikes")
+	}
+	client.throttled = false // a message got through
+	if !client.strike() {
+		t.Fatalf("second run of throttled messages gave %d strikes, want a ban", client.strikes)
+	}
+}
+
+func TestRepeatedlyThrottledClientIsBanned(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.Hub.RateLimit = 20
+		cfg.Hub.RateBurst = 1
+		cfg.Hub.BanStrikes = 2
+		cfg.Hub.BanCooldown = time.Minute
+	})
+	conn := srv.connect(t, "r", "alice", "")
+	for _, pause := range []time.Duration{0, 0, 0, 100 * time.Millisecond, 0} {
+		time.Sleep(pause)
+		conn.WriteMessage(websocket.TextMessage, []byte("spam"))
+	}
+	var closeErr *websocket.CloseError
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !errors.As(err, &closeErr) || closeErr.Code != CloseBanned {
+				t.Fatalf("connection ended with %v, want close code %d", err, CloseBanned)
+			}
+			break
+		}
+	}
+
+	// The username and, from any username, the address are refused
+	for _, path := range []string{"/ws/r/alice", "/ws/r/bob"} {
+		status, header := srv.dialStatus(t, path, nil)
+		if status != http.StatusForbidden || header.Get("Retry-After") == "" {
+			t.Errorf("%s got HTTP %d with Retry-After %q, want 403 with a Retry-After", path, status, header.Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// With MaxConnBytesPerSec, each connection's throughput is capped in each
+// direction, independently of RATE_LIMIT, which counts messages whatever
+// their size. Both directions have a token bucket of bytes that refills at
+// the cap and holds one second's worth. After each write the writer waits
+// until the bytes written are paid for, so a high-volume stream leaves at
+// the cap on average and the rest queues in the send buffer, where
+// BackpressurePolicy applies as for any slow client. After each read
+// ReadPump likewise waits before reading again, so a fast sender is held
+// back by TCP flow control rather than by rejected messages.
+
+// newBandwidthBucket returns a bucket pacing bytesPerSec, or nil when the
+// cap is off.
+func newBandwidthBucket(bytesPerSec int) *tokenBucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return newTokenBucket(float64(bytesPerSec), bytesPerSec)
+}
+
+// throttle holds the caller back until n bytes just transferred fit the
+// bucket's rate, returning early at shutdown. A nil bucket never waits.
+func (c *Client) throttle(bucket *tokenBucket, n int) {
+	if bucket == nil {
+		return
+	}
+	wait := bucket.reserve(n)
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.hub.done:
+	}
+}
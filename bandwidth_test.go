@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBandwidthBucketReserve(t *testing.T) {
+	if newBandwidthBucket(0) != nil {
+		t.Fatal("a zero cap paces connections")
+	}
+	b := newBandwidthBucket(1000)
+	// elapse winds the bucket's clock back, as if d had passed since it
+	// was last used
+	elapse := func(d time.Duration) {
+		b.mu.Lock()
+		b.last = b.last.Add(-d)
+		b.mu.Unlock()
+	}
+	near := func(got, want time.Duration) bool {
+		return got >= want-10*time.Millisecond && got <= want
+	}
+
+	if wait := b.reserve(1000); wait != 0 {
+		t.Errorf("one second's worth within the burst waits %s", wait)
+	}
+	if wait := b.reserve(500); !near(wait, 500*time.Millisecond) {
+		t.Errorf("500 bytes over the burst wait %s, want 500ms", wait)
+	}
+	// Debts accumulate, and time repays them at the cap
+	if wait := b.reserve(250); !near(wait, 750*time.Millisecond) {
+		t.Errorf("another 250 bytes wait %s, want 750ms", wait)
+	}
+	elapse(750 * time.Millisecond)
+	if wait := b.reserve(0); wait != 0 {
+		t.Errorf("after the debt is repaid the wait is %s", wait)
+	}
+	// Idle time refills no more than the burst
+	elapse(time.Hour)
+	if wait := b.reserve(1500); !near(wait, 500*time.Millisecond) {
+		t.Errorf("1500 bytes after an hour idle wait %s, want 500ms", wait)
+	}
+}
+
+// Both directions are paced at MaxConnBytesPerSec: the first second's
+// worth passes at once, the rest at the cap, so relaying total bytes in
+// messages of size takes at least (total-cap-size)/cap seconds.
+const (
+	pacedCap     = 200_000
+	pacedSize    = 50_000
+	pacedCount   = 8
+	pacedMinimum = time.Duration(pacedCount*pacedSize-pacedCap-pacedSize) * time.Second / pacedCap
+)
+
+// checkPaced fails the test unless elapsed is within bounds of the pacing.
+func checkPaced(tb testing.TB, direction string, elapsed time.Duration) {
+	tb.Helper()
+	if elapsed < pacedMinimum*9/10 || elapsed > 3*pacedMinimum+time.Second {
+		tb.Errorf("%s %d bytes at %d B/s took %s, want about %s", direction, pacedCount*pacedSize, pacedCap, elapsed, pacedMinimum)
+	}
+}
+
+func TestBandwidthPacesWrites(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.MaxConnBytesPerSec = pacedCap })
+	receiver := srv.connect(t, "r", "bob", "")
+
+	start := time.Now()
+	payload := bytes.Repeat([]byte("w"), pacedSize)
+	for i := 0; i < pacedCount; i++ {
+		relay(srv.hub, "r", "alice", payload)
+	}
+	for i := 0; i < pacedCount; i++ {
+		if _, data := readFrame(t, receiver); len(data) != pacedSize {
+			t.Fatalf("message %d is %d bytes", i, len(data))
+		}
+	}
+	checkPaced(t, "writing", time.Since(start))
+}
+
+func TestBandwidthPacesReads(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.MaxConnBytesPerSec = pacedCap })
+	sender := srv.connect(t, "r", "alice", "")
+
+	start := time.Now()
+	payload := bytes.Repeat([]byte("r"), pacedSize)
+	go func() {
+		for i := 0; i < pacedCount; i++ {
+			if sender.WriteMessage(websocket.BinaryMessage, payload) != nil {
+				return
+			}
+		}
+	}()
+	waitFor(t, "the messages to be read", func() bool { return hubStats(srv.hub).TotalMessages == pacedCount })
+	checkPaced(t, "reading", time.Since(start))
+}
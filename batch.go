@@ -0,0 +1,87 @@
+package main
+
+import "time"
+
+// writeBatch coalesces first, a relayed message, and the relayed messages
+// queued behind it into a single WebSocket message, saving a write per
+// frame at high message rates. Frames are concatenated as-is, so batching
+// suits payloads that delimit themselves, such as newline-terminated JSON.
+// Only relayed frames of the same type are combined: a server notice, a
+// frame of the other type or one that would take the batch past
+// BatchMaxBytes ends the batch and is written on its own. The batch also
+// ends at BatchMaxMessages, when send runs empty or, with
+// BatchFlushInterval, when that long has passed since the first frame.
+// Frames that outlived MessageTTL are skipped. It reports whether send was
+// closed meanwhile.
+func (c *Client) writeBatch(first frame) (closed bool, err error) {
+	cfg := c.hub.config
+	w, err := c.conn.NextWriter(first.messageType)
+	if err != nil {
+		return false, err
+	}
+	w.Write(first.data)
+	count, size := 1, len(first.data)
+	full := func(next frame) bool {
+		return cfg.BatchMaxBytes > 0 && size+len(next.data) > cfg.BatchMaxBytes
+	}
+
+	var flush <-chan time.Time
+	if cfg.BatchFlushInterval > 0 {
+		timer := time.NewTimer(cfg.BatchFlushInterval)
+		defer timer.Stop()
+		flush = timer.C
+	}
+
+	var other *frame
+collect:
+	for count < cfg.BatchMaxMessages {
+		var next frame
+		var ok bool
+		if flush == nil {
+			select {
+			case next, ok = <-c.send:
+			default:
+				break collect
+			}
+		} else {
+			select {
+			case next, ok = <-c.send:
+			case <-flush:
+				break collect
+			}
+		}
+		if !ok {
+			closed = true
+			break
+		}
+		c.dequeued(next)
+		if c.expired(next) {
+			continue
+		}
+		if next.messageType != first.messageType || next.control || next.backlog != nil || full(next) {
+			other = &next
+			break
+		}
+		// Waiting for more may have used up the deadline WritePump set
+		c.conn.SetWriteDeadline(c.writeDeadline())
+		w.Write(next.data)
+		count++
+		size += len(next.data)
+	}
+
+	c.conn.SetWriteDeadline(c.writeDeadline())
+	if err = w.Close(); err != nil {
+		return closed, err
+	}
+	c.countSent(count, size)
+	switch {
+	case other == nil:
+	case other.backlog != nil:
+		err = c.startWarmup(other.backlog)
+	default:
+		if err = c.writeFrame(*other); err == nil {
+			c.countSent(1, len(other.data))
+		}
+	}
+	return closed, err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// relayText hands the hub a text message from username in room, as
+// ReadPump would.
+func relayText(hub *Hub, room, username, data string) {
+	hub.broadcast <- Message{Room: room, From: username, Type: websocket.TextMessage, Data: []byte(data), Received: time.Now()}
+}
+
+func TestBatchWritesNoticesOnTheirOwn(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.Hub.BatchMaxMessages = 64
+		cfg.Hub.BatchFlushInterval = 200 * time.Millisecond
+	})
+	bob := srv.connect(t, "r", "bob", "presence=1")
+	if _, data := readFrame(t, bob); !strings.Contains(string(data), `"snapshot"`) {
+		t.Fatalf("bob's first message is %s, want his snapshot", data)
+	}
+
+	// carol's join notice arrives while the batch waits for more
+	relayText(srv.hub, "r", "alice", "a\n")
+	relayText(srv.hub, "r", "alice", "b\n")
+	srv.connect(t, "r", "carol", "")
+	relayText(srv.hub, "r", "alice", "c\n")
+
+	want := []string{"a\nb\n", "", "c\n"}
+	for i, w := range want {
+		_, data := readFrame(t, bob)
+		if w != "" {
+			if string(data) != w {
+				t.Errorf("message %d = %q, want the batch %q", i, data, w)
+			}
+			continue
+		}
+		var notice presenceEvent
+		if err := json.Unmarshal(data, &notice); err != nil || notice.Event != "join" || notice.User != "carol" {
+			t.Errorf("message %d = %q, want carol's join notice on its own", i, data)
+		}
+	}
+}
+
+func TestBatchStaysWithinMaxBytes(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.Hub.BatchMaxMessages = 64
+		cfg.Hub.BatchMaxBytes = 10
+		cfg.Hub.BatchFlushInterval = 200 * time.Millisecond
+	})
+	bob := srv.connect(t, "r", "bob", "")
+	for _, data := range []string{"aaaa", "bbbb", "cccc", "dddd", "eeee", strings.Repeat("f", 12)} {
+		relayText(srv.hub, "r", "alice", data)
+	}
+
+	var all bytes.Buffer
+	for _, want := range []string{"aaaabbbb", "cccc", "ddddeeee", strings.Repeat("f", 12)} {
+		_, data := readFrame(t, bob)
+		if string(data) != want {
+			t.Errorf("received %q, want %q", data, want)
+		}
+		all.Write(data)
+	}
+	if all.String() != "aaaabbbbccccddddeeee"+strings.Repeat("f", 12) {
+		t.Errorf("batches add up to %q", all.String())
+	}
+}
+
+func TestBatchFlushIntervalLongerThanWriteWait(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.Hub.BatchMaxMessages = 64
+		cfg.Hub.BatchFlushInterval = 300 * time.Millisecond
+		cfg.Hub.WriteWait = 100 * time.Millisecond
+	})
+	bob := srv.connect(t, "r", "bob", "")
+	relayText(srv.hub, "r", "alice", "a\n")
+	relayText(srv.hub, "r", "alice", "b\n")
+	if _, data := readFrame(t, bob); string(data) != "a\nb\n" {
+		t.Fatalf("received %q, want both messages in one batch", data)
+	}
+	relayText(srv.hub, "r", "alice", "c\n")
+	if _, data := readFrame(t, bob); string(data) != "c\n" {
+		t.Fatalf("after the batch received %q", data)
+	}
+}
+
+// BenchmarkBatching relays a stream of small newline-delimited messages
+// to one receiver with batching off and on, reporting how many WebSocket
+// messages the receiver reads per message relayed.
+func BenchmarkBatching(b *testing.B) {
+	payload := []byte(`{"sensor":"temp","value":21.5}` + "\n")
+	for _, batch := range []int{1, 64} {
+		b.Run(fmt.Sprintf("max=%d", batch), func(b *testing.B) {
+			srv := newTestServer(b, func(cfg *Config) {
+				cfg.Hub.RateLimit = 0
+				cfg.Hub.BatchMaxMessages = batch
+				cfg.Hub.BackpressurePolicy = BackpressureBlock
+				cfg.Hub.BackpressureTimeout = time.Minute
+			})
+			receiver := srv.connect(b, "r", "bob", "")
+			sender := srv.connect(b, "r", "alice", "")
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			sent := make(chan error, 1)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if err := sender.WriteMessage(websocket.TextMessage, payload); err != nil {
+						sent <- err
+						return
+					}
+				}
+				sent <- nil
+			}()
+			reads, want := 0, b.N*len(payload)
+			for received := 0; received < want; reads++ {
+				_, data, err := receiver.ReadMessage()
+				if err != nil {
+					b.Fatal(err)
+				}
+				received += len(data)
+			}
+			b.StopTimer()
+			if err := <-sent; err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/msg")
+		})
+	}
+}
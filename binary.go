@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// The binary protocol, selected with ?protocol=binary or the relay.binary
+// subprotocol, carries control messages without JSON so clients handling
+// frequent presence updates need not parse them. Every frame in either
+// direction is a binary WebSocket message whose first byte says what it
+// is:
+//
+//	0x00 data     the rest is the payload, relayed as a binary message
+//	0x01 control  the next byte is the control type, the rest its body
+//
+// Control types:
+//
+//	0x00 json      body is a JSON control frame as in the text protocols,
+//	               for notices without a binary form, e.g. quota status
+//	0x01 presence  server to client: event byte (1 join, 2 leave,
+//	               3 snapshot), room, then the user for join and leave or a
+//	               count and the users for a snapshot
+//	0x02 roster    client to server with no body: asks for the room's users;
+//	               server to client: room, count, users
+//	0x03 error     server to client: code as a uvarint, reason, e.g.
+//	               "rate_limited", and detail, possibly empty
+//
+// Strings are a uvarint byte length followed by UTF-8 bytes, and counts
+// are uvarints. Data frames from other clients arrive as 0x00 frames
+// whether they were sent as text or binary.
+
+// First byte of a binary protocol frame
+const (
+	binaryData    byte = 0x00
+	binaryControl byte = 0x01
+)
+
+// Control types of binary protocol control frames
+const (
+	controlJSON     byte = 0x00
+	controlPresence byte = 0x01
+	controlRoster   byte = 0x02
+	controlError    byte = 0x03
+)
+
+// presenceEventCodes maps presence events to their binary codes.
+var presenceEventCodes = map[string]byte{
+	"join":     1,
+	"leave":    2,
+	"snapshot": 3,
+}
+
+// appendString appends s as a uvarint length and its bytes.
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendStrings appends a uvarint count followed by each string.
+func appendStrings(b []byte, list []string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(list)))
+	for _, s := range list {
+		b = appendString(b, s)
+	}
+	return b
+}
+
+// encodePresence returns the binary form of a presence event.
+func encodePresence(e presenceEvent) []byte {
+	b := []byte{binaryControl, controlPresence, presenceEventCodes[e.Event]}
+	b = appendString(b, e.Room)
+	if e.Event == "snapshot" {
+		return appendStrings(b, e.Users)
+	}
+	return appendString(b, e.User)
+}
+
+// encodeRoster returns the binary form of a roster frame.
+func encodeRoster(r rosterFrame) []byte {
+	b := appendString([]byte{binaryControl, controlRoster}, r.Room)
+	return appendStrings(b, r.Users)
+}
+
+// encodeNotice converts a JSON server notice to its binary form: errors
+// get their own control type, anything else is wrapped as a JSON control
+// frame.
+func encodeNotice(data []byte) []byte {
+	var notice struct {
+		Type   string `json:"type"`
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+		Detail string `json:"detail"`
+	}
+	if json.Unmarshal(data, &notice) == nil && notice.Type == "error" && notice.Reason != "" {
+		b := binary.AppendUvarint([]byte{binaryControl, controlError}, uint64(notice.Code))
+		b = appendString(b, notice.Reason)
+		return appendString(b, notice.Detail)
+	}
+	return append([]byte{binaryControl, controlJSON}, data...)
+}
+
+// writeFrame writes f to the connection in the client's protocol. Server
+// notices go out in the client's control encoding, and for the binary
+// protocol data frames get the data byte in front.
+func (c *Client) writeFrame(f frame) error {
+	if f.control {
+		messageType, data := c.encoding.encodeControl(f)
+		return c.conn.WriteMessage(messageType, data)
+	}
+	if c.protocol != ProtocolBinary {
+		return c.conn.WriteMessage(f.messageType, f.data)
+	}
+	w, err := c.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	w.Write([]byte{binaryData})
+	w.Write(f.data)
+	return w.Close()
+}
+
+// readBinaryFrame handles a frame from a binary protocol client. It
+// returns the payload of a data frame for relaying, or reports false once
+// it has handled a control frame or rejected an invalid one.
+func (c *Client) readBinaryFrame(messageType int, data []byte) ([]byte, bool) {
+	if messageType != websocket.BinaryMessage || len(data) == 0 {
+		sendError(c, http.StatusBadRequest, "invalid_frame", "binary protocol frames must be non-empty binary messages")
+		return nil, false
+	}
+	switch {
+	case data[0] == binaryData:
+		return data[1:], true
+	case data[0] == binaryControl && len(data) >= 2:
+		switch data[1] {
+		case controlRoster:
+			c.sendFrame(c.roster())
+			return nil, false
+		case controlJSON:
+			if c.handleControl(data[2:]) {
+				return nil, false
+			}
+		}
+	}
+	sendError(c, http.StatusBadRequest, "invalid_frame", "frames must start with 0x00 for data or 0x01 and a known control type")
+	return nil, false
+}
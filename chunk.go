@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// A client connecting with ?chunked=1 receives relayed messages larger
+// than ChunkSize in pieces, so one huge message cannot hold up everything
+// queued behind it. Each piece is announced by a text notice
+//
+//	{"type":"chunk","id":1,"offset":0,"size":10485760,"text":false}
+//
+// and follows it as a binary message of at most ChunkSize bytes, even for
+// text messages, which are only valid UTF-8 once reassembled. Pieces of a
+// message arrive in order; the client appends them by id until offset plus
+// the piece's length reaches size. Between pieces, WritePump writes the
+// smaller frames queued meanwhile, and pieces of several large messages
+// take turns, so each message, large or small, waits for at most one
+// piece per large message ahead of it.
+
+// chunkNotice announces the piece of a chunked message that follows it.
+type chunkNotice struct {
+	Type   string `json:"type"`
+	ID     uint64 `json:"id"`
+	Offset int    `json:"offset"`
+	Size   int    `json:"size"`
+	Text   bool   `json:"text"`
+}
+
+// chunkedMessage is a large message being written piece by piece.
+type chunkedMessage struct {
+	id     uint64
+	f      frame
+	offset int
+}
+
+// needsChunking reports whether f must be written in pieces to the client.
+func (c *Client) needsChunking(f frame) bool {
+	return c.chunked && !f.control && len(f.data) > c.hub.config.ChunkSize
+}
+
+// writeChunked writes first, which needsChunking, in pieces. After each
+// piece it writes whatever was queued meanwhile: small frames whole, while
+// other large ones join the rotation of chunked messages. It returns once
+// every chunked message is written, reporting whether send was closed or
+// the client's eviction grace ran out.
+func (c *Client) writeChunked(first frame) (closed bool, err error) {
+	active := []*chunkedMessage{c.startChunked(first)}
+	for len(active) > 0 {
+		if c.drainExpired() {
+			return true, nil
+		}
+		if err := c.flushPriority(); err != nil {
+			return false, err
+		}
+		m := active[0]
+		active = active[1:]
+		if err := c.writePiece(m); err != nil {
+			return false, err
+		}
+		if m.offset < len(m.f.data) {
+			active = append(active, m)
+		}
+
+		// Only what is queued now, so a steady stream of small frames
+		// cannot stall the large ones, and nothing behind a replay
+		// backlog, which WritePump paces out once this returns
+		for n := len(c.send); n > 0 && !closed && c.warmup == nil; n-- {
+			f, ok := <-c.send
+			if !ok {
+				closed = true
+				break
+			}
+			c.dequeued(f)
+			if c.expired(f) {
+				continue
+			}
+			if c.needsChunking(f) {
+				active = append(active, c.startChunked(f))
+				continue
+			}
+			if f.backlog != nil {
+				if err := c.startWarmup(f.backlog); err != nil {
+					return false, err
+				}
+				continue
+			}
+			c.conn.SetWriteDeadline(c.writeDeadline())
+			if err := c.writeFrame(f); err != nil {
+				return false, err
+			}
+			c.countSent(1, len(f.data))
+		}
+	}
+	return closed, nil
+}
+
+// startChunked assigns f the client's next chunked message ID.
+func (c *Client) startChunked(f frame) *chunkedMessage {
+	c.chunkID++
+	return &chunkedMessage{id: c.chunkID, f: f}
+}
+
+// writePiece writes the next piece of m with its notice.
+func (c *Client) writePiece(m *chunkedMessage) error {
+	end := m.offset + c.hub.config.ChunkSize
+	if end > len(m.f.data) {
+		end = len(m.f.data)
+	}
+	notice, _ := json.Marshal(chunkNotice{
+		Type:   "chunk",
+		ID:     m.id,
+		Offset: m.offset,
+		Size:   len(m.f.data),
+		Text:   m.f.messageType == websocket.TextMessage,
+	})
+	c.conn.SetWriteDeadline(c.writeDeadline())
+	if err := c.writeFrame(textFrame(notice)); err != nil {
+		return err
+	}
+	if err := c.writeFrame(frame{messageType: websocket.BinaryMessage, data: m.f.data[m.offset:end]}); err != nil {
+		return err
+	}
+	c.countSent(0, end-m.offset)
+	m.offset = end
+	if m.offset == len(m.f.data) {
+		c.countSent(1, 0)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestChunkedDelivery(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.ChunkSize = 1024 })
+	receiver := srv.connect(t, "r", "bob", "chunked=1")
+	sender := srv.connect(t, "r", "alice", "")
+
+	large := bytes.Repeat([]byte("0123456789"), 500)
+	sender.WriteMessage(websocket.TextMessage, large)
+	sender.WriteMessage(websocket.TextMessage, []byte("small"))
+
+	var assembled []byte
+	smallAfter := -1
+	for len(assembled) < len(large) {
+		_, data := readFrame(t, receiver)
+		if string(data) == "small" {
+			smallAfter = len(assembled)
+			continue
+		}
+		var notice chunkNotice
+		if err := json.Unmarshal(data, &notice); err != nil || notice.Type != "chunk" {
+			t.Fatalf("got %q, want a chunk notice", data)
+		}
+		if notice.ID != 1 || notice.Offset != len(assembled) || notice.Size != len(large) || !notice.Text {
+			t.Fatalf("chunk notice %+v after %d bytes", notice, len(assembled))
+		}
+		messageType, piece := readFrame(t, receiver)
+		if messageType != websocket.BinaryMessage || len(piece) > 1024 {
+			t.Fatalf("piece of type %d and %d bytes, want binary of at most 1024", messageType, len(piece))
+		}
+		assembled = append(assembled, piece...)
+	}
+	if !bytes.Equal(assembled, large) {
+		t.Fatal("reassembled message differs from the one sent")
+	}
+	if smallAfter < 0 {
+		_, data := readFrame(t, receiver)
+		if string(data) != "small" {
+			t.Fatalf("got %q, want the small message", data)
+		}
+		smallAfter = len(large)
+	}
+	if smallAfter >= len(large) {
+		t.Errorf("small message waited for all %d bytes of the large one", len(large))
+	}
+}
+
+// BenchmarkSmallBehindLarge measures how long a small message sent right
+// after a 4 MiB one takes to reach a receiver, with and without chunked
+// delivery.
+func BenchmarkSmallBehindLarge(b *testing.B) {
+	large := bytes.Repeat([]byte{0xAB}, 4<<20)
+	for _, chunked := range []bool{false, true} {
+		name, query := "whole", ""
+		if chunked {
+			name, query = "chunked", "chunked=1"
+		}
+		b.Run(name, func(b *testing.B) {
+			srv := newTestServer(b, func(cfg *Config) { cfg.Hub.RateLimit = 0 })
+			receiver := srv.connect(b, "r", "bob", query)
+			sender := srv.connect(b, "r", "alice", "")
+
+			var latency time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sender.WriteMessage(websocket.BinaryMessage, large)
+				sent := time.Now()
+				sender.WriteMessage(websocket.TextMessage, []byte("small"))
+				small, received := false, 0
+				for !small || received < len(large) {
+					messageType, data, err := receiver.ReadMessage()
+					if err != nil {
+						b.Fatal(err)
+					}
+					switch {
+					case messageType == websocket.BinaryMessage:
+						received += len(data)
+					case string(data) == "small":
+						latency += time.Since(sent)
+						small = true
+					}
+				}
+			}
+			b.ReportMetric(float64(latency.Microseconds())/float64(b.N), "small-us/op")
+		})
+	}
+}
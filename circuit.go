@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Circuit breaker policies applied while the bytes buffered for clients
+// exceed MaxBufferedBytes
+const (
+	// CircuitRejectPublishes refuses new messages from clients and HTTP
+	// publishers until the buffers drain.
+	CircuitRejectPublishes = "reject-publishes"
+	// CircuitDropSlowest disconnects the clients with the most bytes
+	// queued until the estimate is back under the recovery mark.
+	CircuitDropSlowest = "drop-slowest"
+)
+
+// circuitRecoverRatio is the fraction of MaxBufferedBytes the buffered
+// bytes must fall below before the circuit closes again, so it does not
+// flap around the threshold.
+const circuitRecoverRatio = 0.8
+
+// circuitSampleInterval is how often watchBuffered checks the estimate.
+const circuitSampleInterval = 100 * time.Millisecond
+
+// overloadedFrame is sent to a client whose message was rejected while the
+// circuit breaker is open
+var overloadedFrame = newErrorFrame(http.StatusServiceUnavailable, "overloaded", "server is shedding load; retry later")
+
+// enqueued records f as queued on the client's send channel. Every send
+// to client.send is followed by it, and every receive by dequeued, so
+// bufferedBytes tracks the bytes waiting across all clients, and pinned
+// the frames the drop-oldest policy must not evict.
+func (c *Client) enqueued(f frame) {
+	n := int64(len(f.data))
+	c.queuedBytes.Add(n)
+	c.hub.bufferedBytes.Add(n)
+	if !f.evictable() {
+		c.pinned.Add(1)
+	}
+}
+
+// dequeued records f as taken off the client's send channel.
+func (c *Client) dequeued(f frame) {
+	n := int64(len(f.data))
+	c.queuedBytes.Add(-n)
+	c.hub.bufferedBytes.Add(-n)
+	if !f.evictable() {
+		c.pinned.Add(-1)
+	}
+}
+
+// releaseQueued discards what is left on send and the priority lane once
+// nothing will write it, until Run closes send. Called when a pump exits.
+func (c *Client) releaseQueued() {
+	for f := range c.send {
+		c.dequeued(f)
+	}
+	c.releasePriority()
+}
+
+// watchBuffered opens the circuit breaker when the bytes buffered for
+// clients exceed MaxBufferedBytes and closes it once they fall below
+// circuitRecoverRatio of it, until Run exits. While open with
+// CircuitDropSlowest it asks Run to shed the slowest clients.
+func (h *Hub) watchBuffered() {
+	ticker := time.NewTicker(circuitSampleInterval)
+	defer ticker.Stop()
+	limit := h.config.MaxBufferedBytes
+	for {
+		select {
+		case <-ticker.C:
+			buffered := h.bufferedBytes.Load()
+			open := h.circuitOpen.Load()
+			switch {
+			case !open && buffered > limit:
+				h.circuitOpen.Store(true)
+				h.mu.Lock()
+				h.stats.CircuitTrips++
+				h.mu.Unlock()
+				slog.Warn("Circuit breaker open: too many bytes buffered for clients", "event", "circuit_open", "buffered_bytes", buffered, "limit", limit, "policy", h.config.CircuitBreakerPolicy)
+			case open && float64(buffered) < circuitRecoverRatio*float64(limit):
+				h.circuitOpen.Store(false)
+				slog.Info("Circuit breaker closed", "event", "circuit_closed", "buffered_bytes", buffered, "limit", limit)
+				continue
+			}
+			if h.circuitOpen.Load() && h.config.CircuitBreakerPolicy == CircuitDropSlowest {
+				select {
+				case h.sheds <- struct{}{}:
+				default:
+				}
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// shedSlowest disconnects the clients with the most bytes queued, largest
+// first, until the rest would fit under the recovery mark. Their queues
+// are discarded rather than flushed, so the bytes are freed at once.
+// Called from Run only.
+func (h *Hub) shedSlowest() {
+	var clients []*Client
+	h.forEachClient(func(client *Client) {
+		if client.queuedBytes.Load() > 0 {
+			clients = append(clients, client)
+		}
+	})
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].queuedBytes.Load() > clients[j].queuedBytes.Load()
+	})
+
+	target := int64(circuitRecoverRatio * float64(h.config.MaxBufferedBytes))
+	buffered := h.bufferedBytes.Load()
+	for _, client := range clients {
+		if buffered < target {
+			return
+		}
+		queued := client.queuedBytes.Load()
+		client.drainDeadline.Store(time.Now().UnixNano())
+		if client.conn != nil {
+			// Also cut short a write already blocked on the client
+			client.conn.UnderlyingConn().SetWriteDeadline(time.Now())
+		}
+		client.closeWith(websocket.CloseTryAgainLater, "server overloaded", nil)
+		if h.removeClient(client) {
+			h.mu.Lock()
+			h.stats.ShedClients++
+			h.mu.Unlock()
+			slog.Warn("User dropped: shedding load", "event", "shed", "username", client.username, "room", client.room, "queued_bytes", queued)
+			h.announcePresence(client, "leave")
+		}
+		buffered -= queued
+	}
+}
+
+// rejectingPublishes reports whether the circuit breaker is refusing new
+// messages.
+func (h *Hub) rejectingPublishes() bool {
+	return h.circuitOpen.Load() && h.config.CircuitBreakerPolicy == CircuitRejectPublishes
+}
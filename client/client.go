@@ -0,0 +1,220 @@
+// Package client connects to the relay server from Go.
+//
+// A Relay dials /ws/{username} (or /ws/{room}/{username}), relays raw
+// binary frames in both directions, answers the server's keepalive pings
+// and transparently reconnects with exponential backoff if the connection
+// drops:
+//
+//	r, err := client.Connect("ws://localhost:8080", "alice")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer r.Close()
+//
+//	r.Send([]byte("hello"))
+//	for msg := range r.Messages() {
+//		fmt.Printf("received %q\n", msg)
+//	}
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrNotConnected is returned by Send while the relay is reconnecting.
+var ErrNotConnected = errors.New("relay: not connected")
+
+// ErrClosed is returned by Send after Close.
+var ErrClosed = errors.New("relay: closed")
+
+// Options tunes a Relay. The zero value is valid.
+type Options struct {
+	// Room joins /ws/{room}/{username} instead of the default room.
+	Room string
+	// Header is sent with every handshake, e.g. an Authorization header.
+	Header http.Header
+	// MinBackoff and MaxBackoff bound the delay between reconnection
+	// attempts; they default to 500ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// WriteWait bounds each Send; it defaults to 10s.
+	WriteWait time.Duration
+}
+
+// Relay is a connection to the relay server that survives disconnects.
+type Relay struct {
+	url      string
+	opts     Options
+	messages chan []byte
+	done     chan struct{}
+	stopped  chan struct{}
+
+	mu     sync.Mutex // guards conn and closed, and serializes writes
+	conn   *websocket.Conn
+	closed bool
+}
+
+// Connect dials the server at serverURL (e.g. "ws://localhost:8080") as
+// username with default options.
+func Connect(serverURL, username string) (*Relay, error) {
+	return ConnectWithOptions(serverURL, username, Options{})
+}
+
+// ConnectWithOptions dials the server at serverURL as username. The first
+// dial must succeed; later disconnects are retried in the background.
+func ConnectWithOptions(serverURL, username string, opts Options) (*Relay, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+	if opts.WriteWait <= 0 {
+		opts.WriteWait = 10 * time.Second
+	}
+
+	path := "/ws/" + url.PathEscape(username)
+	if opts.Room != "" {
+		path = "/ws/" + url.PathEscape(opts.Room) + "/" + url.PathEscape(username)
+	}
+
+	r := &Relay{
+		url:      strings.TrimSuffix(serverURL, "/") + path,
+		opts:     opts,
+		messages: make(chan []byte, 256),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	conn, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	r.conn = conn
+	go r.run(conn)
+	return r, nil
+}
+
+// Messages returns the frames relayed from other clients. The channel is
+// closed after Close.
+func (r *Relay) Messages() <-chan []byte {
+	return r.messages
+}
+
+// Send relays data to the other clients in the room. It fails with
+// ErrNotConnected while a reconnect is in progress.
+func (r *Relay) Send(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	if r.conn == nil {
+		return ErrNotConnected
+	}
+	r.conn.SetWriteDeadline(time.Now().Add(r.opts.WriteWait))
+	return r.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// Close sends a close frame, stops reconnecting and closes Messages.
+func (r *Relay) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	var err error
+	if r.conn != nil {
+		r.conn.SetWriteDeadline(time.Now().Add(r.opts.WriteWait))
+		r.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		err = r.conn.Close()
+	}
+	r.mu.Unlock()
+
+	<-r.stopped
+	return err
+}
+
+func (r *Relay) dial() (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(r.url, r.opts.Header)
+	return conn, err
+}
+
+// run reads from conn until it fails, then reconnects with exponential
+// backoff until Close is called. Pings from the server are answered by
+// gorilla's default ping handler while reading.
+func (r *Relay) run(conn *websocket.Conn) {
+	defer close(r.stopped)
+	defer close(r.messages)
+
+	for {
+		r.readLoop(conn)
+
+		r.mu.Lock()
+		r.conn = nil
+		r.mu.Unlock()
+		conn.Close()
+
+		if conn = r.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+// readLoop forwards frames from conn to Messages until a read fails.
+func (r *Relay) readLoop(conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		select {
+		case r.messages <- data:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// reconnect dials until it succeeds or Close is called, in which case it
+// returns nil.
+func (r *Relay) reconnect() *websocket.Conn {
+	backoff := r.opts.MinBackoff
+	for {
+		select {
+		case <-r.done:
+			return nil
+		case <-time.After(backoff):
+		}
+
+		conn, err := r.dial()
+		if err == nil {
+			r.mu.Lock()
+			if r.closed {
+				r.mu.Unlock()
+				conn.Close()
+				return nil
+			}
+			r.conn = conn
+			r.mu.Unlock()
+			return conn
+		}
+
+		backoff *= 2
+		if backoff > r.opts.MaxBackoff {
+			backoff = r.opts.MaxBackoff
+		}
+	}
+}
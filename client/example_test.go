@@ -0,0 +1,37 @@
+package client_test
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"relay-server/client"
+)
+
+func Example() {
+	r, err := client.Connect("ws://localhost:8080", "alice")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	r.Send([]byte("hello"))
+	for msg := range r.Messages() {
+		fmt.Printf("received %q\n", msg)
+	}
+}
+
+func ExampleConnectWithOptions() {
+	r, err := client.ConnectWithOptions("ws://localhost:8080", "alice", client.Options{
+		Room:   "lobby",
+		Header: http.Header{"Authorization": {"Bearer s3cret"}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := r.Send([]byte("hello")); err == client.ErrNotConnected {
+		log.Print("reconnecting, try again later")
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+// Close codes sent in the close frame when the server disconnects a
+// client, in the 4000-4999 range RFC 6455 leaves to applications. The
+// server also uses the standard 1001 (going away) on shutdown and 1009
+// (message too big) for oversized messages.
+const (
+	// CloseDuplicateUsername: another connection took over the username
+	// with ?force=1.
+	CloseDuplicateUsername = 4001
+	// CloseKicked: an operator disconnected the client.
+	CloseKicked = 4003
+	// CloseIdleTimeout: the client sent nothing for IdleTimeout.
+	CloseIdleTimeout = 4004
+	// CloseRateLimited: the client exceeded RateLimitMaxViolations.
+	CloseRateLimited = 4008
+	// CloseBanned: the client collected BanStrikes strikes and is in
+	// cooldown.
+	CloseBanned = 4009
+	// CloseSlowConsumer: the client's send buffer filled up.
+	CloseSlowConsumer = 4010
+	// CloseQuotaExceeded: the client exceeded its quota with QuotaDisconnect.
+	CloseQuotaExceeded = 4029
+)
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings resolved from flags, environment
+// variables and defaults, in that order of precedence.
+type Config struct {
+	ListenAddr      string
+	UnixSocket      string
+	ShutdownTimeout time.Duration
+	AllowedOrigins  []string
+	AuthToken       string
+	AdminToken      string
+	TokenSecret     string
+	TokenTTL        time.Duration
+	MintToken       string
+	LogFormat       string
+	LogLevel        string
+	Quiet           bool
+	BenchmarkLoad   bool
+	Pprof           bool
+	ReadBufferSize  int
+	WriteBufferSize int
+	WriteBufferPool bool
+	Sink            string
+	SinkPath        string
+	Transformers    []string
+	CheckConfig     bool
+	Hub             HubConfig
+
+	// BlockedContent lists the content policy's patterns; see
+	// newContentPolicy
+	BlockedContent           []string
+	BlockedContentIgnoreCase bool
+
+	// SchemaFile names a JSON Schema that JSON protocol frames must
+	// conform to; see loadJSONSchema
+	SchemaFile string
+
+	// TrustedProxies lists the networks whose forwarding headers are
+	// believed; see parseTrustedProxies
+	TrustedProxies []string
+
+	// TLSCertFile and TLSKeyFile, if set, serve HTTPS and WSS, negotiating
+	// HTTP/2 with clients that support it. H2C serves HTTP/2 without TLS
+	// to clients that speak it with prior knowledge.
+	TLSCertFile string
+	TLSKeyFile  string
+	H2C         bool
+
+	// CORS headers for HTTP responses; see corsMiddleware
+	CORSOrigins     []string
+	CORSMethods     string
+	CORSHeaders     string
+	CORSCredentials bool
+
+	// settings records where each option was bound, for -check-config
+	settings *settings
+}
+
+// operatorToken is the token guarding the admin and peer endpoints:
+// ADMIN_TOKEN, falling back to AUTH_TOKEN.
+func (c *Config) operatorToken() string {
+	if c.AdminToken != "" {
+		return c.AdminToken
+	}
+	return c.AuthToken
+}
+
+// loadConfig parses command line flags, falling back to environment
+// variables and then to built-in defaults. On invalid settings it returns
+// every problem found, joined, along with the config as far as it was
+// resolved; only a malformed command line leaves the config nil.
+func loadConfig(args []string) (*Config, error) {
+	s := newSettings("relay-server")
+
+	host, port := "", "8080"
+	s.String(&host, "addr", "LISTEN_ADDR", "bind address, empty for all interfaces")
+	s.String(&port, "port", "PORT", "listen port")
+
+	cfg := &Config{
+		ShutdownTimeout: 15 * time.Second,
+		TokenTTL:        24 * time.Hour,
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		WriteBufferPool: true,
+		LogFormat:       "text",
+		LogLevel:        "info",
+		Sink:            SinkNone,
+		Hub:             DefaultHubConfig(),
+
+		CORSOrigins: []string{"*"},
+		CORSMethods: "GET, POST, OPTIONS",
+		CORSHeaders: "Content-Type, Authorization",
+	}
+	s.String(&cfg.UnixSocket, "unix-socket", "UNIX_SOCKET", "serve on this Unix domain socket instead of TCP")
+	s.String(&cfg.TLSCertFile, "tls-cert", "TLS_CERT_FILE", "PEM certificate file; with -tls-key, serve HTTPS and WSS with HTTP/2")
+	s.String(&cfg.TLSKeyFile, "tls-key", "TLS_KEY_FILE", "PEM private key file for -tls-cert")
+	s.Bool(&cfg.H2C, "h2c", "H2C", "also serve HTTP/2 over cleartext to clients with prior knowledge")
+	s.Duration(&cfg.ShutdownTimeout, "shutdown-timeout", "SHUTDOWN_TIMEOUT", "time allowed for clients to drain on shutdown")
+	s.List(&cfg.AllowedOrigins, "", "ALLOWED_ORIGINS", "comma-separated WebSocket origins, * for any")
+	s.List(&cfg.CORSOrigins, "", "CORS_ALLOWED_ORIGINS", "comma-separated origins allowed by CORS, * for any")
+	s.String(&cfg.CORSMethods, "", "CORS_ALLOWED_METHODS", "methods listed in Access-Control-Allow-Methods")
+	s.String(&cfg.CORSHeaders, "", "CORS_ALLOWED_HEADERS", "headers listed in Access-Control-Allow-Headers")
+	s.Bool(&cfg.CORSCredentials, "", "CORS_ALLOW_CREDENTIALS", "allow credentialed requests from listed origins")
+	s.Secret(&cfg.AuthToken, "AUTH_TOKEN")
+	s.Secret(&cfg.AdminToken, "ADMIN_TOKEN")
+	s.Secret(&cfg.TokenSecret, "TOKEN_SECRET")
+	s.Duration(&cfg.TokenTTL, "token-ttl", "TOKEN_TTL", "validity of tokens minted with -mint-token")
+	s.fs.StringVar(&cfg.MintToken, "mint-token", "", "print a token signed with TOKEN_SECRET for this username and exit")
+	s.fs.BoolVar(&cfg.CheckConfig, "check-config", false, "validate the settings, print the effective configuration as JSON and exit")
+	s.String(&cfg.LogFormat, "log-format", "LOG_FORMAT", "log output format: text or json")
+	s.Bool(&cfg.Quiet, "quiet", "QUIET", "replace the startup banner with a single startup log event")
+	s.String(&cfg.LogLevel, "log-level", "LOG_LEVEL", "minimum level of events logged: debug, info, warn or error")
+	s.Duration(&cfg.Hub.LogSummaryInterval, "log-summary-interval", "LOG_SUMMARY_INTERVAL", "interval between connection summary logs, 0 to disable")
+	s.String(&cfg.Sink, "sink", "SINK", "archive relayed messages: none or file")
+	s.String(&cfg.SinkPath, "sink-path", "SINK_PATH", "file the file sink appends JSON lines to")
+	s.List(&cfg.Transformers, "transformers", "TRANSFORMERS", "comma-separated message transformers applied in order: sender-header, sender-stamp")
+	s.List(&cfg.BlockedContent, "blocked-content", "BLOCKED_CONTENT", "comma-separated substrings, or regular expressions prefixed with re:, that block text messages containing them")
+	s.Bool(&cfg.BlockedContentIgnoreCase, "blocked-content-ignore-case", "BLOCKED_CONTENT_IGNORE_CASE", "match blocked content regardless of case")
+	s.String(&cfg.Hub.ContentPolicyAction, "content-policy-action", "CONTENT_POLICY_ACTION", "what happens to a client sending blocked content: drop or disconnect")
+	s.String(&cfg.SchemaFile, "schema-file", "SCHEMA_FILE", "JSON Schema file that messages from JSON protocol clients must conform to")
+	s.Bool(&cfg.BenchmarkLoad, "benchmark-load", "BENCHMARK_LOAD", "allow /test/benchmark?load=1 to run an in-process load test")
+	s.Bool(&cfg.Pprof, "pprof", "PPROF", "serve net/http/pprof profiles under /debug/pprof/, guarded by the admin token")
+	s.Int(&cfg.Hub.MaxClients, "max-clients", "MAX_CLIENTS", "maximum concurrent connections, 0 for unlimited")
+	s.Int(&cfg.Hub.Shards, "shards", "HUB_SHARDS", "independently locked client maps, defaults to GOMAXPROCS")
+	s.Duration(&cfg.Hub.PingInterval, "ping-interval", "PING_INTERVAL", "interval between keepalive pings")
+	s.Duration(&cfg.Hub.PongWait, "pong-wait", "PONG_WAIT", "read deadline extended by each pong")
+	s.Duration(&cfg.Hub.HeartbeatInterval, "heartbeat-interval", "HEARTBEAT_INTERVAL", "interval between application-level ping data frames, 0 to disable")
+	s.Duration(&cfg.Hub.WriteWait, "write-wait", "WRITE_WAIT", "deadline for each write to a client")
+	s.Duration(&cfg.Hub.EvictionGrace, "eviction-grace", "EVICTION_GRACE", "time a connection replaced by force=1 may spend flushing queued frames")
+	s.Duration(&cfg.Hub.IdleTimeout, "idle-timeout", "IDLE_TIMEOUT", "disconnect clients that send nothing for this long, 0 to disable")
+	s.Duration(&cfg.Hub.MaxConnLifetime, "max-conn-lifetime", "MAX_CONN_LIFETIME", "close connections open for this long so they reconnect elsewhere, 0 to disable")
+	s.Int64(&cfg.Hub.MaxMessageBytes, "max-message-bytes", "MAX_MESSAGE_BYTES", "largest message a client may send")
+	s.Int(&cfg.ReadBufferSize, "read-buffer-size", "READ_BUFFER_SIZE", "bytes of read buffer per connection; messages may still be larger")
+	s.Int(&cfg.WriteBufferSize, "write-buffer-size", "WRITE_BUFFER_SIZE", "bytes of write buffer per connection; messages may still be larger")
+	s.Bool(&cfg.WriteBufferPool, "write-buffer-pool", "WRITE_BUFFER_POOL", "share write buffers between connections instead of holding one per connection")
+	s.Int(&cfg.Hub.SendBuffer, "send-buffer", "SEND_BUFFER", "outbound frames queued per client before backpressure applies")
+	s.Int(&cfg.Hub.WarmupRate, "warmup-rate", "WARMUP_RATE", "messages per second at which history is replayed to new clients, 0 to queue it at once")
+	s.Int(&cfg.Hub.PriorityBuffer, "priority-buffer", "PRIORITY_BUFFER", "priority frames queued per client ahead of the send buffer, 0 to disable the priority lane")
+	s.Duration(&cfg.Hub.MessageTTL, "message-ttl", "MESSAGE_TTL", "discard relayed messages queued for a client longer than this, 0 to disable")
+	s.Int(&cfg.Hub.ChunkSize, "chunk-size", "CHUNK_SIZE", "largest piece of a message written at once to ?chunked=1 clients, 0 to disable chunking")
+	s.Int(&cfg.Hub.BatchMaxMessages, "batch-max-messages", "BATCH_MAX_MESSAGES", "coalesce up to this many queued frames per write, 0 or 1 to disable")
+	s.Int(&cfg.Hub.BatchMaxBytes, "batch-max-bytes", "BATCH_MAX_BYTES", "stop adding frames to a batch at this size, 0 for no limit")
+	s.Duration(&cfg.Hub.BatchFlushInterval, "batch-flush-interval", "BATCH_FLUSH_INTERVAL", "wait this long for more frames before writing a batch")
+	s.Int(&cfg.Hub.HistorySize, "history-size", "HISTORY_SIZE", "recent messages kept per room for replay, 0 to disable")
+	s.List(&cfg.Hub.Subprotocols, "subprotocols", "SUBPROTOCOLS", "comma-separated WebSocket subprotocols accepted, in order of preference")
+	s.Bool(&cfg.Hub.StrictSubprotocols, "strict-subprotocols", "STRICT_SUBPROTOCOLS", "reject clients offering only unsupported subprotocols")
+	s.Bool(&cfg.Hub.Compression, "compression", "COMPRESSION", "negotiate permessage-deflate compression")
+	s.Int(&cfg.Hub.CompressionLevel, "compression-level", "COMPRESSION_LEVEL", "deflate level from -2 (Huffman only) to 9 (best)")
+	s.Bool(&cfg.Hub.LatencyTracking, "latency-tracking", "LATENCY_TRACKING", "record relay latency percentiles for /stats and /metrics")
+	s.Bool(&cfg.Hub.AllowAnonymous, "allow-anonymous", "ALLOW_ANONYMOUS", "give WebSocket clients connecting without a username a generated anon-<random> one")
+	s.Bool(&cfg.Hub.SenderSequence, "sender-sequence", "SENDER_SEQUENCE", "stamp JSON protocol envelopes with a per-sender sequence number")
+	s.Duration(&cfg.Hub.DedupWindow, "dedup-window", "DEDUP_WINDOW", "suppress identical messages from the same user within this window, 0 to disable")
+	s.String(&cfg.Hub.BackpressurePolicy, "backpressure-policy", "BACKPRESSURE_POLICY", "full send buffer handling: drop-client, drop-message, drop-oldest or block-with-timeout")
+	s.List(&cfg.Hub.Peers, "peers", "PEERS", "comma-separated /peer URLs of other instances to forward messages to, e.g. ws://relay-2:8080/peer")
+	s.String(&cfg.Hub.NodeID, "node-id", "NODE_ID", "ID marking messages that originate on this instance, random by default")
+	s.Int64(&cfg.Hub.MaxBufferedBytes, "max-buffered-bytes", "MAX_BUFFERED_BYTES", "bytes queued for all clients at which the circuit breaker opens, 0 to disable")
+	s.String(&cfg.Hub.CircuitBreakerPolicy, "circuit-breaker-policy", "CIRCUIT_BREAKER_POLICY", "load shedding while the circuit breaker is open: reject-publishes or drop-slowest")
+	s.Duration(&cfg.Hub.BackpressureTimeout, "backpressure-timeout", "BACKPRESSURE_TIMEOUT", "wait for buffer space under block-with-timeout")
+	s.Float(&cfg.Hub.RateLimit, "rate-limit", "RATE_LIMIT", "messages per second each client may publish, 0 to disable")
+	s.Int(&cfg.Hub.RateBurst, "rate-burst", "RATE_BURST", "burst of messages allowed above the per-client rate")
+	s.Float(&cfg.Hub.GlobalRateLimit, "global-rate-limit", "GLOBAL_RATE_LIMIT", "messages per second across all clients, 0 to disable")
+	s.Int(&cfg.Hub.GlobalRateBurst, "global-rate-burst", "GLOBAL_RATE_BURST", "burst of messages allowed above the global rate")
+	s.Float(&cfg.Hub.SaturationThreshold, "saturation-threshold", "SATURATION_THRESHOLD", "fraction of the broadcast queue in use at which it counts as saturated")
+	s.Duration(&cfg.Hub.SaturationPeriod, "saturation-period", "SATURATION_PERIOD", "how long the broadcast queue must stay saturated before /ready fails, 0 to never fail")
+	s.Int(&cfg.Hub.FanOutWorkers, "fanout-workers", "FANOUT_WORKERS", "goroutines sharing the fan-out of broadcasts to large rooms, 0 to fan out on the hub goroutine")
+	s.Int(&cfg.Hub.HealthDropRate, "health-drop-rate", "HEALTH_DROP_RATE", "slow-consumer drops per minute at which /health reports degraded, 0 to disable")
+	s.Int(&cfg.Hub.HealthMaxGoroutines, "health-max-goroutines", "HEALTH_MAX_GOROUTINES", "running goroutines at which /health reports degraded, 0 to disable")
+	s.Float(&cfg.Hub.ConnectionRateLimit, "conn-rate-limit", "CONN_RATE_LIMIT", "new connections accepted per second, 0 to disable")
+	s.Int(&cfg.Hub.ConnectionRateBurst, "conn-rate-burst", "CONN_RATE_BURST", "burst of connections allowed above the connection rate")
+	s.Int(&cfg.Hub.MaxConnBytesPerSec, "max-conn-bytes-per-sec", "MAX_CONN_BYTES_PER_SEC", "bytes per second each connection may send and receive, 0 for unlimited")
+	s.Int(&cfg.Hub.MaxConnsPerIP, "max-conns-per-ip", "MAX_CONNS_PER_IP", "connections allowed from one IP address, 0 for no limit")
+	s.List(&cfg.Hub.ProxyHeaders, "proxy-headers", "PROXY_HEADERS", "comma-separated headers carrying the client IP set by a trusted proxy, e.g. X-Forwarded-For")
+	s.List(&cfg.TrustedProxies, "trusted-proxies", "TRUSTED_PROXIES", "comma-separated CIDRs or addresses of proxies whose forwarding headers are believed, e.g. 10.0.0.0/8")
+	s.Int(&cfg.Hub.BanStrikes, "ban-strikes", "BAN_STRIKES", "runs of rate-limited messages before a client is banned, 0 to never ban")
+	s.Duration(&cfg.Hub.BanCooldown, "ban-cooldown", "BAN_COOLDOWN", "how long a banned username and IP are refused")
+	s.Int(&cfg.Hub.RateLimitMaxViolations, "rate-limit-max-violations", "RATE_LIMIT_MAX_VIOLATIONS", "throttled messages before a client is disconnected, 0 to never disconnect")
+
+	var quotaOverrides string
+	s.Int64(&cfg.Hub.Quota.Messages, "quota-messages", "QUOTA_MESSAGES", "messages each user may publish per quota window, 0 for unlimited")
+	s.Int64(&cfg.Hub.Quota.Bytes, "quota-bytes", "QUOTA_BYTES", "bytes each user may publish per quota window, 0 for unlimited")
+	s.Duration(&cfg.Hub.QuotaWindow, "quota-window", "QUOTA_WINDOW", "period after which a user's quota resets")
+	s.Bool(&cfg.Hub.QuotaDisconnect, "quota-disconnect", "QUOTA_DISCONNECT", "disconnect clients that exceed their quota")
+	s.String(&quotaOverrides, "", "QUOTA_OVERRIDES", `per-user quotas as JSON, e.g. {"alice":{"messages":100,"bytes":0}}`)
+
+	if err := s.Parse(args); err != nil {
+		return nil, err
+	}
+	cfg.settings = s
+
+	// Every problem is collected rather than just the first, so one run
+	// of -check-config lists them all
+	problems := s.errs
+	if quotaOverrides != "" {
+		if err := json.Unmarshal([]byte(quotaOverrides), &cfg.Hub.QuotaOverrides); err != nil {
+			problems = append(problems, fmt.Errorf("invalid QUOTA_OVERRIDES: %w", err))
+		}
+	}
+
+	var err error
+	if cfg.ListenAddr, err = resolveListenAddr(host, port); err != nil {
+		problems = append(problems, err)
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		problems = append(problems, fmt.Errorf("invalid shutdown timeout %s: must be positive", cfg.ShutdownTimeout))
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		problems = append(problems, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	} else if cfg.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			problems = append(problems, fmt.Errorf("invalid TLS certificate: %w", err))
+		}
+		if cfg.H2C {
+			problems = append(problems, errors.New("H2C serves cleartext HTTP/2 and cannot be combined with TLS, which negotiates HTTP/2 itself"))
+		}
+	}
+	if cfg.H2C && !h2cSupported {
+		problems = append(problems, errors.New("H2C requires a server built with Go 1.24 or later"))
+	}
+	if cfg.ReadBufferSize <= 0 || cfg.WriteBufferSize <= 0 {
+		problems = append(problems, fmt.Errorf("invalid buffer sizes %d/%d: must be positive", cfg.ReadBufferSize, cfg.WriteBufferSize))
+	}
+	if cfg.MintToken != "" && cfg.TokenSecret == "" {
+		problems = append(problems, errors.New("-mint-token requires TOKEN_SECRET"))
+	}
+	if cfg.TokenTTL <= 0 {
+		problems = append(problems, fmt.Errorf("invalid token TTL %s: must be positive", cfg.TokenTTL))
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		problems = append(problems, err)
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		problems = append(problems, fmt.Errorf("invalid log format %q: must be json or text", cfg.LogFormat))
+	}
+	problems = append(problems, checkSink(cfg.Sink, cfg.SinkPath))
+	if _, err := newTransformers(cfg.Transformers); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := newContentPolicy(cfg.BlockedContent, cfg.BlockedContentIgnoreCase); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := loadJSONSchema(cfg.SchemaFile); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		problems = append(problems, err)
+	}
+	problems = append(problems, cfg.Hub.Validate())
+	if err := errors.Join(problems...); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// checkConfig implements -check-config: it prints every problem found
+// while loading cfg to stderr and returns 1, or prints the effective
+// settings as JSON to stdout and returns 0.
+func checkConfig(cfg *Config, err error) int {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "❌ Invalid configuration:")
+		for _, problem := range flattenErrors(err) {
+			fmt.Fprintf(os.Stderr, "  - %v\n", problem)
+		}
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(cfg.settings.effective())
+	return 0
+}
+
+// flattenErrors splits errors joined with errors.Join, at any depth.
+func flattenErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, flattenErrors(e)...)
+	}
+	return errs
+}
+
+// resolveListenAddr validates the bind host and port and joins them into
+// an address suitable for net.Listen.
+func resolveListenAddr(host, port string) (string, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return "", fmt.Errorf("invalid port %q: must be a number between 0 and 65535", port)
+	}
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid bind address %q: expected a host or IP without a port", host)
+	}
+
+	addr := net.JoinHostPort(host, port)
+	if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	return addr, nil
+}
+
+// settings binds options to command line flags whose defaults are taken
+// from the environment. Each bound pointer holds the built-in default on
+// entry. Malformed environment values are collected in errs.
+type settings struct {
+	fs   *flag.FlagSet
+	errs []error
+
+	// bound lists every option by environment variable, for effective
+	bound []boundSetting
+}
+
+// boundSetting is an option's environment variable and the pointer it
+// was bound to. Secrets are redacted by effective.
+type boundSetting struct {
+	env    string
+	p      interface{}
+	secret bool
+}
+
+// bind records an option for effective.
+func (s *settings) bind(env string, p interface{}) {
+	s.bound = append(s.bound, boundSetting{env: env, p: p})
+}
+
+// effective returns the resolved value of every bound option keyed by its
+// environment variable, with durations as strings and secrets redacted.
+func (s *settings) effective() map[string]interface{} {
+	values := make(map[string]interface{}, len(s.bound))
+	for _, b := range s.bound {
+		var value interface{}
+		switch p := b.p.(type) {
+		case *string:
+			value = *p
+			if b.secret && *p != "" {
+				value = "<redacted>"
+			}
+		case *time.Duration:
+			value = p.String()
+		case *[]string:
+			list := *p
+			if list == nil {
+				list = []string{}
+			}
+			value = list
+		case *int:
+			value = *p
+		case *int64:
+			value = *p
+		case *bool:
+			value = *p
+		case *float64:
+			value = *p
+		}
+		values[b.env] = value
+	}
+	return values
+}
+
+// Secret binds an environment-only string option whose value is
+// redacted from effective.
+func (s *settings) Secret(p *string, env string) {
+	if value, ok := os.LookupEnv(env); ok && value != "" {
+		*p = value
+	}
+	s.bound = append(s.bound, boundSetting{env: env, p: p, secret: true})
+}
+
+func newSettings(name string) *settings {
+	return &settings{fs: flag.NewFlagSet(name, flag.ContinueOnError)}
+}
+
+// Parse parses the command line. Malformed environment values are left
+// in errs for the caller to report alongside its own checks.
+func (s *settings) Parse(args []string) error {
+	return s.fs.Parse(args)
+}
+
+// String binds a string option. An empty flag name makes it environment-only.
+func (s *settings) String(p *string, name, env, usage string) {
+	s.bind(env, p)
+	if value, ok := os.LookupEnv(env); ok && value != "" {
+		*p = value
+	}
+	if name != "" {
+		s.fs.StringVar(p, name, *p, usage+" (env "+env+")")
+	}
+}
+
+// Int binds an integer option. An empty flag name makes it environment-only.
+func (s *settings) Int(p *int, name, env, usage string) {
+	s.bind(env, p)
+	if value := os.Getenv(env); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			s.errs = append(s.errs, fmt.Errorf("invalid %s %q: must be an integer", env, value))
+		} else {
+			*p = n
+		}
+	}
+	if name != "" {
+		s.fs.IntVar(p, name, *p, usage+" (env "+env+")")
+	}
+}
+
+// Int64 binds a 64-bit integer option. An empty flag name makes it
+// environment-only.
+func (s *settings) Int64(p *int64, name, env, usage string) {
+	s.bind(env, p)
+	if value := os.Getenv(env); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			s.errs = append(s.errs, fmt.Errorf("invalid %s %q: must be an integer", env, value))
+		} else {
+			*p = n
+		}
+	}
+	if name != "" {
+		s.fs.Int64Var(p, name, *p, usage+" (env "+env+")")
+	}
+}
+
+// Bool binds a boolean option. An empty flag name makes it environment-only.
+func (s *settings) Bool(p *bool, name, env, usage string) {
+	s.bind(env, p)
+	if value := os.Getenv(env); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			s.errs = append(s.errs, fmt.Errorf("invalid %s %q: must be a boolean", env, value))
+		} else {
+			*p = b
+		}
+	}
+	if name != "" {
+		s.fs.BoolVar(p, name, *p, usage+" (env "+env+")")
+	}
+}
+
+// Float binds a floating point option. An empty flag name makes it
+// environment-only.
+func (s *settings) Float(p *float64, name, env, usage string) {
+	s.bind(env, p)
+	if value := os.Getenv(env); value != "" {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			s.errs = append(s.errs, fmt.Errorf("invalid %s %q: must be a number", env, value))
+		} else {
+			*p = f
+		}
+	}
+	if name != "" {
+		s.fs.Float64Var(p, name, *p, usage+" (env "+env+")")
+	}
+}
+
+// Duration binds a duration option. An empty flag name makes it environment-only.
+func (s *settings) Duration(p *time.Duration, name, env, usage string) {
+	s.bind(env, p)
+	if value := os.Getenv(env); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			s.errs = append(s.errs, fmt.Errorf("invalid %s %q: %w", env, value, err))
+		} else {
+			*p = d
+		}
+	}
+	if name != "" {
+		s.fs.DurationVar(p, name, *p, usage+" (env "+env+")")
+	}
+}
+
+// List binds a comma-separated list option. An empty flag name makes it
+// environment-only.
+func (s *settings) List(p *[]string, name, env, usage string) {
+	s.bind(env, p)
+	if value := os.Getenv(env); value != "" {
+		*p = splitList(value)
+	}
+	if name != "" {
+		s.fs.Func(name, usage+" (env "+env+")", func(value string) error {
+			*p = splitList(value)
+			return nil
+		})
+	}
+}
+
+// splitList splits a comma-separated value, trimming blanks and dropping
+// empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
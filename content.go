@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Content policy actions for messages matching BLOCKED_CONTENT
+const (
+	// ContentPolicyDrop discards the message and tells the sender.
+	ContentPolicyDrop = "drop"
+	// ContentPolicyDisconnect also closes the sender's connection.
+	ContentPolicyDisconnect = "disconnect"
+)
+
+// regexpPrefix marks a content policy pattern as a regular expression
+// rather than a substring.
+const regexpPrefix = "re:"
+
+// contentBlockedFrame is sent to a client whose message the content
+// policy blocked
+var contentBlockedFrame = newErrorFrame(http.StatusForbidden, "content_blocked", "message matches the server's content policy")
+
+// ContentPolicy blocks text messages matching any of its patterns. Binary
+// messages are opaque to the server and never checked.
+type ContentPolicy struct {
+	substrings []string
+	patterns   []*regexp.Regexp
+	ignoreCase bool
+}
+
+// newContentPolicy compiles patterns, each a substring or, prefixed with
+// "re:", a regular expression. With ignoreCase both kinds match regardless
+// of case. It returns nil when there are no patterns.
+func newContentPolicy(patterns []string, ignoreCase bool) (*ContentPolicy, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	p := &ContentPolicy{ignoreCase: ignoreCase}
+	for _, pattern := range patterns {
+		expr, ok := strings.CutPrefix(pattern, regexpPrefix)
+		if !ok {
+			if ignoreCase {
+				pattern = strings.ToLower(pattern)
+			}
+			p.substrings = append(p.substrings, pattern)
+			continue
+		}
+		if ignoreCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blocked content pattern %q: %v", pattern, err)
+		}
+		p.patterns = append(p.patterns, re)
+	}
+	return p, nil
+}
+
+// blocks reports whether a text message must be blocked.
+func (p *ContentPolicy) blocks(data []byte) bool {
+	text := string(data)
+	if p.ignoreCase && len(p.substrings) > 0 {
+		text = strings.ToLower(text)
+	}
+	for _, s := range p.substrings {
+		if strings.Contains(text, s) {
+			return true
+		}
+	}
+	for _, re := range p.patterns {
+		if re.Match(data) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedContent reports whether the content policy blocks a message of
+// messageType from username, counting and logging it if so.
+func (h *Hub) blockedContent(messageType int, data []byte, username, room string) bool {
+	policy := h.config.ContentPolicy
+	if policy == nil || messageType != websocket.TextMessage || !policy.blocks(data) {
+		return false
+	}
+	h.mu.Lock()
+	h.stats.BlockedMessages++
+	h.mu.Unlock()
+	slog.Info("Message blocked by content policy", "event", "content_blocked", "username", username, "room", room, "bytes", len(data))
+	return true
+}
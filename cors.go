@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+)
+
+// corsMiddleware adds CORS headers to every HTTP response and answers
+// preflight requests. With a "*" entry in origins any origin is allowed
+// with a wildcard; otherwise a listed request Origin is echoed back, which
+// browsers require for credentialed requests, and others get no CORS
+// headers at all.
+func corsMiddleware(origins []string, methods, headers string, credentials bool) func(http.Handler) http.Handler {
+	allowAll := false
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		if origin == "*" {
+			allowAll = true
+		}
+		allowed[origin] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			switch {
+			case allowAll:
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			case allowed[origin]:
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+				if credentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+			default:
+				w.Header().Add("Vary", "Origin")
+			}
+			if allowAll || allowed[origin] {
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
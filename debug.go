@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleRuntime reports goroutine and memory figures alongside the client
+// count, so goroutine or heap growth can be correlated with connections
+// when hunting leaks. Every client runs two pumps, so goroutines should
+// track about twice the client count.
+func HandleRuntime(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+
+		hub.mu.RLock()
+		clients := hub.clientCount()
+		hub.mu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"goroutines":        runtime.NumGoroutine(),
+			"connected_clients": clients,
+			"memory": map[string]interface{}{
+				"alloc_bytes":       mem.Alloc,
+				"total_alloc_bytes": mem.TotalAlloc,
+				"heap_inuse_bytes":  mem.HeapInuse,
+				"sys_bytes":         mem.Sys,
+				"num_gc":            mem.NumGC,
+			},
+		})
+	}
+}
+
+// registerPprof serves the net/http/pprof profiles under /debug/pprof/,
+// each guarded by wrap.
+func registerPprof(router *mux.Router, wrap func(http.HandlerFunc) http.HandlerFunc) {
+	router.HandleFunc("/debug/pprof/cmdline", wrap(pprof.Cmdline))
+	router.HandleFunc("/debug/pprof/profile", wrap(pprof.Profile))
+	router.HandleFunc("/debug/pprof/symbol", wrap(pprof.Symbol))
+	router.HandleFunc("/debug/pprof/trace", wrap(pprof.Trace))
+	router.PathPrefix("/debug/pprof/").HandlerFunc(wrap(pprof.Index))
+}
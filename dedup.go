@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+)
+
+// dedupCache remembers hashes of recently relayed messages so retransmitted
+// duplicates can be suppressed. Entries expire in insertion order, which is
+// also expiry order, so a queue is enough to prune them. It is only touched
+// by the hub's Run goroutine.
+type dedupCache struct {
+	window time.Duration
+	seen   map[uint64]time.Time
+	order  []dedupEntry
+}
+
+type dedupEntry struct {
+	key uint64
+	at  time.Time
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	return &dedupCache{window: window, seen: make(map[uint64]time.Time)}
+}
+
+// dedupKey hashes a message's room, sender and payload, so identical
+// payloads from different users or rooms are not mistaken for duplicates.
+func dedupKey(m Message) uint64 {
+	f := fnv.New64a()
+	for _, field := range []string{m.Room, m.From} {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(field)))
+		f.Write(n[:])
+		f.Write([]byte(field))
+	}
+	f.Write(m.Data)
+	return f.Sum64()
+}
+
+// duplicate reports whether m was already seen within the window, and
+// records it if not.
+func (d *dedupCache) duplicate(m Message, now time.Time) bool {
+	d.expire(now)
+	key := dedupKey(m)
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+	d.seen[key] = now
+	d.order = append(d.order, dedupEntry{key: key, at: now})
+	return false
+}
+
+// expire forgets hashes older than the window.
+func (d *dedupCache) expire(now time.Time) {
+	i := 0
+	for ; i < len(d.order) && now.Sub(d.order[i].at) >= d.window; i++ {
+		delete(d.seen, d.order[i].key)
+	}
+	d.order = d.order[i:]
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HandleEcho upgrades the connection and writes every message back as it
+// arrived, keeping it alive with pings like a relay connection. It never
+// touches the hub's clients, rooms or limits, so a client that can echo
+// but not relay knows the trouble lies with the relay rather than the
+// network or a proxy in between. Messages are bounded by MaxMessageBytes
+// and the connection is closed on shutdown.
+func HandleEcho(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		slog.Debug("Echo connection opened", "event", "echo_connected", "remote_addr", r.RemoteAddr)
+
+		// Pings and the shutdown close frame go through WriteControl, which
+		// is safe alongside the echo loop's writes.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			ticker := time.NewTicker(hub.config.PingInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(hub.config.WriteWait)) != nil {
+						return
+					}
+				case <-hub.done:
+					conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"), time.Now().Add(hub.config.WriteWait))
+					conn.Close()
+					return
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		conn.SetReadLimit(hub.config.MaxMessageBytes)
+		conn.SetReadDeadline(time.Now().Add(hub.config.PongWait))
+		conn.SetPongHandler(func(string) error {
+			conn.SetReadDeadline(time.Now().Add(hub.config.PongWait))
+			return nil
+		})
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				slog.Debug("Echo connection closed", "event", "echo_closed", "remote_addr", r.RemoteAddr, "error", err)
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(hub.config.PongWait))
+			conn.SetWriteDeadline(time.Now().Add(hub.config.WriteWait))
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import "github.com/gorilla/websocket"
+
+// Control frame encodings selected with the ?encoding= query parameter.
+// They only change how server notices such as presence, roster, error and
+// ack frames reach the client; relayed data is written as it arrived.
+const (
+	// EncodingJSON writes notices as JSON text frames; this is the default.
+	EncodingJSON = "json"
+	// EncodingMsgpack writes notices as MessagePack binary frames; see
+	// msgpack.go.
+	EncodingMsgpack = "msgpack"
+)
+
+// SubprotocolMsgpack selects EncodingMsgpack for a client relaying raw
+// frames, like ?encoding=msgpack without a ?protocol=.
+const SubprotocolMsgpack = "relay.msgpack"
+
+// controlEncoding turns a server notice, JSON encoded throughout the hub,
+// into the WebSocket message a client receives. Each client gets one when
+// it connects.
+type controlEncoding interface {
+	encodeControl(f frame) (messageType int, data []byte)
+}
+
+// jsonEncoding writes notices unchanged, as text frames.
+type jsonEncoding struct{}
+
+func (jsonEncoding) encodeControl(f frame) (int, []byte) {
+	return websocket.TextMessage, f.data
+}
+
+// binaryProtocolEncoding writes notices in the binary protocol's control
+// framing, reusing the form prepared for presence and roster frames.
+type binaryProtocolEncoding struct{}
+
+func (binaryProtocolEncoding) encodeControl(f frame) (int, []byte) {
+	if f.binary != nil {
+		return websocket.BinaryMessage, f.binary
+	}
+	return websocket.BinaryMessage, encodeNotice(f.data)
+}
+
+// msgpackEncoding writes notices as MessagePack maps in binary frames.
+type msgpackEncoding struct{}
+
+func (msgpackEncoding) encodeControl(f frame) (int, []byte) {
+	data, err := jsonToMsgpack(f.data)
+	if err != nil {
+		// Notices are built by the server and always valid JSON; should
+		// one not be, the client still gets it readable
+		return websocket.TextMessage, f.data
+	}
+	return websocket.BinaryMessage, data
+}
+
+// newControlEncoding returns the encoding for a client of protocol that
+// asked for encoding. The binary protocol has its own control framing.
+func newControlEncoding(protocol, encoding string) controlEncoding {
+	switch {
+	case protocol == ProtocolBinary:
+		return binaryProtocolEncoding{}
+	case encoding == EncodingMsgpack:
+		return msgpackEncoding{}
+	default:
+		return jsonEncoding{}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "encoding/json"
+
+// errorFrame is the schema of every error the server reports in-band, as
+// a text frame: {"type":"error","code":429,"reason":"quota_exceeded",
+// "detail":"..."}. Code follows the HTTP status of the equivalent
+// condition, reason is a stable machine-readable string and detail, which
+// may be empty, is meant for humans and may change.
+type errorFrame struct {
+	Type   string `json:"type"`
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// newErrorFrame encodes an error frame.
+func newErrorFrame(code int, reason, detail string) []byte {
+	data, _ := json.Marshal(errorFrame{Type: "error", Code: code, Reason: reason, Detail: detail})
+	return data
+}
+
+// sendError queues an error frame for client alone, via the hub so it
+// cannot race with the client leaving.
+func sendError(client *Client, code int, reason, detail string) {
+	client.sendDirect(newErrorFrame(code, reason, detail))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// decodeErrorFrame decodes data as an error frame, failing the test if it
+// has fields outside the schema.
+func decodeErrorFrame(tb testing.TB, data []byte) errorFrame {
+	tb.Helper()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var f errorFrame
+	if err := decoder.Decode(&f); err != nil {
+		tb.Fatalf("error frame %s does not match the schema: %v", data, err)
+	}
+	return f
+}
+
+func TestErrorFrames(t *testing.T) {
+	reasonFormat := regexp.MustCompile(`^[a-z]+(_[a-z]+)*$`)
+	tests := []struct {
+		name   string
+		frame  []byte
+		code   int
+		reason string
+	}{
+		{"throttleNotice", throttleNotice, http.StatusTooManyRequests, "rate_limited"},
+		{"rateLimitedFrame", rateLimitedFrame, http.StatusTooManyRequests, "rate_limited"},
+		{"bannedFrame", bannedFrame, http.StatusForbidden, "banned"},
+		{"idleTimeoutFrame", idleTimeoutFrame, http.StatusRequestTimeout, "idle_timeout"},
+		{"invalidJSONFrame", invalidJSONFrame, http.StatusBadRequest, "invalid_json"},
+		{"replacedFrame", replacedFrame, http.StatusConflict, "replaced"},
+		{"contentBlockedFrame", contentBlockedFrame, http.StatusForbidden, "content_blocked"},
+		{"overloadedFrame", overloadedFrame, http.StatusServiceUnavailable, "overloaded"},
+		{"quotaExceededFrame", quotaExceededFrame, http.StatusTooManyRequests, "quota_exceeded"},
+	}
+	for _, tt := range tests {
+		f := decodeErrorFrame(t, tt.frame)
+		if f.Type != "error" || f.Code != tt.code || f.Reason != tt.reason || f.Detail == "" {
+			t.Errorf("%s = %s, want an error frame with code %d, reason %s and a detail", tt.name, tt.frame, tt.code, tt.reason)
+		}
+		if !reasonFormat.MatchString(f.Reason) {
+			t.Errorf("%s reason %q is not snake case", tt.name, f.Reason)
+		}
+	}
+	// Detail is optional
+	if got := string(newErrorFrame(http.StatusBadRequest, "invalid_frame", "")); got != `{"type":"error","code":400,"reason":"invalid_frame"}` {
+		t.Errorf("error frame without detail = %s", got)
+	}
+}
+
+func TestRateLimitedMessageGetsErrorFrame(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.RateLimit, cfg.Hub.RateBurst = 0.1, 1 })
+	raw := srv.connect(t, "r", "alice", "")
+	raw.WriteMessage(websocket.TextMessage, []byte("one"))
+	raw.WriteMessage(websocket.TextMessage, []byte("two"))
+	messageType, data := readFrame(t, raw)
+	if f := decodeErrorFrame(t, data); messageType != websocket.TextMessage || f.Code != http.StatusTooManyRequests || f.Reason != "rate_limited" {
+		t.Fatalf("throttled raw client got type %d %s, want a rate_limited error frame", messageType, data)
+	}
+
+	bin := srv.connect(t, "other", "bob", "protocol=binary")
+	bin.WriteMessage(websocket.BinaryMessage, []byte{binaryData, 1})
+	bin.WriteMessage(websocket.BinaryMessage, []byte{binaryData, 2})
+	_, data = readFrame(t, bin)
+	want := binary.AppendUvarint([]byte{binaryControl, controlError}, http.StatusTooManyRequests)
+	if !bytes.HasPrefix(data, appendString(want, "rate_limited")) {
+		t.Fatalf("throttled binary client got % x, want a rate_limited error control frame", data)
+	}
+}
+
+func TestEncodeNotice(t *testing.T) {
+	want := binary.AppendUvarint([]byte{binaryControl, controlError}, http.StatusConflict)
+	want = appendString(appendString(want, "replaced"), "another connection took over this username")
+	if got := encodeNotice(replacedFrame); !bytes.Equal(got, want) {
+		t.Errorf("encodeNotice(error) = % x, want % x", got, want)
+	}
+	ack := []byte(`{"type":"ack","id":"m1"}`)
+	if got := encodeNotice(ack); !bytes.Equal(got, append([]byte{binaryControl, controlJSON}, ack...)) {
+		t.Errorf("encodeNotice(ack) = % x, want it wrapped as a JSON control frame", got)
+	}
+}
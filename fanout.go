@@ -0,0 +1,93 @@
+package main
+
+import "sync"
+
+// fanOutMinRecipients is the room size below which a broadcast is fanned
+// out on Run's goroutine even with FanOutWorkers set, as handing off to
+// the workers would cost more than it saves.
+const fanOutMinRecipients = 256
+
+// fanOutJob delivers a frame to count clients of a room's rotation,
+// starting at index start and wrapping around.
+type fanOutJob struct {
+	clients      []*Client
+	start, count int
+	message      Message
+	out          frame
+
+	slow []*Client // clients the backpressure policy gave up on
+	done *sync.WaitGroup
+}
+
+// deliver queues the frame on each client that receives the message, in
+// order.
+func (j *fanOutJob) deliver(h *Hub) {
+	n := len(j.clients)
+	for i := 0; i < j.count; i++ {
+		client := j.clients[(j.start+i)%n]
+		if !client.receives(j.message) {
+			continue
+		}
+		if !h.deliver(client, j.out) {
+			j.slow = append(j.slow, client)
+		}
+	}
+}
+
+// fanOutWorker runs jobs until Run closes fanOutJobs.
+func (h *Hub) fanOutWorker() {
+	for job := range h.fanOutJobs {
+		h.runJob(job)
+	}
+}
+
+// runJob delivers job, signalling it done even if delivery panics, so
+// Run is not left waiting.
+func (h *Hub) runJob(job *fanOutJob) {
+	defer job.done.Done()
+	defer h.recoverPanic("fan-out")
+	job.deliver(h)
+}
+
+// fanOut queues out on every client in the message's room that receives
+// it, starting one position further along the room's rotation each time,
+// and returns the clients the backpressure policy gave up on. With
+// FanOutWorkers, large rooms are split into contiguous runs of the
+// rotation delivered concurrently. Run waits for every run before taking
+// the next message, so each client still receives messages in broadcast
+// order; only the order across clients within one broadcast is lost.
+// Called from Run only; the rotation cannot change meanwhile.
+func (h *Hub) fanOut(message Message, out frame) []*Client {
+	r, ok := h.rotations[message.Room]
+	if !ok || len(r.clients) == 0 {
+		return nil
+	}
+	n := len(r.clients)
+	start := r.advance()
+	workers := h.config.FanOutWorkers
+	if h.fanOutJobs == nil || n < fanOutMinRecipients {
+		job := fanOutJob{clients: r.clients, start: start, count: n, message: message, out: out}
+		job.deliver(h)
+		return job.slow
+	}
+
+	var done sync.WaitGroup
+	jobs := make([]fanOutJob, workers)
+	size := (n + workers - 1) / workers
+	for i := range jobs {
+		count := size
+		if remaining := n - i*size; remaining < count {
+			count = remaining
+		}
+		jobs[i] = fanOutJob{clients: r.clients, start: start + i*size, count: count, message: message, out: out, done: &done}
+		done.Add(1)
+		h.fanOutJobs <- &jobs[i]
+	}
+	done.Wait()
+
+	var slow []*Client
+	for i := range jobs {
+		slow = append(slow, jobs[i].slow...)
+	}
+	return slow
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestFanOutWorkersDeliverToEveryClientInOrder(t *testing.T) {
+	config := DefaultHubConfig()
+	config.FanOutWorkers = 4
+	hub := startHub(t, config)
+	clients := make([]*Client, fanOutMinRecipients+50)
+	for i := range clients {
+		clients[i] = newTestClient(hub, "r", fmt.Sprintf("user%d", i), 10)
+		hub.register <- clients[i]
+	}
+	waitFor(t, "clients to register", func() bool {
+		hub.mu.RLock()
+		defer hub.mu.RUnlock()
+		return hub.clientCount() == len(clients)
+	})
+
+	for i := 0; i < 10; i++ {
+		relay(hub, "r", "sender", []byte{byte(i)})
+	}
+	waitFor(t, "the messages to be relayed", func() bool { return hubStats(hub).TotalMessages == 10 })
+	for _, client := range clients {
+		waitFor(t, client.username+" to receive every message", func() bool { return len(client.send) == 10 })
+		frames, _ := queued(client)
+		for i, f := range frames {
+			if f.data[0] != byte(i) {
+				t.Fatalf("%s received message %d in position %d", client.username, f.data[0], i)
+			}
+		}
+	}
+}
+
+// BenchmarkFanOutWorkers compares fan-out to 10k clients on Run's
+// goroutine alone and shared with a pool of workers.
+func BenchmarkFanOutWorkers(b *testing.B) {
+	for _, workers := range []int{0, max(runtime.GOMAXPROCS(0), 2)} {
+		name := "single"
+		if workers > 0 {
+			name = fmt.Sprintf("pooled=%d", workers)
+		}
+		b.Run(name, func(b *testing.B) {
+			config := DefaultHubConfig()
+			config.FanOutWorkers = workers
+			benchmarkFanOut(b, config, 10000, nil)
+		})
+	}
+}
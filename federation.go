@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// With PEERS set, the server dials each peer's /peer endpoint and forwards
+// every message that originated locally, so clients on either instance see
+// all traffic. Messages from a peer are injected into the local hub like
+// any other broadcast, marked with the ID of the node they originated on,
+// and never forwarded again; peers therefore need a full mesh, each listing
+// all the others. Only messages are shared: presence, usernames and limits
+// stay per instance.
+
+// peerOriginHeader carries the dialing node's ID, so a node configured as
+// its own peer is refused instead of echoing its messages forever.
+const peerOriginHeader = "X-Relay-Origin"
+
+// peerBuffer is how many encoded messages may wait for each peer; more
+// are dropped while the peer is slow or unreachable.
+const peerBuffer = 1024
+
+// Reconnect backoff for peer links
+const (
+	peerRetryMin = time.Second
+	peerRetryMax = 30 * time.Second
+)
+
+// peerMessage is a message as sent between peers.
+type peerMessage struct {
+	Origin   string `json:"origin"`
+	Room     string `json:"room"`
+	From     string `json:"from"`
+	Type     int    `json:"type"`
+	Data     []byte `json:"data"`
+	Topic    string `json:"topic,omitempty"`
+	Envelope bool   `json:"envelope,omitempty"`
+	Priority bool   `json:"priority,omitempty"`
+	Selector string `json:"selector,omitempty"`
+}
+
+// peerLink is the outbound connection to one peer. Run queues messages on
+// out and run writes them, reconnecting as needed.
+type peerLink struct {
+	url string
+	out chan []byte
+
+	connected atomic.Bool
+	forwarded atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// newNodeID returns a random ID for this server's origin marker.
+func newNodeID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newPeerLinks returns a link for each peer URL.
+func newPeerLinks(urls []string) []*peerLink {
+	links := make([]*peerLink, len(urls))
+	for i, u := range urls {
+		links[i] = &peerLink{url: u, out: make(chan []byte, peerBuffer)}
+	}
+	return links
+}
+
+// forwardToPeers queues a locally originated message for every peer,
+// dropping it for peers whose queue is full. Messages that came from a
+// peer are not forwarded again. Called from Run only.
+func (h *Hub) forwardToPeers(message Message) {
+	if len(h.peers) == 0 || message.Origin != "" {
+		return
+	}
+	data, err := json.Marshal(peerMessage{
+		Origin:   h.config.NodeID,
+		Room:     message.Room,
+		From:     message.From,
+		Type:     message.Type,
+		Data:     message.Data,
+		Topic:    message.Topic,
+		Envelope: message.Envelope,
+		Priority: message.Priority,
+		Selector: message.Selector.String(),
+	})
+	if err != nil {
+		return
+	}
+	for _, link := range h.peers {
+		select {
+		case link.out <- data:
+		default:
+			link.dropped.Add(1)
+		}
+	}
+}
+
+// run keeps the link connected until the hub stops, retrying with
+// exponential backoff.
+func (l *peerLink) run(h *Hub) {
+	header := http.Header{}
+	header.Set(peerOriginHeader, h.config.NodeID)
+	if h.config.PeerToken != "" {
+		header.Set("Authorization", "Bearer "+h.config.PeerToken)
+	}
+	retry := peerRetryMin
+	for {
+		conn, resp, err := websocket.DefaultDialer.Dial(l.url, header)
+		if err == nil {
+			retry = peerRetryMin
+			slog.Info("Peer connected", "event", "peer_connected", "peer", l.url)
+			l.connected.Store(true)
+			err = l.serve(h, conn)
+			l.connected.Store(false)
+			if err == nil {
+				return
+			}
+			slog.Warn("Peer disconnected", "event", "peer_disconnected", "peer", l.url, "error", err)
+		} else {
+			// A handshake refused with 401 or 508 points at the token or at
+			// a node listed as its own peer
+			status := 0
+			if resp != nil {
+				status = resp.StatusCode
+			}
+			slog.Warn("Peer unreachable", "event", "peer_dial_failed", "peer", l.url, "error", err, "status", status, "retry_in", retry.String())
+		}
+		select {
+		case <-time.After(retry):
+		case <-h.done:
+			return
+		}
+		if retry *= 2; retry > peerRetryMax {
+			retry = peerRetryMax
+		}
+	}
+}
+
+// serve writes queued messages and keepalive pings to conn until it fails,
+// returning the error, or until the hub stops, returning nil.
+func (l *peerLink) serve(h *Hub, conn *websocket.Conn) error {
+	defer conn.Close()
+
+	// The peer sends nothing but pongs; reading processes them and notices
+	// the connection closing.
+	conn.SetReadDeadline(time.Now().Add(h.config.PongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(h.config.PongWait))
+		return nil
+	})
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(h.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-l.out:
+			conn.SetWriteDeadline(time.Now().Add(h.config.WriteWait))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return err
+			}
+			l.forwarded.Add(1)
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(h.config.WriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return err
+		case <-h.done:
+			conn.SetWriteDeadline(time.Now().Add(h.config.WriteWait))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"))
+			return nil
+		}
+	}
+}
+
+// HandlePeer accepts a connection from a peer and injects the messages it
+// forwards into the local hub. Messages carrying this node's own ID, which
+// could only arrive through a misconfigured loop, are discarded.
+func HandlePeer(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get(peerOriginHeader)
+		if origin == "" {
+			http.Error(w, "Missing "+peerOriginHeader+" header", http.StatusBadRequest)
+			return
+		}
+		if origin == hub.config.NodeID {
+			http.Error(w, "Peer is this server", http.StatusLoopDetected)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		slog.Info("Peer accepted", "event", "peer_accepted", "origin", origin, "remote_addr", r.RemoteAddr)
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-hub.done:
+				conn.Close()
+			case <-stop:
+			}
+		}()
+
+		conn.SetReadLimit(2 * hub.config.MaxMessageBytes)
+		conn.SetReadDeadline(time.Now().Add(hub.config.PongWait))
+		conn.SetPingHandler(func(data string) error {
+			conn.SetReadDeadline(time.Now().Add(hub.config.PongWait))
+			return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(hub.config.WriteWait))
+		})
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				slog.Info("Peer went away", "event", "peer_closed", "origin", origin, "error", err)
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(hub.config.PongWait))
+			var m peerMessage
+			if err := json.Unmarshal(data, &m); err != nil || m.Origin == "" || m.Origin == hub.config.NodeID ||
+				(m.Type != websocket.TextMessage && m.Type != websocket.BinaryMessage) {
+				hub.peerDiscarded.Add(1)
+				continue
+			}
+			sel, err := parseSelector(m.Selector)
+			if err != nil {
+				hub.peerDiscarded.Add(1)
+				continue
+			}
+			hub.peerReceived.Add(1)
+			select {
+			case hub.broadcast <- Message{
+				Room: m.Room,
+				From: m.From,
+				Type: m.Type,
+				Data: m.Data,
+
+				Topic:    m.Topic,
+				Envelope: m.Envelope,
+				Priority: m.Priority,
+				Selector: sel,
+				Origin:   m.Origin,
+				Received: time.Now(),
+			}:
+			case <-hub.done:
+				return
+			}
+		}
+	}
+}
+
+// peerStatus describes the peer links for /stats, reading their counters
+// with take.
+func (h *Hub) peerStatus(take func(*atomic.Uint64) uint64) []map[string]interface{} {
+	status := make([]map[string]interface{}, 0, len(h.peers))
+	for _, link := range h.peers {
+		status = append(status, map[string]interface{}{
+			"url":       link.url,
+			"connected": link.connected.Load(),
+			"forwarded": take(&link.forwarded),
+			"dropped":   take(&link.dropped),
+		})
+	}
+	return status
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newMesh serves n instances, each listing every other one as a peer,
+// and waits until all their links are up. configure, if not nil, adjusts
+// the configuration of instance i.
+func newMesh(tb testing.TB, n int, configure func(i int, cfg *Config)) []*testServer {
+	tb.Helper()
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		listeners[i] = l
+	}
+	nodes := make([]*testServer, n)
+	for i := range nodes {
+		cfg := &Config{AdminToken: "root", ReadBufferSize: 4096, WriteBufferSize: 4096, Hub: DefaultHubConfig()}
+		cfg.Hub.NodeID = fmt.Sprintf("node-%d", i)
+		cfg.Hub.PeerToken = cfg.AdminToken
+		for j, l := range listeners {
+			if j != i {
+				cfg.Hub.Peers = append(cfg.Hub.Peers, "ws://"+l.Addr().String()+"/peer")
+			}
+		}
+		if configure != nil {
+			configure(i, cfg)
+		}
+		configureUpgrader(cfg)
+		hub := startHub(tb, cfg.Hub)
+		ts := httptest.NewUnstartedServer(newRouter(cfg, hub, nil))
+		ts.Listener.Close()
+		ts.Listener = listeners[i]
+		ts.Start()
+		tb.Cleanup(ts.Close)
+		nodes[i] = &testServer{Server: ts, hub: hub}
+	}
+	for _, node := range nodes {
+		for _, link := range node.hub.peers {
+			waitFor(tb, "link to "+link.url, link.connected.Load)
+		}
+	}
+	return nodes
+}
+
+func TestFederatedMessagesAreNotForwardedAgain(t *testing.T) {
+	nodes := newMesh(t, 3, nil)
+	receivers := []*websocket.Conn{
+		nodes[0].connect(t, "r", "bob", ""),
+		nodes[1].connect(t, "r", "carol", ""),
+		nodes[2].connect(t, "r", "dave", ""),
+	}
+	sender := nodes[0].connect(t, "r", "alice", "")
+
+	sender.WriteMessage(websocket.TextMessage, []byte("hello mesh"))
+	for i, receiver := range receivers {
+		if _, data := readFrame(t, receiver); string(data) != "hello mesh" {
+			t.Fatalf("receiver on node %d got %q", i, data)
+		}
+	}
+	// A message forwarded back would arrive a second time
+	for _, receiver := range receivers {
+		expectSilence(t, receiver, 100*time.Millisecond)
+	}
+
+	for i, node := range nodes {
+		wantReceived := uint64(1)
+		if i == 0 {
+			wantReceived = 0
+		}
+		if got := node.hub.peerReceived.Load(); got != wantReceived {
+			t.Errorf("node %d accepted %d peer messages, want %d", i, got, wantReceived)
+		}
+		if got := node.hub.peerDiscarded.Load(); got != 0 {
+			t.Errorf("node %d discarded %d peer messages, want 0", i, got)
+		}
+		for _, link := range node.hub.peers {
+			wantForwarded := uint64(0)
+			if i == 0 {
+				wantForwarded = 1
+			}
+			if got := link.forwarded.Load(); got != wantForwarded {
+				t.Errorf("node %d forwarded %d messages to %s, want %d", i, got, link.url, wantForwarded)
+			}
+		}
+	}
+}
+
+func TestPeerHandshake(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.AdminToken = "root"
+		cfg.Hub.NodeID = "self"
+	})
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"own node ID", http.Header{"Authorization": {"Bearer root"}, peerOriginHeader: {"self"}}, http.StatusLoopDetected},
+		{"missing node ID", http.Header{"Authorization": {"Bearer root"}}, http.StatusBadRequest},
+		{"missing token", http.Header{peerOriginHeader: {"other"}}, http.StatusUnauthorized},
+		{"other node", http.Header{"Authorization": {"Bearer root"}, peerOriginHeader: {"other"}}, http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		if status, _ := srv.dialStatus(t, "/peer", tt.header); status != tt.want {
+			t.Errorf("%s: got HTTP %d, want %d", tt.name, status, tt.want)
+		}
+	}
+}
+
+func TestPeerDiscardsOwnOrigin(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.AdminToken = "root"
+		cfg.Hub.NodeID = "self"
+	})
+	receiver := srv.connect(t, "r", "bob", "")
+	peer := srv.dial(t, "/peer", http.Header{"Authorization": {"Bearer root"}, peerOriginHeader: {"other"}})
+
+	for _, origin := range []string{"self", "", "other"} {
+		data, _ := json.Marshal(peerMessage{Origin: origin, Room: "r", From: "alice", Type: websocket.TextMessage, Data: []byte("from " + origin)})
+		peer.WriteMessage(websocket.TextMessage, data)
+	}
+	if _, data := readFrame(t, receiver); string(data) != "from other" {
+		t.Fatalf("receiver got %q, want only the message from the other node", data)
+	}
+	waitFor(t, "both looping messages to be discarded", func() bool { return srv.hub.peerDiscarded.Load() == 2 })
+	if got := srv.hub.peerReceived.Load(); got != 1 {
+		t.Errorf("accepted %d peer messages, want 1", got)
+	}
+}
+
+func TestPeersReceiveTransformedMessages(t *testing.T) {
+	tag := TransformerFunc(func(m Message) (Message, error) {
+		if string(m.Data) == "secret" {
+			return m, fmt.Errorf("refused")
+		}
+		m.Data = append([]byte("tagged:"), m.Data...)
+		return m, nil
+	})
+	nodes := newMesh(t, 2, func(i int, cfg *Config) {
+		cfg.Hub.Transformers = []Transformer{tag}
+	})
+	local := nodes[0].connect(t, "r", "bob", "")
+	remote := nodes[1].connect(t, "r", "carol", "")
+	sender := nodes[0].connect(t, "r", "alice", "")
+
+	sender.WriteMessage(websocket.TextMessage, []byte("secret"))
+	sender.WriteMessage(websocket.TextMessage, []byte("hello"))
+	for name, receiver := range map[string]*websocket.Conn{"local": local, "remote": remote} {
+		if _, data := readFrame(t, receiver); string(data) != "tagged:hello" {
+			t.Errorf("%s receiver got %q, want the message transformed once", name, data)
+		}
+	}
+	if got := nodes[0].hub.peers[0].forwarded.Load(); got != 1 {
+		t.Errorf("forwarded %d messages, want only the one the transformer accepted", got)
+	}
+	expectSilence(t, remote, 100*time.Millisecond)
+}
+
+func TestPeerDiscardsControlMessageTypes(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.AdminToken = "root"
+		cfg.Hub.NodeID = "self"
+	})
+	receiver := srv.connect(t, "r", "bob", "")
+	peer := srv.dial(t, "/peer", http.Header{"Authorization": {"Bearer root"}, peerOriginHeader: {"other"}})
+
+	for _, messageType := range []int{websocket.CloseMessage, websocket.PingMessage, 0, websocket.TextMessage} {
+		data, _ := json.Marshal(peerMessage{Origin: "other", Room: "r", From: "alice", Type: messageType, Data: []byte(fmt.Sprint("type ", messageType))})
+		peer.WriteMessage(websocket.TextMessage, data)
+	}
+	if messageType, data := readFrame(t, receiver); messageType != websocket.TextMessage || string(data) != "type 1" {
+		t.Fatalf("receiver got type %d %q, want only the text message", messageType, data)
+	}
+	waitFor(t, "the other types to be discarded", func() bool { return srv.hub.peerDiscarded.Load() == 3 })
+	if got := srv.hub.peerReceived.Load(); got != 1 {
+		t.Errorf("accepted %d peer messages, want 1", got)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build go1.24
+
+package main
+
+import "net/http"
+
+// h2cSupported reports whether this build can serve h2c, which needs
+// http.Server.Protocols from Go 1.24; see h2c_legacy.go.
+const h2cSupported = true
+
+// enableH2C lets server speak HTTP/2 over cleartext connections to
+// clients with prior knowledge, alongside HTTP/1.1 on the same listener.
+// WebSocket upgrades keep arriving as HTTP/1.1 requests, so they are
+// unaffected.
+func enableH2C(server *http.Server) {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server.Protocols = &protocols
+}
@@ -0,0 +1,12 @@
+//go:build !go1.24
+
+package main
+
+import "net/http"
+
+// h2cSupported is false before Go 1.24, whose standard library cannot
+// serve h2c; loadConfig then rejects H2C.
+const h2cSupported = false
+
+// enableH2C is never called when h2c is unsupported.
+func enableH2C(server *http.Server) {}
@@ -0,0 +1,36 @@
+//go:build go1.24
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestH2CServesHTTP2AndWebSocketsOverHTTP1(t *testing.T) {
+	srv := newUnstartedTestServer(t, nil)
+	enableH2C(srv.Config)
+	srv.Start()
+
+	// A client with prior knowledge speaks HTTP/2 straight away
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	defer client.CloseIdleConnections()
+	for _, path := range []string{"/health", "/stats", "/version"} {
+		expectHTTP2(t, srv, client, path)
+	}
+	expectWebSocketRelay(t, srv, websocket.DefaultDialer)
+
+	// Plain HTTP/1.1 clients are still served on the same listener
+	resp, err := http.Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 || resp.StatusCode != http.StatusOK {
+		t.Errorf("HTTP/1.1 client got HTTP %d over %s", resp.StatusCode, resp.Proto)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// Health statuses reported by /health. Degraded still answers 200 so a
+// liveness probe leaves the process alone; unhealthy answers 503.
+const (
+	healthHealthy   = "healthy"
+	healthDegraded  = "degraded"
+	healthUnhealthy = "unhealthy"
+)
+
+// dropRateWindow is the window over which HealthDropRate is measured.
+const dropRateWindow = time.Minute
+
+// noteDrop records a client dropped for a full send buffer, keeping only
+// as many recent drops as it takes to exceed HealthDropRate. The caller
+// must hold h.mu.
+func (h *Hub) noteDrop(now time.Time) {
+	limit := h.config.HealthDropRate
+	if limit <= 0 {
+		return
+	}
+	h.recentDrops = append(h.recentDrops, now)
+	if len(h.recentDrops) > limit {
+		h.recentDrops = h.recentDrops[len(h.recentDrops)-limit:]
+	}
+}
+
+// recentDropCount returns how many of the recorded drops fall within
+// dropRateWindow. The caller must hold h.mu.
+func (h *Hub) recentDropCount(now time.Time) int {
+	n := 0
+	for _, t := range h.recentDrops {
+		if now.Sub(t) < dropRateWindow {
+			n++
+		}
+	}
+	return n
+}
+
+// healthStatus assesses the hub and returns its status along with the
+// reasons it is not healthy:
+//
+//   - broadcast_saturated: the broadcast queue is saturated (degraded), or
+//     has been for SaturationPeriod, meaning the hub is stalled (unhealthy)
+//   - drop_rate: HealthDropRate clients were dropped for a full send buffer
+//     within the last minute (degraded)
+//   - goroutines: at least HealthMaxGoroutines goroutines are running,
+//     which suggests a leak (degraded)
+//
+// The caller must hold h.mu.
+func (h *Hub) healthStatus() (string, []string) {
+	status, reasons := healthHealthy, []string{}
+	degrade := func(reason string, to string) {
+		reasons = append(reasons, reason)
+		if status != healthUnhealthy {
+			status = to
+		}
+	}
+	if !h.saturatedSince.IsZero() {
+		if h.config.SaturationPeriod > 0 && h.saturated() {
+			degrade("broadcast_saturated", healthUnhealthy)
+		} else {
+			degrade("broadcast_saturated", healthDegraded)
+		}
+	}
+	if limit := h.config.HealthDropRate; limit > 0 && h.recentDropCount(time.Now()) >= limit {
+		degrade("drop_rate", healthDegraded)
+	}
+	if limit := h.config.HealthMaxGoroutines; limit > 0 && runtime.NumGoroutine() >= limit {
+		degrade("goroutines", healthDegraded)
+	}
+	return status, reasons
+}
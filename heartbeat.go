@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Some proxies and gateways drop WebSocket control frames, so protocol
+// pings never reach the client and its pongs never come back. With
+// HeartbeatInterval set, WritePump also sends {"type":"ping","ts":...}
+// as a data frame, ts being the server's Unix time in milliseconds, and
+// a client answering with {"type":"pong"} extends its read deadline by
+// PongWait just like a control-frame pong. Heartbeat pongs are never
+// relayed; clients may echo ts to let operators correlate them.
+
+// heartbeatFrame returns the application-level ping sent at now.
+func heartbeatFrame(now time.Time) []byte {
+	return []byte(fmt.Sprintf(`{"type":"ping","ts":%d}`, now.UnixMilli()))
+}
+
+// handlePong extends the read deadline if data answers a heartbeat,
+// reporting whether it did.
+func (c *Client) handlePong(data []byte) bool {
+	if c.hub.config.HeartbeatInterval == 0 || !isHeartbeatPong(data) {
+		return false
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.hub.config.PongWait))
+	return true
+}
+
+// isHeartbeatPong reports whether data answers a heartbeat,
+// {"type":"pong"}.
+func isHeartbeatPong(data []byte) bool {
+	if !bytes.Contains(data, []byte(`"pong"`)) {
+		return false
+	}
+	var pong struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(data, &pong) == nil && pong.Type == "pong"
+}
@@ -0,0 +1,46 @@
+package main
+
+// history is a fixed-size ring buffer of the most recent messages relayed
+// in a room. It is only touched by the hub's Run goroutine.
+type history struct {
+	messages []Message
+	next     int
+	full     bool
+}
+
+func newHistory(size int) *history {
+	return &history{messages: make([]Message, size)}
+}
+
+// add records a message, evicting the oldest one once the buffer is full.
+func (h *history) add(m Message) {
+	h.messages[h.next] = m
+	h.next = (h.next + 1) % len(h.messages)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// len returns the number of buffered messages.
+func (h *history) len() int {
+	if h.full {
+		return len(h.messages)
+	}
+	return h.next
+}
+
+// last returns up to n of the most recent messages, oldest first.
+func (h *history) last(n int) []Message {
+	if size := h.len(); n > size {
+		n = size
+	}
+	out := make([]Message, 0, n)
+	start := h.next - n
+	if start < 0 {
+		start += len(h.messages)
+	}
+	for i := 0; i < n; i++ {
+		out = append(out, h.messages[(start+i)%len(h.messages)])
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// expectHTTP2 fails the test unless client fetches path from srv over
+// HTTP/2 with status 200.
+func expectHTTP2(tb testing.TB, srv *testServer, client *http.Client, path string) {
+	tb.Helper()
+	resp, err := client.Get(srv.URL + path)
+	if err != nil {
+		tb.Fatalf("GET %s: %v", path, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		tb.Errorf("GET %s got HTTP %d over %s, want 200 over HTTP/2", path, resp.StatusCode, resp.Proto)
+	}
+}
+
+// expectWebSocketRelay connects two clients to srv with dialer and checks
+// that a message passes between them, which needs an HTTP/1.1 upgrade.
+func expectWebSocketRelay(tb testing.TB, srv *testServer, dialer *websocket.Dialer) {
+	tb.Helper()
+	dial := func(username string) *websocket.Conn {
+		conn, resp, err := dialer.Dial(srv.wsURL("/ws/r/"+username), nil)
+		if err != nil {
+			tb.Fatalf("dial %s: %v", username, err)
+		}
+		if resp.ProtoMajor != 1 {
+			tb.Errorf("%s upgraded over %s, want HTTP/1.1", username, resp.Proto)
+		}
+		tb.Cleanup(func() { conn.Close() })
+		waitFor(tb, username+" to register", func() bool { return srv.hub.lookup("r", username) != nil })
+		return conn
+	}
+	receiver := dial("bob")
+	dial("alice").WriteMessage(websocket.TextMessage, []byte("over http/1.1"))
+	if _, data := readFrame(tb, receiver); string(data) != "over http/1.1" {
+		tb.Errorf("bob received %q", data)
+	}
+}
+
+func TestTLSServesHTTP2AndWebSocketsOverHTTP1(t *testing.T) {
+	srv := newUnstartedTestServer(t, nil)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+
+	client := srv.Client()
+	for _, path := range []string{"/health", "/stats", "/version"} {
+		expectHTTP2(t, srv, client, path)
+	}
+	// WebSocket clients offer only HTTP/1.1 over ALPN, as browsers do
+	tlsConfig := client.Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	expectWebSocketRelay(t, srv, &websocket.Dialer{TLSClientConfig: tlsConfig})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// defaultProxyHeaders are consulted when TrustedProxies is set without
+// ProxyHeaders.
+var defaultProxyHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+
+// clientIP returns the IP address of the client behind r, as used for
+// per-IP limits, bans and connection listings.
+//
+// Without TrustedProxies, the ProxyHeaders, e.g. X-Forwarded-For or
+// X-Real-IP, are consulted in order, so only list ones set by a proxy in
+// front of the server: clients can send any header themselves. A header
+// may hold a comma-separated list, as X-Forwarded-For does when proxies
+// append to it; the last entry is the one added by the proxy closest to
+// the server, so it is the one used.
+//
+// With TrustedProxies, the headers are only believed when the connection
+// comes from a trusted proxy, and a list is walked from its end past the
+// entries that are trusted proxies themselves, so a chain of proxies
+// yields the first address outside it. Headers sent by anyone else are
+// ignored, so a client cannot claim another address.
+//
+// Without a usable header the connection's own address is returned.
+func (h *Hub) clientIP(r *http.Request) string {
+	peer := addrIP(r.RemoteAddr)
+	trusted := h.config.TrustedProxies
+	headers := h.config.ProxyHeaders
+	if len(trusted) > 0 {
+		if len(headers) == 0 {
+			headers = defaultProxyHeaders
+		}
+		if !containsIP(trusted, net.ParseIP(peer)) {
+			for _, header := range headers {
+				if r.Header.Get(header) != "" {
+					slog.Debug("Ignored forwarding header from untrusted peer", "event", "proxy_header_ignored", "remote_addr", r.RemoteAddr, "header", header)
+				}
+			}
+			return peer
+		}
+	}
+	for _, header := range headers {
+		if ip := forwardedIP(r.Header.Get(header), trusted); ip != "" {
+			return ip
+		}
+	}
+	return peer
+}
+
+// forwardedIP returns the client address in a forwarding header value:
+// the last entry not in trusted, or the first entry if all of them are.
+// It returns "" if the value is empty or the entries it needs are not IP
+// addresses.
+func forwardedIP(value string, trusted []*net.IPNet) string {
+	entries := strings.Split(value, ",")
+	var ip net.IP
+	for i := len(entries) - 1; i >= 0; i-- {
+		if ip = net.ParseIP(strings.TrimSpace(entries[i])); ip == nil {
+			return ""
+		}
+		if !containsIP(trusted, ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// containsIP reports whether ip lies in any of nets.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses TRUSTED_PROXIES entries, each a CIDR such as
+// 10.0.0.0/8 or a single address.
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: not an IP address or CIDR", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ipLimiter caps the connections open from each IP address, so a single
+// host cannot take the server's capacity by connecting under many
+// usernames.
+type ipLimiter struct {
+	limit int
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newIPLimiter(limit int) *ipLimiter {
+	return &ipLimiter{limit: limit, conns: make(map[string]int)}
+}
+
+// acquire counts a new connection from ip, reporting false without
+// counting it if ip is already at the limit.
+func (l *ipLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.limit {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+// release uncounts a connection from ip once it has closed. A nil limiter
+// does nothing, so callers need not check whether limiting is on.
+func (l *ipLimiter) release(ip string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] <= 1 {
+		delete(l.conns, ip)
+		return
+	}
+	l.conns[ip]--
+}
+
+// checkIPLimit counts a connection from ip against MaxConnsPerIP,
+// answering 429 and reporting false if the address is at the limit. The
+// caller must release the connection once it ends.
+func checkIPLimit(w http.ResponseWriter, hub *Hub, ip string) bool {
+	if hub.ipLimits == nil || hub.ipLimits.acquire(ip) {
+		return true
+	}
+	http.Error(w, "Too many connections from this address", http.StatusTooManyRequests)
+	return false
+}
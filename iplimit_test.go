@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		trusted bool
+		headers []string
+		remote  string
+		header  map[string]string
+		want    string
+	}{
+		{"no headers configured", false, nil, "203.0.113.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "203.0.113.5"},
+		{"header", false, []string{"X-Forwarded-For"}, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"last list entry", false, []string{"X-Forwarded-For"}, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.7"}, "198.51.100.7"},
+		{"headers in order", false, []string{"X-Real-IP", "X-Forwarded-For"}, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7", "X-Real-IP": "198.51.100.8"}, "198.51.100.8"},
+		{"invalid header", false, []string{"X-Forwarded-For"}, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "not-an-ip"}, "10.0.0.1"},
+		{"trusted proxy", true, nil, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"chain of trusted proxies", true, nil, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.7, 192.0.2.1, 10.0.0.2"}, "198.51.100.7"},
+		{"untrusted peer", true, nil, "203.0.113.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "203.0.113.5"},
+		{"only trusted entries", true, nil, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"no header from trusted proxy", true, nil, "10.0.0.1:1234", nil, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultHubConfig()
+			config.ProxyHeaders = tt.headers
+			if tt.trusted {
+				config.TrustedProxies = trusted
+			}
+			hub := NewHub(config)
+			r := httptest.NewRequest(http.MethodGet, "/ws/r/alice", nil)
+			r.RemoteAddr = tt.remote
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			if got := hub.clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesRejectsInvalidEntries(t *testing.T) {
+	for _, entry := range []string{"proxy.internal", "10.0.0.0/33", "10.0.0"} {
+		if _, err := parseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded, want an error", entry)
+		}
+	}
+}
+
+func TestPerIPLimitRejectsWith429(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.Hub.MaxConnsPerIP = 2
+		cfg.Hub.ProxyHeaders = []string{"X-Forwarded-For"}
+	})
+	from := func(ip string) http.Header { return http.Header{"X-Forwarded-For": {ip}} }
+
+	first := srv.dial(t, "/ws/r/alice", from("198.51.100.7"))
+	srv.dial(t, "/ws/r/bob", from("198.51.100.7"))
+	if status, _ := srv.dialStatus(t, "/ws/r/carol", from("198.51.100.7")); status != http.StatusTooManyRequests {
+		t.Fatalf("third connection from one address got HTTP %d, want 429", status)
+	}
+	if status, _ := srv.dialStatus(t, "/ws/r/carol", from("198.51.100.8")); status != http.StatusSwitchingProtocols {
+		t.Fatalf("connection from another address got HTTP %d, want 101", status)
+	}
+
+	// A closed connection frees its slot
+	first.Close()
+	waitFor(t, "alice to be unregistered", func() bool { return srv.hub.lookup("r", "alice") == nil })
+	waitFor(t, "the address to have a free slot", func() bool {
+		status, _ := srv.dialStatus(t, "/ws/r/dave", from("198.51.100.7"))
+		return status == http.StatusSwitchingProtocols
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyBuckets is the number of histogram buckets. Bucket i counts
+// latencies up to 1µs<<i, and the last one everything above ~9min.
+const latencyBuckets = 31
+
+// latencyQuantiles are the percentiles reported by /stats and /metrics.
+var latencyQuantiles = []float64{0.50, 0.95, 0.99}
+
+// latencyHistogram records relay latencies in exponentially sized buckets,
+// so its memory stays fixed however many messages are observed. Quantiles
+// are reported as the upper bound of the bucket they fall in, which is
+// within a factor of two of the true value.
+type latencyHistogram struct {
+	mu sync.Mutex
+	latencyCounts
+}
+
+// latencyCounts is the histogram's data, copied out for reporting.
+type latencyCounts struct {
+	counts [latencyBuckets]uint64
+	total  uint64
+	sum    time.Duration
+	// exemplars holds the latest observation in each bucket, which
+	// OpenMetrics scrapes get as the bucket's exemplar
+	exemplars [latencyBuckets]latencyExemplar
+}
+
+// latencyExemplar is one observed latency and the message it was measured
+// on, identified by its room and sequence number.
+type latencyExemplar struct {
+	latency time.Duration
+	room    string
+	seq     uint64
+	at      time.Time
+}
+
+// observe records the latency of the message numbered seq in room.
+func (h *latencyHistogram) observe(d time.Duration, room string, seq uint64) {
+	i := 0
+	for i < latencyBuckets-1 && d > latencyBound(i) {
+		i++
+	}
+	now := time.Now()
+	h.mu.Lock()
+	h.counts[i]++
+	h.total++
+	h.sum += d
+	h.exemplars[i] = latencyExemplar{latency: d, room: room, seq: seq, at: now}
+	h.mu.Unlock()
+}
+
+// snapshot returns a copy of the histogram's data.
+func (h *latencyHistogram) snapshot() latencyCounts {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.latencyCounts
+}
+
+// quantiles returns the latency at each quantile in qs along with the
+// number of observations. All latencies are zero before the first one.
+func (h *latencyHistogram) quantiles(qs []float64) ([]time.Duration, uint64) {
+	return h.read(qs, false)
+}
+
+// takeQuantiles is quantiles, but also clears the histogram in the same
+// step, so no observation is lost between reading and resetting.
+func (h *latencyHistogram) takeQuantiles(qs []float64) ([]time.Duration, uint64) {
+	return h.read(qs, true)
+}
+
+func (h *latencyHistogram) read(qs []float64, reset bool) ([]time.Duration, uint64) {
+	h.mu.Lock()
+	counts, total := h.counts, h.total
+	if reset {
+		h.latencyCounts = latencyCounts{}
+	}
+	h.mu.Unlock()
+
+	out := make([]time.Duration, len(qs))
+	if total == 0 {
+		return out, 0
+	}
+	for j, q := range qs {
+		rank := uint64(q*float64(total) + 0.5)
+		if rank == 0 {
+			rank = 1
+		}
+		var seen uint64
+		for i, n := range counts {
+			seen += n
+			if seen >= rank {
+				out[j] = latencyBound(i)
+				break
+			}
+		}
+	}
+	return out, total
+}
+
+// latencyBound is the upper bound of bucket i.
+func latencyBound(i int) time.Duration {
+	return time.Microsecond << i
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// listen opens the server's listener: the Unix domain socket at
+// UnixSocket if one is configured, otherwise TCP on ListenAddr.
+func listen(cfg *Config) (net.Listener, error) {
+	if cfg.UnixSocket == "" {
+		return net.Listen("tcp", cfg.ListenAddr)
+	}
+	if err := removeStaleSocket(cfg.UnixSocket); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", cfg.UnixSocket)
+}
+
+// removeStaleSocket deletes a socket file left behind by a server that did
+// not shut down cleanly, which would otherwise make listening fail. Other
+// kinds of file are left alone so a typo cannot delete data.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
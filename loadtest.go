@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Bounds for the ?clients= and ?messages= parameters of a load test
+const (
+	loadTestMaxClients  = 500
+	loadTestMaxMessages = 100000
+	loadTestTimeout     = 30 * time.Second
+
+	// loadTestWindow is how many messages may be in flight at once. The
+	// test measures relay latency, so it must not publish faster than the
+	// clients drain or backpressure would drop them mid-run.
+	loadTestWindow = 32
+)
+
+// loadGenerator drives in-process WebSocket clients against the server's
+// own listener for /test/benchmark?load=1. It is nil unless BENCHMARK_LOAD
+// is set, since a load test competes with real traffic.
+type loadGenerator struct {
+	hub     *Hub
+	baseURL string // e.g. ws://localhost:8080
+	token   string // AUTH_TOKEN, if connections require one
+
+	// tokenSecret, if set, signs a token for each load client instead
+	tokenSecret string
+
+	// dialer connects the load clients; nil uses websocket.DefaultDialer
+	dialer *websocket.Dialer
+}
+
+// loadResult summarises one load test run.
+type loadResult struct {
+	Clients           int     `json:"clients"`
+	MessagesSent      int     `json:"messages_sent"`
+	MessagesExpected  int     `json:"messages_expected"`
+	MessagesDelivered int64   `json:"messages_delivered"`
+	DurationMs        int64   `json:"duration_ms"`
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	LatencyAvgMs      float64 `json:"latency_avg_ms"`
+	LatencyP50Ms      float64 `json:"latency_p50_ms"`
+	LatencyP95Ms      float64 `json:"latency_p95_ms"`
+	LatencyP99Ms      float64 `json:"latency_p99_ms"`
+	TimedOut          bool    `json:"timed_out"`
+}
+
+// parseLoadParams reads the client and message counts of a load test.
+func parseLoadParams(r *http.Request) (clients, messages int, err error) {
+	clients, messages = 10, 1000
+	if value := r.URL.Query().Get("clients"); value != "" {
+		if clients, err = strconv.Atoi(value); err != nil || clients < 2 || clients > loadTestMaxClients {
+			return 0, 0, fmt.Errorf("clients must be between 2 and %d", loadTestMaxClients)
+		}
+	}
+	if value := r.URL.Query().Get("messages"); value != "" {
+		if messages, err = strconv.Atoi(value); err != nil || messages < 1 || messages > loadTestMaxMessages {
+			return 0, 0, fmt.Errorf("messages must be between 1 and %d", loadTestMaxMessages)
+		}
+	}
+	return clients, messages, nil
+}
+
+// run connects the clients to a private room, has them take turns
+// publishing messages stamped with the send time, and measures how long
+// each takes to reach every other client. All connections are closed
+// before it returns.
+func (g *loadGenerator) run(clients, messages int) (loadResult, error) {
+	room := fmt.Sprintf("loadtest-%d", time.Now().UnixNano())
+	header := http.Header{}
+	if g.token != "" {
+		header.Set("Authorization", "Bearer "+g.token)
+	}
+	expires := time.Now().Add(loadTestTimeout)
+	dialer := g.dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+
+	conns := make([]*websocket.Conn, 0, clients)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < clients; i++ {
+		username := fmt.Sprintf("load-%d", i)
+		if g.tokenSecret != "" {
+			header.Set("Authorization", "Bearer "+mintToken(g.tokenSecret, username, expires))
+		}
+		u := fmt.Sprintf("%s/ws/%s/%s?replay=0", g.baseURL, url.PathEscape(room), username)
+		conn, _, err := dialer.Dial(u, header)
+		if err != nil {
+			return loadResult{}, fmt.Errorf("connecting load client %d: %w", i, err)
+		}
+		conns = append(conns, conn)
+	}
+
+	// Dial returns once upgraded, slightly before Run registers the client,
+	// and a later client's handler may reach Run first. Wait until every
+	// client is in the room so no early message can miss a recipient.
+	wait := time.Now()
+	for i := 0; i < clients; i++ {
+		username := fmt.Sprintf("load-%d", i)
+		for g.hub.lookup(room, username) == nil {
+			if time.Since(wait) > loadTestTimeout {
+				return loadResult{}, errors.New("load clients were not registered in time")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	expected := messages * (clients - 1)
+	var (
+		delivered atomic.Int64
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, expected)
+		readers   sync.WaitGroup
+		progress  = make(chan struct{}, 1)
+	)
+	for _, conn := range conns {
+		readers.Add(1)
+		go func(conn *websocket.Conn) {
+			defer readers.Done()
+			for {
+				messageType, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				// Skip server notices such as throttling. A frame may hold
+				// several payloads when the server batches writes.
+				if messageType != websocket.BinaryMessage || len(data)%16 != 0 {
+					continue
+				}
+				now := time.Now()
+				mu.Lock()
+				for off := 0; off < len(data); off += 16 {
+					sent := time.Unix(0, int64(binary.BigEndian.Uint64(data[off:])))
+					latencies = append(latencies, now.Sub(sent))
+				}
+				mu.Unlock()
+				delivered.Add(int64(len(data) / 16))
+				select {
+				case progress <- struct{}{}:
+				default:
+				}
+			}
+		}(conn)
+	}
+
+	// waitFor blocks until n deliveries have been seen, reporting false if
+	// the test ran out of time first.
+	deadline := time.NewTimer(loadTestTimeout)
+	defer deadline.Stop()
+	waitFor := func(n int) bool {
+		for delivered.Load() < int64(n) {
+			select {
+			case <-progress:
+			case <-deadline.C:
+				return false
+			}
+		}
+		return true
+	}
+
+	// Payloads carry the send time and a sequence number, so they are
+	// never mistaken for duplicates.
+	start := time.Now()
+	timedOut := false
+	for seq := 0; seq < messages && !timedOut; seq++ {
+		if !waitFor((seq - loadTestWindow) * (clients - 1)) {
+			timedOut = true
+			break
+		}
+		payload := make([]byte, 16)
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(payload[8:], uint64(seq))
+		if err := conns[seq%clients].WriteMessage(websocket.BinaryMessage, payload); err != nil {
+			return loadResult{}, fmt.Errorf("publishing load message %d: %w", seq, err)
+		}
+	}
+	if !timedOut {
+		timedOut = !waitFor(expected)
+	}
+	elapsed := time.Since(start)
+	for _, conn := range conns {
+		conn.Close()
+	}
+	readers.Wait()
+
+	result := loadResult{
+		Clients:           clients,
+		MessagesSent:      messages,
+		MessagesExpected:  expected,
+		MessagesDelivered: delivered.Load(),
+		DurationMs:        elapsed.Milliseconds(),
+		TimedOut:          timedOut,
+	}
+	if elapsed > 0 {
+		result.MessagesPerSecond = float64(result.MessagesDelivered) / elapsed.Seconds()
+	}
+	if len(latencies) == 0 {
+		return result, errors.New("no load test messages were delivered")
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	result.LatencyAvgMs = milliseconds(total / time.Duration(len(latencies)))
+	result.LatencyP50Ms = milliseconds(percentile(latencies, 0.50))
+	result.LatencyP95Ms = milliseconds(percentile(latencies, 0.95))
+	result.LatencyP99Ms = milliseconds(percentile(latencies, 0.99))
+	return result, nil
+}
+
+// percentile returns the p-th quantile of sorted, which must not be empty.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
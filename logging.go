@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// parseLogLevel maps a LOG_LEVEL value to a slog level.
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", level)
+	}
+}
+
+// setupLogging configures the default slog logger. The "text" format keeps
+// the standard log output for local development; "json" writes one JSON
+// object per line with the timestamp under "ts", for log aggregators, and
+// routes plain log.Printf calls through the same handler as info events.
+// Events below level are discarded; with the text format log.Printf output
+// is always written.
+func setupLogging(format, level string) error {
+	minLevel, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "", "text":
+		if minLevel == slog.LevelInfo {
+			return nil
+		}
+		slog.SetDefault(slog.New(&textHandler{
+			level:  minLevel,
+			logger: log.New(os.Stderr, "", log.LstdFlags),
+		}))
+		// SetDefault routes the log package through the handler too; keep
+		// log.Printf writing directly, as with the default handler.
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		return nil
+	case "json":
+		handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level: minLevel,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					a.Key = "ts"
+				}
+				return a
+			},
+		})
+		slog.SetDefault(slog.New(handler))
+		return nil
+	default:
+		return fmt.Errorf("invalid log format %q: must be json or text", format)
+	}
+}
+
+// textHandler writes records in the format of slog's default handler,
+// "2006/01/02 15:04:05 INFO message key=value", with a minimum level. The
+// default handler itself cannot be filtered by level before Go 1.22.
+type textHandler struct {
+	level  slog.Level
+	logger *log.Logger
+	attrs  string // preformatted attributes from WithAttrs
+	group  string // key prefix from WithGroup
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Level.String())
+	b.WriteByte(' ')
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&b, h.group, a)
+		return true
+	})
+	return h.logger.Output(0, b.String())
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	for _, a := range attrs {
+		appendAttr(&b, h.group, a)
+	}
+	h2 := *h
+	h2.attrs += b.String()
+	return &h2
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group += name + "."
+	return &h2
+}
+
+// appendAttr writes " key=value", quoting values that contain spaces or
+// other characters that would make the line ambiguous.
+func appendAttr(b *strings.Builder, group string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		prefix := group
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(b, prefix, ga)
+		}
+		return
+	}
+	value := a.Value.String()
+	if strings.IndexFunc(value, func(r rune) bool { return unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r) }) >= 0 || value == "" {
+		value = strconv.Quote(value)
+	}
+	b.WriteByte(' ')
+	b.WriteString(group)
+	b.WriteString(a.Key)
+	b.WriteByte('=')
+	b.WriteString(value)
+}
+
+// bannerEnabled selects the human-readable startup banner over a single
+// structured startup event; main turns it off for QUIET and JSON logs.
+var bannerEnabled = true
+
+// bannerf logs a line of the startup banner, if it is enabled.
+func bannerf(format string, args ...interface{}) {
+	if bannerEnabled {
+		log.Printf(format, args...)
+	}
+}
+
+// logStartup logs the startup event that replaces the banner, with the
+// address served, the connection timeouts and the build metadata.
+func logStartup(addr string, hub HubConfig) {
+	info := deploymentInfo()
+	slog.Info("Server started", "event", "startup",
+		"version", ServerVersion,
+		"addr", addr,
+		"write_wait", hub.WriteWait.String(),
+		"ping_interval", hub.PingInterval.String(),
+		"pong_wait", hub.PongWait.String(),
+		"commit", info["commit"],
+		"build_time", info["timestamp"],
+		"actor", info["actor"],
+		"run_id", info["run_id"])
+}
+
+// logSummary is what the previous connection summary reported.
+type logSummary struct {
+	connections uint64
+	connected   int
+	messages    uint64
+}
+
+// logConnectionSummary logs the connected count and what changed since
+// the previous summary, in place of the per-connection events demoted to
+// debug level. Nothing is logged when nothing changed. Called from Run
+// only.
+func (h *Hub) logConnectionSummary(prev *logSummary) {
+	h.mu.RLock()
+	now := logSummary{
+		connections: h.stats.TotalConnections,
+		connected:   h.clientCount(),
+		messages:    h.stats.TotalMessages,
+	}
+	h.mu.RUnlock()
+	if now == *prev {
+		return
+	}
+	connects := now.connections - prev.connections
+	disconnects := int(connects) - (now.connected - prev.connected)
+	slog.Info("Connection summary", "event", "connection_summary",
+		"total_users", now.connected,
+		"connects", connects,
+		"disconnects", disconnects,
+		"messages", now.messages-prev.messages,
+		"interval", h.config.LogSummaryInterval.String())
+	*prev = now
+}
+
+// summaryTicker returns a channel that fires every LogSummaryInterval, or
+// nil, which never fires, when summaries are off, along with a function
+// to stop it.
+func (h *Hub) summaryTicker() (<-chan time.Time, func()) {
+	if h.config.LogSummaryInterval <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(h.config.LogSummaryInterval)
+	return ticker.C, ticker.Stop
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Clients may describe themselves with metadata when connecting, given as
+// query parameters prefixed with "meta.", e.g. ?meta.region=eu&meta.role=worker.
+// A message may then carry a selector such as "region=eu,role!=observer",
+// with "selector" in a JSON protocol frame or ?selector= on an HTTP
+// publish, and is only delivered to clients in its room whose metadata
+// satisfies every term: key=value requires the key to have that value,
+// key!=value that it is missing or has another. Messages without a
+// selector reach every client as before.
+
+// Limits on the metadata a client may attach.
+const (
+	maxMetadataKeys   = 16
+	maxMetadataLength = 256
+)
+
+// metadataPrefix marks the query parameters holding client metadata.
+const metadataPrefix = "meta."
+
+// parseMetadata collects the client metadata from query, nil if there is
+// none. Only the first value of a repeated parameter is kept.
+func parseMetadata(query url.Values) (map[string]string, error) {
+	var meta map[string]string
+	for param, values := range query {
+		key, ok := strings.CutPrefix(param, metadataPrefix)
+		if !ok {
+			continue
+		}
+		if err := validateMetadataKey(key); err != nil {
+			return nil, err
+		}
+		if len(values[0]) > maxMetadataLength {
+			return nil, fmt.Errorf("metadata %q: value longer than %d bytes", key, maxMetadataLength)
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[key] = values[0]
+	}
+	if len(meta) > maxMetadataKeys {
+		return nil, fmt.Errorf("too many metadata keys: at most %d", maxMetadataKeys)
+	}
+	return meta, nil
+}
+
+// validateMetadataKey checks that key is non-empty, not too long and
+// cannot be confused with selector syntax.
+func validateMetadataKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("empty metadata key")
+	}
+	if len(key) > maxMetadataLength {
+		return fmt.Errorf("metadata key longer than %d bytes", maxMetadataLength)
+	}
+	if strings.ContainsAny(key, "=!, ") {
+		return fmt.Errorf("invalid metadata key %q: must not contain '=', '!', ',' or spaces", key)
+	}
+	return nil
+}
+
+// selectorTerm is one comma-separated term of a selector.
+type selectorTerm struct {
+	key    string
+	value  string
+	negate bool
+}
+
+// selector is a parsed message selector; nil matches every client.
+type selector []selectorTerm
+
+// parseSelector parses a selector of comma-separated key=value and
+// key!=value terms. An empty selector is nil.
+func parseSelector(s string) (selector, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var sel selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		key, value, ok := strings.Cut(term, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid selector term %q: want key=value or key!=value", term)
+		}
+		key, negate := strings.CutSuffix(key, "!")
+		key = strings.TrimSpace(key)
+		if err := validateMetadataKey(key); err != nil {
+			return nil, fmt.Errorf("invalid selector term %q: %w", term, err)
+		}
+		sel = append(sel, selectorTerm{key: key, value: strings.TrimSpace(value), negate: negate})
+	}
+	return sel, nil
+}
+
+// matches reports whether metadata satisfies every term of the selector.
+func (s selector) matches(meta map[string]string) bool {
+	for _, term := range s {
+		value, ok := meta[term.key]
+		if (ok && value == term.value) == term.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the selector in the form parseSelector reads, for
+// forwarding to peers.
+func (s selector) String() string {
+	terms := make([]string, len(s))
+	for i, term := range s {
+		op := "="
+		if term.negate {
+			op = "!="
+		}
+		terms[i] = term.key + op + term.value
+	}
+	return strings.Join(terms, ",")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseMetadata(t *testing.T) {
+	tooMany := url.Values{}
+	for _, key := range strings.Split("abcdefghijklmnopq", "") {
+		tooMany.Set("meta."+key, "v")
+	}
+	tests := []struct {
+		query string
+		want  map[string]string
+		valid bool
+	}{
+		{"", nil, true},
+		{"replay=5&mode=publisher", nil, true},
+		{"meta.region=eu&meta.role=worker&echo=1", map[string]string{"region": "eu", "role": "worker"}, true},
+		{"meta.region=eu&meta.region=us", map[string]string{"region": "eu"}, true},
+		{"meta.region=", map[string]string{"region": ""}, true},
+		{"meta.=eu", nil, false},
+		{"meta.a%3Db=1", nil, false},
+		{"meta.a!=1", nil, false},
+		{"meta.a,b=1", nil, false},
+		{"meta.a%20b=1", nil, false},
+		{"meta." + strings.Repeat("k", maxMetadataLength+1) + "=1", nil, false},
+		{"meta.k=" + strings.Repeat("v", maxMetadataLength), map[string]string{"k": strings.Repeat("v", maxMetadataLength)}, true},
+		{"meta.k=" + strings.Repeat("v", maxMetadataLength+1), nil, false},
+		{tooMany.Encode(), nil, false},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseMetadata(query)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseMetadata(%.40q) error = %v, want valid %t", tt.query, err, tt.valid)
+			continue
+		}
+		if tt.valid && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseMetadata(%.40q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	eu := map[string]string{"region": "eu", "role": "worker"}
+	tests := []struct {
+		selector string
+		meta     map[string]string
+		want     bool
+	}{
+		{"", nil, true},
+		{"", eu, true},
+		{"region=eu", eu, true},
+		{"region=us", eu, false},
+		{"region=eu", nil, false},
+		{"region!=us", eu, true},
+		{"region!=eu", eu, false},
+		{"region!=eu", nil, true},
+		{"region=eu,role=worker", eu, true},
+		{"region=eu,role=observer", eu, false},
+		{"region=eu,role!=observer", eu, true},
+		{" region = eu , role != observer ", eu, true},
+		{"zone=", eu, false},
+		{"zone=", map[string]string{"zone": ""}, true},
+	}
+	for _, tt := range tests {
+		sel, err := parseSelector(tt.selector)
+		if err != nil {
+			t.Fatalf("parseSelector(%q): %v", tt.selector, err)
+		}
+		if got := sel.matches(tt.meta); got != tt.want {
+			t.Errorf("selector %q matches %v = %t, want %t", tt.selector, tt.meta, got, tt.want)
+		}
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	for _, s := range []string{"region", "region=eu,", "=eu", "!=eu", "a b=1", "region=eu,role"} {
+		if _, err := parseSelector(s); err == nil {
+			t.Errorf("parseSelector(%q) accepted an invalid selector", s)
+		}
+	}
+	// String gives back what peers parse into the same selector
+	sel, err := parseSelector(" region = eu , role != observer ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sel.String(); got != "region=eu,role!=observer" {
+		t.Errorf("String() = %q", got)
+	}
+	again, err := parseSelector(sel.String())
+	if err != nil || !reflect.DeepEqual(again, sel) {
+		t.Errorf("reparsing %q gave %v, %v", sel, again, err)
+	}
+}
+
+func TestSelectorTargetsMatchingClients(t *testing.T) {
+	srv := newTestServer(t, nil)
+	euWorker := srv.connect(t, "r", "eu-worker", "meta.region=eu&meta.role=worker")
+	euObserver := srv.connect(t, "r", "eu-observer", "meta.region=eu&meta.role=observer")
+	us := srv.connect(t, "r", "us-worker", "meta.region=us&meta.role=worker")
+	sender := srv.connect(t, "r", "alice", "protocol=json")
+
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"selector":"region=eu,role!=observer","payload":"eu job"}`))
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"payload":"everyone"}`))
+	if _, data := readFrame(t, euWorker); !strings.Contains(string(data), "eu job") {
+		t.Fatalf("eu worker got %s, want the selected message", data)
+	}
+	for name, conn := range map[string]*websocket.Conn{"eu worker": euWorker, "eu observer": euObserver, "us worker": us} {
+		if _, data := readFrame(t, conn); !strings.Contains(string(data), "everyone") {
+			t.Errorf("%s got %s, want only the unselected message", name, data)
+		}
+	}
+
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"selector":"region","payload":"lost"}`))
+	if _, data := readFrame(t, sender); decodeErrorFrame(t, data).Reason != "invalid_selector" {
+		t.Errorf("invalid selector answered with %s", data)
+	}
+	expectSilence(t, us, 100*time.Millisecond)
+}
+
+func TestInvalidMetadataRejectedBeforeUpgrade(t *testing.T) {
+	srv := newTestServer(t, nil)
+	for _, query := range []string{"meta.=x", "meta.a!=b", "meta.k=" + strings.Repeat("v", maxMetadataLength+1)} {
+		if status, _ := srv.dialStatus(t, "/ws/r/alice?"+query, nil); status != http.StatusBadRequest {
+			t.Errorf("%.30s: got HTTP %d, want 400", query, status)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Content types of the two exposition formats /metrics serves. Scrapers
+// asking for OpenMetrics in their Accept header get it, with exemplars;
+// everyone else gets the classic Prometheus text format.
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// maxExemplarRoom is the longest room name given as an exemplar label;
+// OpenMetrics limits exemplar labels to 128 characters in all.
+const maxExemplarRoom = 64
+
+// metricsWriter renders metrics in the Prometheus text exposition format,
+// or in OpenMetrics with openMetrics set.
+type metricsWriter struct {
+	w           io.Writer
+	openMetrics bool
+}
+
+// metric writes one metric with its HELP and TYPE lines. kind is "counter"
+// or "gauge". In OpenMetrics a counter family is named without the
+// _total suffix its sample carries.
+func (m metricsWriter) metric(name, kind, help string, value interface{}) {
+	family := name
+	if m.openMetrics && kind == "counter" {
+		family = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", family, help, family, kind, name, value)
+}
+
+// summary writes a summary metric from quantile values in seconds.
+func (m metricsWriter) summary(name, help string, quantiles []float64, values []time.Duration, count uint64) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s summary\n", name, help, name)
+	for i, q := range quantiles {
+		fmt.Fprintf(m.w, "%s{quantile=\"%g\"} %v\n", name, q, values[i].Seconds())
+	}
+	fmt.Fprintf(m.w, "%s_count %d\n", name, count)
+}
+
+// histogram writes the latency histogram in OpenMetrics, with the latest
+// observation in each bucket as its exemplar, labelled with the room and
+// sequence number of the message measured.
+func (m metricsWriter) histogram(name, help string, c latencyCounts) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, n := range c.counts {
+		cumulative += n
+		le := "+Inf"
+		if i < latencyBuckets-1 {
+			le = fmt.Sprintf("%g", latencyBound(i).Seconds())
+		}
+		fmt.Fprintf(m.w, "%s_bucket{le=\"%s\"} %d", name, le, cumulative)
+		if e := c.exemplars[i]; !e.at.IsZero() {
+			fmt.Fprintf(m.w, " # {%sseq=\"%d\"} %v %.3f", exemplarRoom(e.room), e.seq, e.latency.Seconds(), float64(e.at.UnixMilli())/1000)
+		}
+		fmt.Fprintln(m.w)
+	}
+	fmt.Fprintf(m.w, "%s_count %d\n%s_sum %v\n", name, c.total, name, c.sum.Seconds())
+}
+
+// end finishes the exposition; OpenMetrics requires a closing # EOF.
+func (m metricsWriter) end() {
+	if m.openMetrics {
+		fmt.Fprintln(m.w, "# EOF")
+	}
+}
+
+// exemplarRoom returns the room label of an exemplar, escaped, or nothing
+// for a room name too long to fit the exemplar's label limit.
+func exemplarRoom(room string) string {
+	if len(room) > maxExemplarRoom {
+		return ""
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(room)
+	return `room="` + escaped + `",`
+}
+
+// wantsOpenMetrics reports whether the scraper accepts OpenMetrics.
+func wantsOpenMetrics(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+}
+
+// HandleMetrics serves the hub counters for Prometheus scraping.
+func HandleMetrics(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hub.mu.RLock()
+		clientCount := hub.clientCount()
+		stats := hub.stats
+		uptime := time.Since(hub.startTime)
+		hub.mu.RUnlock()
+		stats.TotalBytesSent = hub.bytesSent.Load()
+		stats.PanicsRecovered = hub.panicsRecovered.Load()
+		stats.DroppedMessages = hub.droppedMessages.Load()
+		circuitOpen := 0
+		if hub.circuitOpen.Load() {
+			circuitOpen = 1
+		}
+
+		m := metricsWriter{w: w, openMetrics: wantsOpenMetrics(r)}
+		w.Header().Add("Vary", "Accept")
+		if m.openMetrics {
+			w.Header().Set("Content-Type", openMetricsContentType)
+		} else {
+			w.Header().Set("Content-Type", prometheusContentType)
+		}
+		m.metric("relay_uptime_seconds", "gauge", "Seconds since the server started.", uptime.Seconds())
+		m.metric("relay_connected_clients", "gauge", "Clients currently connected.", clientCount)
+		m.metric("relay_peak_connections", "gauge", "Highest number of concurrent clients.", stats.PeakConnections)
+		m.metric("relay_broadcast_queue_depth", "gauge", "Messages waiting in the broadcast queue.", len(hub.broadcast))
+		m.metric("relay_broadcast_queue_capacity", "gauge", "Capacity of the broadcast queue.", cap(hub.broadcast))
+		m.metric("relay_buffered_bytes", "gauge", "Payload bytes queued for all clients.", hub.bufferedBytes.Load())
+		m.metric("relay_circuit_open", "gauge", "1 while the circuit breaker is shedding load.", circuitOpen)
+		m.metric("relay_connections_total", "counter", "Clients accepted since startup.", stats.TotalConnections)
+		m.metric("relay_upgrade_failures_total", "counter", "WebSocket handshakes that failed.", stats.UpgradeFailures)
+		m.metric("relay_panics_recovered_total", "counter", "Panics the hub recovered from.", stats.PanicsRecovered)
+		m.metric("relay_messages_total", "counter", "Messages relayed since startup.", stats.TotalMessages)
+		m.metric("relay_bytes_relayed_total", "counter", "Payload bytes relayed since startup.", stats.TotalBytesRelayed)
+		m.metric("relay_bytes_sent_total", "counter", "Payload bytes written to clients since startup, once per recipient.", stats.TotalBytesSent)
+		m.metric("relay_dropped_clients_total", "counter", "Clients disconnected because their send buffer was full.", stats.DroppedClients)
+		m.metric("relay_dropped_messages_total", "counter", "Queued frames discarded for a full send buffer by drop-message or drop-oldest.", stats.DroppedMessages)
+		m.metric("relay_expired_messages_total", "counter", "Queued messages discarded after the message TTL.", stats.ExpiredMessages)
+		m.metric("relay_transform_failures_total", "counter", "Messages dropped because a transformer failed.", stats.TransformFailures)
+		m.metric("relay_blocked_messages_total", "counter", "Messages refused by the content policy.", stats.BlockedMessages)
+		m.metric("relay_schema_rejections_total", "counter", "JSON protocol frames rejected for not conforming to the schema.", stats.SchemaRejections)
+		m.metric("relay_deduplicated_messages_total", "counter", "Repeated messages suppressed within the dedup window.", stats.DeduplicatedMessages)
+		m.metric("relay_circuit_trips_total", "counter", "Times the circuit breaker opened.", stats.CircuitTrips)
+		m.metric("relay_shed_clients_total", "counter", "Clients disconnected by the circuit breaker.", stats.ShedClients)
+		m.metric("relay_sink_dropped_total", "counter", "Messages not archived because the sink fell behind.", stats.SinkDropped)
+		if hub.latency != nil {
+			const help = "Time from reading a message to queuing it for every recipient."
+			if m.openMetrics {
+				m.histogram("relay_latency_seconds", help, hub.latency.snapshot())
+			} else {
+				latencies, count := hub.latency.quantiles(latencyQuantiles)
+				m.summary("relay_latency_seconds", help, latencyQuantiles, latencies, count)
+			}
+		}
+		m.end()
+	}
+}
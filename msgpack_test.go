@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// decodeMsgpack decodes the MessagePack value at the start of b, returning
+// it with the bytes that follow. It reads what appendMsgpack writes, as a
+// client would: integers as int64, floats as float64, maps as
+// map[string]interface{}.
+func decodeMsgpack(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("unexpected end of input")
+	}
+	tag, b := b[0], b[1:]
+	switch {
+	case tag <= 0x7f:
+		return int64(tag), b, nil
+	case tag >= 0xe0:
+		return int64(int8(tag)), b, nil
+	case tag&0xe0 == 0xa0:
+		return decodeMsgpackString(b, int(tag&0x1f))
+	case tag&0xf0 == 0x90:
+		return decodeMsgpackArray(b, int(tag&0x0f))
+	case tag&0xf0 == 0x80:
+		return decodeMsgpackMap(b, int(tag&0x0f))
+	}
+
+	sizes := map[byte]int{
+		0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8,
+		0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8,
+		0xcb: 8, 0xd9: 1, 0xda: 2, 0xdb: 4,
+		0xdc: 2, 0xdd: 4, 0xde: 2, 0xdf: 4,
+	}
+	switch tag {
+	case 0xc0:
+		return nil, b, nil
+	case 0xc2:
+		return false, b, nil
+	case 0xc3:
+		return true, b, nil
+	}
+	size, ok := sizes[tag]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown format 0x%02x", tag)
+	}
+	if len(b) < size {
+		return nil, nil, fmt.Errorf("format 0x%02x truncated", tag)
+	}
+	var u uint64
+	for _, c := range b[:size] {
+		u = u<<8 | uint64(c)
+	}
+	b = b[size:]
+	switch tag {
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		if u > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("uint64 %d overflows int64", u)
+		}
+		return int64(u), b, nil
+	case 0xd0:
+		return int64(int8(u)), b, nil
+	case 0xd1:
+		return int64(int16(u)), b, nil
+	case 0xd2:
+		return int64(int32(u)), b, nil
+	case 0xd3:
+		return int64(u), b, nil
+	case 0xcb:
+		return math.Float64frombits(u), b, nil
+	case 0xd9, 0xda, 0xdb:
+		return decodeMsgpackString(b, int(u))
+	case 0xdc, 0xdd:
+		return decodeMsgpackArray(b, int(u))
+	default:
+		return decodeMsgpackMap(b, int(u))
+	}
+}
+
+func decodeMsgpackString(b []byte, n int) (interface{}, []byte, error) {
+	if len(b) < n {
+		return nil, nil, fmt.Errorf("string of %d bytes truncated", n)
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func decodeMsgpackArray(b []byte, n int) (interface{}, []byte, error) {
+	items := make([]interface{}, n)
+	for i := range items {
+		var err error
+		if items[i], b, err = decodeMsgpack(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	return items, b, nil
+}
+
+func decodeMsgpackMap(b []byte, n int) (interface{}, []byte, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, rest, err := decodeMsgpack(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("map key %v is not a string", k)
+		}
+		if m[key], b, err = decodeMsgpack(rest); err != nil {
+			return nil, nil, err
+		}
+	}
+	return m, b, nil
+}
+
+// normalizeJSON decodes data as decodeMsgpack would decode its
+// MessagePack form: whole numbers that fit as int64, others as float64.
+func normalizeJSON(tb testing.TB, data []byte) interface{} {
+	tb.Helper()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		tb.Fatalf("decode %s: %v", data, err)
+	}
+	var normalize func(v interface{}) interface{}
+	normalize = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				return n
+			}
+			f, _ := v.Float64()
+			return f
+		case []interface{}:
+			for i := range v {
+				v[i] = normalize(v[i])
+			}
+		case map[string]interface{}:
+			for k := range v {
+				v[k] = normalize(v[k])
+			}
+		}
+		return v
+	}
+	return normalize(v)
+}
+
+// roundTrip encodes data with jsonToMsgpack and decodes it again.
+func roundTrip(tb testing.TB, data []byte) interface{} {
+	tb.Helper()
+	encoded, err := jsonToMsgpack(data)
+	if err != nil {
+		tb.Fatalf("jsonToMsgpack(%s): %v", data, err)
+	}
+	v, rest, err := decodeMsgpack(encoded)
+	if err != nil {
+		tb.Fatalf("decode %s: %v", data, err)
+	}
+	if len(rest) != 0 {
+		tb.Fatalf("decode %s left %d trailing bytes", data, len(rest))
+	}
+	return v
+}
+
+func TestControlFramesRoundTripThroughMsgpack(t *testing.T) {
+	marshal := func(v interface{}) []byte {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	remaining := int64(42)
+	resets := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	frames := map[string][]byte{
+		"ping":       heartbeatFrame(resets),
+		"welcome":    newWelcomeFrame("guest-1a2b", "lobby"),
+		"error":      newErrorFrame(429, "rate_limited", "message dropped by the rate limit"),
+		"presence":   presenceFrame(presenceEvent{Type: "presence", Event: "join", Room: "r", User: "alice"}).data,
+		"snapshot":   presenceFrame(presenceEvent{Type: "presence", Event: "snapshot", Room: "r", Users: []string{"alice", "bob"}}).data,
+		"roster":     marshal(rosterFrame{Type: "roster", Room: "r", Users: []string{"alice", "bob", "carol"}}),
+		"ack":        marshal(ackFrame{Type: "ack", ID: json.RawMessage(`"m-1"`)}),
+		"nack":       marshal(ackFrame{Type: "nack", ID: json.RawMessage(`17`), Reason: "rate_limited"}),
+		"quota":      marshal(quotaStatus{Type: "quota", MessagesRemaining: &remaining, ResetsAt: resets}),
+		"resume":     marshal(resumeFrame{Type: "resume", Room: "r", Seq: 1 << 40, Since: 300, Lost: 0}),
+		"subscribed": marshal(subscribeRequest{Type: "subscribed", Topics: []string{"news.*", "alerts"}}),
+		"announcement": marshal(announcementFrame{
+			Type: "announcement", Level: AnnouncementWarning, Message: "restarting in 5 minutes", TS: resets,
+		}),
+		"chunk": marshal(chunkNotice{Type: "chunk", ID: 7, Offset: 65536, Size: 1 << 20, Text: true}),
+	}
+	for name, data := range frames {
+		t.Run(name, func(t *testing.T) {
+			got := roundTrip(t, data)
+			if want := normalizeJSON(t, data); !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip of %s = %#v, want %#v", data, got, want)
+			}
+		})
+	}
+}
+
+func TestMsgpackFormatBoundaries(t *testing.T) {
+	var values []interface{}
+	for _, n := range []int64{
+		0, 127, 128, 255, 256, 65535, 65536, math.MaxUint32, math.MaxUint32 + 1, math.MaxInt64,
+		-1, -32, -33, -128, -129, -32768, -32769, math.MinInt32, math.MinInt32 - 1, math.MinInt64,
+	} {
+		values = append(values, n)
+	}
+	values = append(values, 0.5, -1e300, true, false, nil)
+	for _, n := range []int{0, 31, 32, 255, 256, 65535, 65536} {
+		values = append(values, strings.Repeat("x", n))
+	}
+	for _, n := range []int{0, 15, 16, 65536} {
+		array := make([]interface{}, n)
+		object := make(map[string]interface{}, n)
+		for i := range array {
+			array[i] = int64(i)
+			object[fmt.Sprint(i)] = int64(i)
+		}
+		values = append(values, array, object)
+	}
+
+	for _, want := range values {
+		data, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := roundTrip(t, data); !reflect.DeepEqual(got, normalizeJSON(t, data)) {
+			t.Errorf("round trip of %.40s changed it to %.40v", data, got)
+		}
+	}
+}
+
+func TestMsgpackIntegersUseSmallestFormat(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want []byte
+	}{
+		{5, []byte{0x05}},
+		{-5, []byte{0xfb}},
+		{200, []byte{0xcc, 200}},
+		{-100, []byte{0xd0, 0x9c}},
+		{1000, []byte{0xcd, 0x03, 0xe8}},
+		{1 << 20, []byte{0xce, 0x00, 0x10, 0x00, 0x00}},
+		{-1 << 20, []byte{0xd2, 0xff, 0xf0, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		if got := appendMsgpackInt(nil, tt.n); !bytes.Equal(got, tt.want) {
+			t.Errorf("appendMsgpackInt(%d) = % x, want % x", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestMsgpackClientReceivesDecodableNotices(t *testing.T) {
+	srv := newTestServer(t, nil)
+	alice := srv.connect(t, "r", "alice", "encoding=msgpack&presence=1")
+	messageType, data := readFrame(t, alice)
+	if messageType != websocket.BinaryMessage {
+		t.Fatalf("snapshot arrived as message type %d, want binary", messageType)
+	}
+	v, rest, err := decodeMsgpack(data)
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("decode snapshot: %v (%d trailing bytes)", err, len(rest))
+	}
+	want := map[string]interface{}{
+		"type": "presence", "event": "snapshot", "room": "r", "users": []interface{}{"alice"},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("snapshot = %#v, want %#v", v, want)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// presenceEvent is the control frame sent to clients that connected with
+// ?presence=1 when users join or leave their room. A "snapshot" event
+// carrying the current user list is sent once to the joining client.
+type presenceEvent struct {
+	Type  string   `json:"type"`
+	Event string   `json:"event"`
+	Room  string   `json:"room"`
+	User  string   `json:"user,omitempty"`
+	Users []string `json:"users,omitempty"`
+}
+
+// announcePresence tells the other subscribed clients in the room that
+// client joined or left. On join the client itself, if subscribed, also
+// receives a snapshot of the room. Called from Run only.
+func (h *Hub) announcePresence(client *Client, event string) {
+	notice := presenceFrame(presenceEvent{
+		Type:  "presence",
+		Event: event,
+		Room:  client.room,
+		User:  client.username,
+	})
+
+	var users []string
+	h.forEachInRoom(client.room, func(other *Client) {
+		users = append(users, other.username)
+		if other != client && other.presence {
+			trySend(other, notice)
+		}
+	})
+
+	if event == "join" && client.presence {
+		sort.Strings(users)
+		h.sendTo(client, presenceFrame(presenceEvent{
+			Type:  "presence",
+			Event: "snapshot",
+			Room:  client.room,
+			Users: users,
+		}))
+	}
+}
+
+// presenceFrame encodes a presence event as a notice, with its binary
+// protocol form alongside.
+func presenceFrame(e presenceEvent) frame {
+	data, _ := json.Marshal(e)
+	f := textFrame(data)
+	f.binary = encodePresence(e)
+	return f
+}
+
+// trySend queues a frame on the client without blocking, dropping it if the
+// client's buffer is full. The caller must hold the read lock of the
+// client's shard so send is not closed concurrently.
+func trySend(client *Client, f frame) bool {
+	select {
+	case client.send <- f:
+		client.enqueued(f)
+		return true
+	default:
+		return false
+	}
+}
+
+// rosterFrame answers a {"type":"who"} query with the users in the
+// client's room.
+type rosterFrame struct {
+	Type  string   `json:"type"`
+	Room  string   `json:"room"`
+	Users []string `json:"users"`
+}
+
+// isWhoQuery reports whether data is a roster query, {"type":"who"}.
+func isWhoQuery(data []byte) bool {
+	if !bytes.Contains(data, []byte(`"who"`)) {
+		return false
+	}
+	var query struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(data, &query) == nil && query.Type == "who"
+}
+
+// roster returns the sorted users in the client's room, including the
+// client, as a roster notice with its binary protocol form. Each shard is
+// read under its lock, so the list is consistent per shard even while Run
+// adds and removes clients.
+func (c *Client) roster() frame {
+	users := []string{}
+	c.hub.forEachInRoom(c.room, func(other *Client) {
+		users = append(users, other.username)
+	})
+	sort.Strings(users)
+	r := rosterFrame{Type: "roster", Room: c.room, Users: users}
+	data, _ := json.Marshal(r)
+	f := textFrame(data)
+	f.binary = encodeRoster(r)
+	return f
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWhoQuery(t *testing.T) {
+	srv := newTestServer(t, nil)
+	receiver := srv.connect(t, "r", "bob", "")
+	alice := srv.connect(t, "r", "alice", "protocol=json")
+	carol := srv.connect(t, "r", "carol", "")
+	srv.connect(t, "other", "dave", "")
+
+	// To a raw client the query is just another payload
+	query := `{"type":"who"}`
+	carol.WriteMessage(websocket.TextMessage, []byte(query))
+	if _, data := readFrame(t, receiver); string(data) != query {
+		t.Fatalf("receiver got %s, want the raw query relayed", data)
+	}
+	readFrame(t, alice)
+
+	alice.WriteMessage(websocket.TextMessage, []byte(query))
+	_, data := readFrame(t, alice)
+	var roster rosterFrame
+	if err := json.Unmarshal(data, &roster); err != nil || roster.Type != "roster" || roster.Room != "r" {
+		t.Fatalf("roster query answered with %s", data)
+	}
+	if got := roster.Users; len(got) != 3 || got[0] != "alice" || got[1] != "bob" || got[2] != "carol" {
+		t.Errorf("roster users %v, want [alice bob carol]", got)
+	}
+	expectSilence(t, receiver, 50*time.Millisecond)
+	expectSilence(t, carol, 50*time.Millisecond)
+}
@@ -0,0 +1,54 @@
+package main
+
+// Messages marked priority, by a JSON protocol client with
+// "priority":true or an HTTP publish with ?priority=1, are queued on each
+// recipient's priority lane instead of its send buffer. WritePump empties
+// the lane before every frame it takes from the send buffer and between
+// the pieces of a chunked message, so a priority message overtakes bulk
+// data already queued; frames within each lane keep their order. Anyone
+// who may publish may mark messages priority, and a steady stream of them
+// holds back everything in the send buffer, so the lane suits occasional
+// control messages rather than data.
+
+// writePriority writes f, just taken off the priority lane, and then
+// every frame still waiting there.
+func (c *Client) writePriority(f frame) error {
+	for {
+		c.dequeued(f)
+		if !c.expired(f) {
+			c.conn.SetWriteDeadline(c.writeDeadline())
+			if err := c.writeFrame(f); err != nil {
+				return err
+			}
+			c.countSent(1, len(f.data))
+		}
+		select {
+		case f = <-c.priority:
+		default:
+			return nil
+		}
+	}
+}
+
+// flushPriority writes whatever waits on the priority lane, if anything.
+func (c *Client) flushPriority() error {
+	select {
+	case f := <-c.priority:
+		return c.writePriority(f)
+	default:
+		return nil
+	}
+}
+
+// releasePriority discards what is left on the priority lane. Called once
+// Run has closed send, after which nothing is queued on the lane.
+func (c *Client) releasePriority() {
+	for {
+		select {
+		case f := <-c.priority:
+			c.dequeued(f)
+		default:
+			return
+		}
+	}
+}
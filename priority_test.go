@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPriorityMessageOvertakesBulk(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.RateLimit = 0 })
+	receiver := srv.connect(t, "r", "bob", "")
+	sender := srv.connect(t, "r", "alice", "protocol=json")
+
+	// bob reads nothing yet, so once the socket buffers are full the bulk
+	// messages wait in his send buffer
+	const bulk = 200
+	payload := `{"payload":"` + strings.Repeat("x", 64*1024) + `"}`
+	for i := 0; i < bulk; i++ {
+		sender.WriteMessage(websocket.TextMessage, []byte(payload))
+	}
+	waitFor(t, "the bulk messages to be relayed", func() bool { return hubStats(srv.hub).TotalMessages == bulk })
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"priority":true,"payload":"urgent"}`))
+	waitFor(t, "the priority message to be relayed", func() bool { return hubStats(srv.hub).TotalMessages == bulk+1 })
+
+	for i := 0; i <= bulk; i++ {
+		_, data := readFrame(t, receiver)
+		if strings.Contains(string(data), "urgent") {
+			if !strings.Contains(string(data), `"priority":true`) {
+				t.Errorf("priority message relayed as %s", data)
+			}
+			if i == bulk {
+				t.Fatal("priority message arrived after all the bulk messages")
+			}
+			return
+		}
+	}
+	t.Fatal("priority message never arrived")
+}
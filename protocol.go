@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Message protocols selected with the ?protocol= query parameter
+const (
+	// ProtocolRaw relays frames as opaque bytes; this is the default.
+	ProtocolRaw = "raw"
+	// ProtocolJSON requires each frame to be a JSON object and relays it
+	// as an envelope stamped by the server.
+	ProtocolJSON = "json"
+	// ProtocolBinary frames data and control messages in binary; see
+	// binary.go for the wire format.
+	ProtocolBinary = "binary"
+)
+
+// WebSocket subprotocols offered by default. A client negotiating
+// SubprotocolJSON or SubprotocolBinary gets that protocol without a
+// ?protocol= parameter.
+const (
+	SubprotocolRaw    = "relay.raw"
+	SubprotocolJSON   = "relay.json"
+	SubprotocolBinary = "relay.binary"
+)
+
+// envelope is a message relayed in the JSON protocol. From and TS are
+// always set by the server, so clients cannot impersonate each other.
+// With SenderSequence, SenderSeq numbers the sender's messages from 1 on
+// each connection, and SenderReset marks the first of them.
+type envelope struct {
+	Type        string          `json:"type"`
+	Topic       string          `json:"topic,omitempty"`
+	From        string          `json:"from"`
+	TS          time.Time       `json:"ts"`
+	SenderSeq   uint64          `json:"sender_seq,omitempty"`
+	SenderReset bool            `json:"sender_reset,omitempty"`
+	Priority    bool            `json:"priority,omitempty"`
+	Selector    string          `json:"selector,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// invalidJSONFrame is sent to a JSON protocol client whose frame could not
+// be parsed; the frame is not relayed
+var invalidJSONFrame = newErrorFrame(http.StatusBadRequest, "invalid_json", "frames must be JSON objects")
+
+// inbound is a frame sent by a JSON protocol client. Only these fields
+// are taken from it; ID is for acknowledgments and not relayed.
+type inbound struct {
+	Type    string          `json:"type"`
+	Topic   string          `json:"topic"`
+	ID      json.RawMessage `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+
+	// Priority sends the message on recipients' priority lanes
+	Priority bool `json:"priority"`
+	// Selector limits delivery to clients with matching metadata
+	Selector string `json:"selector"`
+}
+
+// stampEnvelope parses a frame sent by a JSON protocol client and returns
+// it re-encoded with the server's from and ts, along with the parsed
+// frame. The frame must be a JSON object, and type defaults to "message".
+// With SenderSequence the envelope carries the client's next sender
+// sequence number, which the caller commits with c.senderSeq++ once the
+// message is relayed.
+func (c *Client) stampEnvelope(data []byte) ([]byte, inbound, bool) {
+	var in inbound
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return nil, in, false
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return nil, in, false
+	}
+	if isJSONNull(in.ID) {
+		in.ID = nil
+	}
+	if in.Type == "" {
+		in.Type = "message"
+	}
+	if in.Payload == nil {
+		in.Payload = json.RawMessage("null")
+	}
+	env := envelope{
+		Type:    in.Type,
+		Topic:   in.Topic,
+		From:    c.username,
+		TS:      time.Now().UTC(),
+		Payload: in.Payload,
+
+		Priority: in.Priority,
+		Selector: in.Selector,
+	}
+	if c.hub.config.SenderSequence {
+		env.SenderSeq = c.senderSeq + 1
+		env.SenderReset = c.senderSeq == 0
+	}
+	out, err := json.Marshal(env)
+	if err != nil {
+		return nil, in, false
+	}
+	return out, in, true
+}
+
+// supportsSubprotocol reports whether any offered subprotocol is supported.
+func supportsSubprotocol(supported, offered []string) bool {
+	for _, o := range offered {
+		for _, s := range supported {
+			if o == s {
+				return true
+			}
+		}
+	}
+	return false
+}
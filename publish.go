@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// maxPublishLimiters bounds how many idle per-user limiters are kept for
+// HTTP publishers before refilled ones are pruned.
+const maxPublishLimiters = 1024
+
+// publishLimiters applies the per-client rate limit to HTTP publishers,
+// which have no Client to hold a limiter across requests. Buckets are kept
+// per room and username and dropped once they have refilled, as a full
+// bucket is no different from a new one.
+type publishLimiters struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*tokenBucket
+}
+
+func newPublishLimiters(rate float64, burst int) *publishLimiters {
+	return &publishLimiters{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// take spends a token from the bucket of username in room.
+func (p *publishLimiters) take(room, username string) (bool, time.Duration) {
+	key := room + "/" + username
+	p.mu.Lock()
+	bucket, ok := p.buckets[key]
+	if !ok {
+		if len(p.buckets) >= maxPublishLimiters {
+			for k, b := range p.buckets {
+				if b.full() {
+					delete(p.buckets, k)
+				}
+			}
+		}
+		bucket = newTokenBucket(p.rate, p.burst)
+		p.buckets[key] = bucket
+	}
+	p.mu.Unlock()
+	return bucket.take()
+}
+
+// requirePublishCredential wraps HandlePublish, whose caller names the
+// user it speaks for, so it only runs for a request carrying the operator
+// token, which may publish as anyone, or a token signed with secret for
+// the username in the URL. Without either configured, anyone could
+// impersonate any user, so publishing is refused altogether.
+func requirePublishCredential(secret, adminToken string, next http.HandlerFunc) http.HandlerFunc {
+	signed := requireSignedToken(secret, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case adminToken != "" && tokenMatches(requestToken(r), adminToken):
+			next(w, r)
+		case secret != "":
+			signed(w, r)
+		case adminToken != "":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="relay"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		default:
+			http.Error(w, "HTTP publishing disabled: set TOKEN_SECRET, ADMIN_TOKEN or AUTH_TOKEN", http.StatusForbidden)
+		}
+	}
+}
+
+// HandlePublish relays the request body to the room as if the user in the
+// URL had sent it over a WebSocket, for producers such as cron jobs that
+// cannot keep a connection open. The body is relayed as a text frame when
+// its Content-Type is text or JSON and as a binary frame otherwise. Size,
+// rate and quota limits, the content policy and the circuit breaker apply
+// as they do to WebSocket publishes; accepted messages get 202.
+func HandlePublish(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkRequestURI(w, r) {
+			return
+		}
+		vars := mux.Vars(r)
+		username := vars["username"]
+		room := vars["room"]
+		if room == "" {
+			room = defaultRoom
+		}
+		if err := validateUsername(username); err != nil {
+			http.Error(w, "Invalid username: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !checkBan(w, hub, username, hub.clientIP(r)) {
+			return
+		}
+
+		limit := hub.config.MaxMessageBytes
+		data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			http.Error(w, "Reading body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if int64(len(data)) > limit {
+			http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if hub.publishLimiters != nil {
+			if ok, wait := hub.publishLimiters.take(room, username); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Rate limited", http.StatusTooManyRequests)
+				return
+			}
+		}
+		if hub.globalLimiter != nil && !hub.globalLimiter.allow() {
+			http.Error(w, "Rate limited", http.StatusTooManyRequests)
+			return
+		}
+		if hub.rejectingPublishes() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Server overloaded", http.StatusServiceUnavailable)
+			return
+		}
+
+		sel, err := parseSelector(r.URL.Query().Get("selector"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		messageType := websocket.BinaryMessage
+		if isTextContent(r.Header.Get("Content-Type")) {
+			messageType = websocket.TextMessage
+		}
+		if hub.blockedContent(messageType, data, username, room) {
+			http.Error(w, "Message blocked by content policy", http.StatusForbidden)
+			return
+		}
+		if hub.quotas != nil && !hub.quotas.charge(username, len(data)) {
+			http.Error(w, "Quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		hub.mu.RLock()
+		closing := hub.closing
+		hub.mu.RUnlock()
+		if closing {
+			http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		select {
+		case hub.broadcast <- Message{
+			Room: room,
+			From: username,
+			Type: messageType,
+			Data: data,
+
+			Priority: r.URL.Query().Get("priority") == "1",
+			Selector: sel,
+			Received: time.Now(),
+		}:
+		case <-hub.done:
+			http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		slog.Debug("Message published over HTTP", "event", "http_publish", "username", username, "room", room, "bytes", len(data))
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// isTextContent reports whether a Content-Type names text or JSON.
+func isTextContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasPrefix(mediaType, "text/")
+}
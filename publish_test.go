@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publish posts body as text to path on srv with token, if any, and
+// returns the response status.
+func publish(tb testing.TB, srv *testServer, path, token, body string) int {
+	tb.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPublishRequiresCredential(t *testing.T) {
+	hour := time.Now().Add(time.Hour)
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		token     string
+		want      int
+	}{
+		{"nothing configured", nil, "", http.StatusForbidden},
+		{"nothing configured, any token", nil, "guess", http.StatusForbidden},
+		{"admin token", func(cfg *Config) { cfg.AdminToken = "root" }, "root", http.StatusAccepted},
+		{"admin token missing", func(cfg *Config) { cfg.AdminToken = "root" }, "", http.StatusUnauthorized},
+		{"admin token wrong", func(cfg *Config) { cfg.AdminToken = "root" }, "guess", http.StatusUnauthorized},
+		{"auth token as operator token", func(cfg *Config) { cfg.AuthToken = "shared" }, "shared", http.StatusAccepted},
+		{"auth token beside admin token", func(cfg *Config) { cfg.AuthToken, cfg.AdminToken = "shared", "root" }, "shared", http.StatusUnauthorized},
+		{"signed token", func(cfg *Config) { cfg.TokenSecret = "s3cret" }, mintToken("s3cret", "cron", hour), http.StatusAccepted},
+		{"signed token for another user", func(cfg *Config) { cfg.TokenSecret = "s3cret" }, mintToken("s3cret", "alice", hour), http.StatusForbidden},
+		{"signed token missing", func(cfg *Config) { cfg.TokenSecret = "s3cret" }, "", http.StatusUnauthorized},
+		{"admin token beside secret", func(cfg *Config) { cfg.TokenSecret, cfg.AdminToken = "s3cret", "root" }, "root", http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.configure)
+			if got := publish(t, srv, "/publish/r/cron", tt.token, "backup finished"); got != tt.want {
+				t.Fatalf("got HTTP %d, want %d", got, tt.want)
+			}
+			if tt.want == http.StatusAccepted {
+				waitFor(t, "the message to be relayed", func() bool { return hubStats(srv.hub).TotalMessages == 1 })
+			} else if got := hubStats(srv.hub).TotalMessages; got != 0 {
+				t.Errorf("%d messages relayed after a refused publish", got)
+			}
+		})
+	}
+}
+
+func TestPublishRelaysToRoom(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.AdminToken = "root" })
+	receiver := srv.connect(t, "ops", "bob", "")
+	if got := publish(t, srv, "/publish/ops/cron", "root", "backup finished"); got != http.StatusAccepted {
+		t.Fatalf("got HTTP %d, want 202", got)
+	}
+	if _, data := readFrame(t, receiver); string(data) != "backup finished" {
+		t.Fatalf("receiver got %q", data)
+	}
+	if got := publish(t, srv, "/publish/ops/admin", "root", "x"); got != http.StatusBadRequest {
+		t.Errorf("reserved username got HTTP %d, want 400", got)
+	}
+}
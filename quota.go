@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Quota caps how much a user may publish per quota window. A zero field
+// leaves that dimension unlimited.
+type Quota struct {
+	Messages int64 `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+}
+
+func (q Quota) enabled() bool {
+	return q.Messages > 0 || q.Bytes > 0
+}
+
+// quotaUsage is what a user has published in the current window.
+type quotaUsage struct {
+	start    time.Time
+	messages int64
+	bytes    int64
+}
+
+// quotaTracker counts each username's messages and bytes. A user's window
+// starts with their first message or query and resets once it has
+// elapsed, so usage survives reconnects but not the window. Read pumps
+// charge it concurrently, hence the mutex.
+type quotaTracker struct {
+	mu        sync.Mutex
+	window    time.Duration
+	defaults  Quota
+	overrides map[string]Quota
+	usage     map[string]*quotaUsage
+	lastPrune time.Time
+}
+
+func newQuotaTracker(window time.Duration, defaults Quota, overrides map[string]Quota) *quotaTracker {
+	return &quotaTracker{
+		window:    window,
+		defaults:  defaults,
+		overrides: overrides,
+		usage:     make(map[string]*quotaUsage),
+		lastPrune: time.Now(),
+	}
+}
+
+// limits returns the quota that applies to username.
+func (q *quotaTracker) limits(username string) Quota {
+	if quota, ok := q.overrides[username]; ok {
+		return quota
+	}
+	return q.defaults
+}
+
+// current returns username's usage in the current window, starting a new
+// window if the last one has elapsed. The caller must hold q.mu.
+func (q *quotaTracker) current(username string, now time.Time) *quotaUsage {
+	if now.Sub(q.lastPrune) >= q.window {
+		for name, u := range q.usage {
+			if now.Sub(u.start) >= q.window {
+				delete(q.usage, name)
+			}
+		}
+		q.lastPrune = now
+	}
+	u, ok := q.usage[username]
+	if !ok || now.Sub(u.start) >= q.window {
+		u = &quotaUsage{start: now}
+		q.usage[username] = u
+	}
+	return u
+}
+
+// charge counts a message of size bytes against username's quota. It
+// reports false, without counting it, if the message would exceed it.
+func (q *quotaTracker) charge(username string, size int) bool {
+	limits := q.limits(username)
+	if !limits.enabled() {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.current(username, time.Now())
+	if limits.Messages > 0 && u.messages+1 > limits.Messages {
+		return false
+	}
+	if limits.Bytes > 0 && u.bytes+int64(size) > limits.Bytes {
+		return false
+	}
+	u.messages++
+	u.bytes += int64(size)
+	return true
+}
+
+// quotaStatus answers a client's quota query. Remaining counts are omitted
+// for unlimited dimensions.
+type quotaStatus struct {
+	Type              string    `json:"type"`
+	MessagesRemaining *int64    `json:"messages_remaining,omitempty"`
+	BytesRemaining    *int64    `json:"bytes_remaining,omitempty"`
+	ResetsAt          time.Time `json:"resets_at"`
+}
+
+// status reports what username may still publish in the current window.
+func (q *quotaTracker) status(username string) quotaStatus {
+	limits := q.limits(username)
+	q.mu.Lock()
+	u := q.current(username, time.Now())
+	status := quotaStatus{Type: "quota", ResetsAt: u.start.Add(q.window).UTC()}
+	if limits.Messages > 0 {
+		remaining := limits.Messages - u.messages
+		status.MessagesRemaining = &remaining
+	}
+	if limits.Bytes > 0 {
+		remaining := limits.Bytes - u.bytes
+		status.BytesRemaining = &remaining
+	}
+	q.mu.Unlock()
+	return status
+}
+
+// quotaExceededFrame is sent to a client whose message was rejected because
+// it has used up its quota
+var quotaExceededFrame = newErrorFrame(http.StatusTooManyRequests, "quota_exceeded", `quota used up until it resets; send {"type":"quota"} for details`)
+
+// isQuotaQuery reports whether data is a quota query, {"type":"quota"}.
+func isQuotaQuery(data []byte) bool {
+	if !bytes.Contains(data, []byte(`"quota"`)) {
+		return false
+	}
+	var query struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(data, &query) == nil && query.Type == "quota"
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestQuotaQuery(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.Quota = Quota{Messages: 3} })
+	receiver := srv.connect(t, "r", "bob", "")
+	alice := srv.connect(t, "r", "alice", "protocol=json")
+	carol := srv.connect(t, "r", "carol", "")
+
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"payload":1}`))
+	readFrame(t, receiver)
+	readFrame(t, carol)
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"quota"}`))
+	_, data := readFrame(t, alice)
+	var status quotaStatus
+	if err := json.Unmarshal(data, &status); err != nil || status.Type != "quota" {
+		t.Fatalf("quota query answered with %s", data)
+	}
+	if status.MessagesRemaining == nil || *status.MessagesRemaining != 2 || status.BytesRemaining != nil || status.ResetsAt.IsZero() {
+		t.Errorf("quota status %s, want 2 messages remaining and a reset time", data)
+	}
+
+	// To a raw client the query is just another payload
+	query := `{"type":"quota"}`
+	carol.WriteMessage(websocket.TextMessage, []byte(query))
+	if _, data := readFrame(t, receiver); string(data) != query {
+		t.Fatalf("receiver got %s, want the raw query relayed", data)
+	}
+	expectSilence(t, carol, 100*time.Millisecond)
+}
+
+func TestQuotaChargesContentNotEnvelope(t *testing.T) {
+	payload := []byte(`{"payload":1}`)
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.Quota = Quota{Bytes: int64(2 * len(payload))} })
+	receiver := srv.connect(t, "r", "bob", "")
+	alice := srv.connect(t, "r", "alice", "protocol=json")
+
+	// The stamped from and ts would take each message over half the quota
+	for i := 0; i < 2; i++ {
+		alice.WriteMessage(websocket.TextMessage, payload)
+		readFrame(t, receiver)
+	}
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"quota"}`))
+	_, data := readFrame(t, alice)
+	var status quotaStatus
+	if err := json.Unmarshal(data, &status); err != nil || status.BytesRemaining == nil || *status.BytesRemaining != 0 {
+		t.Errorf("quota status %s, want 0 bytes remaining", data)
+	}
+}
+
+func TestValidateRefusesNegativeQuotaOverrides(t *testing.T) {
+	tests := map[string]Quota{
+		"messages": {Messages: -1},
+		"bytes":    {Bytes: -1},
+	}
+	for name, q := range tests {
+		config := DefaultHubConfig()
+		config.QuotaOverrides = map[string]Quota{"alice": {Messages: 10}, "bob": q}
+		err := config.Validate()
+		if err == nil || !strings.Contains(err.Error(), `"bob"`) {
+			t.Errorf("negative %s override: Validate() = %v, want an error naming bob", name, err)
+		}
+	}
+	config := DefaultHubConfig()
+	config.QuotaOverrides = map[string]Quota{"alice": {}}
+	if err := config.Validate(); err != nil {
+		t.Errorf("zero override: Validate() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 3)
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatalf("event %d within the burst was refused", i)
+		}
+	}
+	ok, wait := b.take()
+	if ok {
+		t.Fatal("event over the burst was allowed")
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("wait = %s, want up to 100ms at 10 per second", wait)
+	}
+	time.Sleep(wait + 10*time.Millisecond)
+	if !b.allow() {
+		t.Fatal("event refused after the bucket refilled")
+	}
+}
+
+func TestConnectionRateLimitRejectsWith429(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.Hub.ConnectionRateLimit = 1
+		cfg.Hub.ConnectionRateBurst = 2
+	})
+
+	accepted, limited := 0, 0
+	for i := 0; i < 10; i++ {
+		status, header := srv.dialStatus(t, fmt.Sprintf("/ws/r/user%d", i), nil)
+		switch status {
+		case http.StatusSwitchingProtocols:
+			accepted++
+		case http.StatusTooManyRequests:
+			limited++
+			if seconds, err := strconv.Atoi(header.Get("Retry-After")); err != nil || seconds < 1 {
+				t.Errorf("Retry-After = %q, want a positive number of seconds", header.Get("Retry-After"))
+			}
+		default:
+			t.Fatalf("connection %d got HTTP %d", i, status)
+		}
+	}
+	// The burst admits two at once; at one per second, rapid connects
+	// may earn at most one more
+	if accepted < 2 || accepted > 3 || limited != 10-accepted {
+		t.Fatalf("accepted %d and limited %d of 10 rapid connects", accepted, limited)
+	}
+}
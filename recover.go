@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+)
+
+// A panic while the hub handles one event, e.g. in a transformer, a sink
+// or a bug in delivering to one client, would otherwise end the process
+// and every connection with it. Run, the fan-out workers and the archive
+// goroutine instead recover, log the panic with its stack, count it in
+// ServerStats.PanicsRecovered and carry on with the next event; whatever
+// the panicking event was doing is abandoned half done. A panic while
+// h.mu is held cannot be survived this way, as the lock is never released.
+
+// recoverPanic, deferred, recovers from a panic on whichever of the hub's
+// goroutines it runs on, logging where it happened.
+func (h *Hub) recoverPanic(where string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	h.panicsRecovered.Add(1)
+	slog.Error("Recovered from panic", "event", "panic_recovered", "where", where,
+		"panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+}
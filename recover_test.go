@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHubSurvivesPanickingTransformer(t *testing.T) {
+	config := DefaultHubConfig()
+	config.Transformers = []Transformer{TransformerFunc(func(m Message) (Message, error) {
+		if string(m.Data) == "boom" {
+			panic("transformer bug")
+		}
+		return m, nil
+	})}
+	config.HistorySize = 0
+	hub := startHub(t, config)
+	bob := joinHub(t, newTestClient(hub, "r", "bob", 4))
+
+	relay(hub, "r", "alice", []byte("before"))
+	relay(hub, "r", "alice", []byte("boom"))
+	relay(hub, "r", "alice", []byte("after"))
+	waitFor(t, "the message after the panic", func() bool { return len(bob.send) == 2 })
+	frames, _ := queued(bob)
+	if string(frames[0].data) != "before" || string(frames[1].data) != "after" {
+		t.Errorf("bob received %q and %q, want the messages either side of the panic", frames[0].data, frames[1].data)
+	}
+	if n := hub.panicsRecovered.Load(); n != 1 {
+		t.Errorf("recovered %d panics, want 1", n)
+	}
+
+	// Run still serves registrations and delivers to newcomers
+	carol := joinHub(t, newTestClient(hub, "r", "carol", 4))
+	relay(hub, "r", "alice", []byte("later"))
+	waitFor(t, "carol to receive a message", func() bool { return len(carol.send) == 1 })
+	// The panicking message was abandoned before it was counted
+	if stats := hubStats(hub); stats.TotalMessages != 3 {
+		t.Errorf("TotalMessages = %d, want 3", stats.TotalMessages)
+	}
+}
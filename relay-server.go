@@ -1,13 +1,28 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -24,222 +39,1960 @@ var (
 	ServerVersion = "1.0.0"
 )
 
+// defaultRoom is used for clients connecting via the legacy /ws/{username} URL
+const defaultRoom = "default"
+
+// Connection modes selected with the ?mode= query parameter
+const (
+	// ModePublisher clients send and receive; this is the default.
+	ModePublisher = "publisher"
+	// ModeSubscriber clients only receive; frames they send are discarded.
+	ModeSubscriber = "subscriber"
+)
+
 type Client struct {
-	conn     *websocket.Conn
-	send     chan []byte
+	conn *websocket.Conn
+	send chan frame
+	// priority is the lane for frames that overtake send, nil when
+	// PriorityBuffer is off. Unlike send it is never closed; see
+	// priority.go.
+	priority chan frame
 	username string
+	room     string
+	mode     string
+	protocol string
 	hub      *Hub
+
+	// encoding writes server notices in the form the client asked for;
+	// see encoding.go
+	encoding controlEncoding
+
+	// subprotocol is the WebSocket subprotocol negotiated on upgrade, empty
+	// if the client offered none of the supported ones
+	subprotocol string
+
+	// replay is how many buffered messages to send on connect, -1 for all
+	replay int
+	// resume replaces replay when the client connected with ?since=: it
+	// is sent the messages after sequence number since instead
+	resume bool
+	since  uint64
+	// presence subscribes the client to join/leave notifications
+	presence bool
+	// streams filters relayed frames by their 2-byte stream ID; nil
+	// receives every frame
+	streams map[uint16]struct{}
+	// topics is the client's topic subscription; nil receives every
+	// message. See topic.go.
+	topics atomic.Pointer[topicFilter]
+	// metadata is what the client told about itself with meta.* query
+	// parameters, matched against message selectors; see metadata.go
+	metadata map[string]string
+	// echo delivers the client's own messages back to it
+	echo bool
+	// senderSeq is the sender sequence number of the client's last relayed
+	// JSON protocol message, with SenderSequence; ReadPump only
+	senderSeq uint64
+	// compressed is set when the client negotiated permessage-deflate
+	compressed bool
+	// chunked delivers messages over ChunkSize in pieces, interleaved
+	// with smaller ones; chunkID numbers them. See chunk.go.
+	chunked bool
+	chunkID uint64
+	// warmup is the paced replay backlog WritePump is writing, nil when
+	// there is none; WritePump only. See warmup.go.
+	warmup *warmup
+	// force evicts an existing connection with the same username instead
+	// of being rejected, so crashed clients can reconnect immediately
+	force bool
+
+	// limiter throttles inbound messages; nil when rate limiting is off.
+	// violations counts messages rejected by it or the hub's global limiter,
+	// and strikes the runs of consecutive rejections; throttled is set
+	// while such a run lasts. See ban.go.
+	limiter    *tokenBucket
+	violations int
+	strikes    int
+	throttled  bool
+
+	// readBandwidth and writeBandwidth pace the bytes read from and
+	// written to the connection; nil when MaxConnBytesPerSec is off. See
+	// bandwidth.go.
+	readBandwidth  *tokenBucket
+	writeBandwidth *tokenBucket
+
+	// farewell is a final frame queued just before send is closed, and
+	// closeCode and closeReason fill the close frame WritePump writes after
+	// it, telling the client why it is being disconnected
+	closeMu     sync.Mutex
+	farewell    []byte
+	closeCode   int
+	closeReason string
+
+	// Per-client counters from the server's point of view, updated by the
+	// pumps and read atomically by the health handler.
+	messagesSent     atomic.Uint64
+	bytesSent        atomic.Uint64
+	messagesReceived atomic.Uint64
+	bytesReceived    atomic.Uint64
+	// droppedMessages counts frames discarded for the client by the
+	// drop-message or drop-oldest backpressure policy
+	droppedMessages atomic.Uint64
+
+	// remoteAddr and connectedAt describe the connection for operators
+	remoteAddr  string
+	connectedAt time.Time
+
+	// ip is the client's address, taken from ProxyHeaders if configured
+	// and sent by a trusted proxy; bans and MaxConnsPerIP apply to it
+	ip string
+
+	// lastReadTime is when the client last sent a message, in Unix
+	// nanoseconds; WritePump compares it against IdleTimeout.
+	lastReadTime atomic.Int64
+
+	// queuedBytes is the payload bytes waiting on send; see circuit.go
+	queuedBytes atomic.Int64
+	// pinned counts the queued frames that are not evictable
+	pinned atomic.Int64
+
+	// drainDeadline, in Unix nanoseconds, bounds how long WritePump keeps
+	// flushing after the client was evicted; zero when it was not.
+	drainDeadline atomic.Int64
+}
+
+// Backpressure policies applied when a client's send buffer is full
+const (
+	// BackpressureDropClient disconnects the client.
+	BackpressureDropClient = "drop-client"
+	// BackpressureDropMessage skips the frame for that client only.
+	BackpressureDropMessage = "drop-message"
+	// BackpressureDropOldest discards the oldest frame queued for the
+	// client to make room, so the latest messages win. Server notices and
+	// replay backlogs are never discarded: while one is queued, the
+	// incoming message is dropped instead.
+	BackpressureDropOldest = "drop-oldest"
+	// BackpressureBlock waits up to BackpressureTimeout for room in the
+	// buffer, then disconnects the client. The hub stalls while it waits.
+	BackpressureBlock = "block-with-timeout"
+)
+
+// HubConfig holds the tunables that govern how the hub accepts and serves clients.
+type HubConfig struct {
+	// MaxClients caps concurrent connections across all rooms; 0 means unlimited.
+	MaxClients int
+
+	// Shards is how many independently locked client maps the hub keeps;
+	// clients are assigned by a hash of their username.
+	Shards int
+
+	// PingInterval is how often WritePump pings the client. It must be
+	// shorter than PongWait so a healthy client answers before the read
+	// deadline expires.
+	PingInterval time.Duration
+	// PongWait is how long ReadPump waits for any frame, including pongs.
+	PongWait time.Duration
+	// HeartbeatInterval is how often WritePump also sends an
+	// application-level {"type":"ping"} data frame, whose {"type":"pong"}
+	// answer extends the read deadline like a pong, for clients behind
+	// intermediaries that strip control frames; 0 disables it. It must be
+	// shorter than PongWait.
+	HeartbeatInterval time.Duration
+	// WriteWait bounds each write to the client.
+	WriteWait time.Duration
+	// IdleTimeout disconnects clients that send no message for this long,
+	// even if they keep answering pings; 0 disables it.
+	IdleTimeout time.Duration
+	// MaxConnLifetime closes connections with 1001 (going away) once they
+	// have been open this long, so clients reconnect and spread across
+	// instances behind a load balancer; 0 disables it.
+	MaxConnLifetime time.Duration
+	// LogSummaryInterval is how often Run logs the connected count and
+	// connects, disconnects and messages since the last summary; 0
+	// disables it. Individual connects and disconnects are debug events.
+	LogSummaryInterval time.Duration
+	// SaturationThreshold is the fraction of the broadcast channel's
+	// capacity at which it counts as saturated, and SaturationPeriod how
+	// long it must stay saturated before /ready reports 503; a zero period
+	// leaves readiness unaffected.
+	SaturationThreshold float64
+	SaturationPeriod    time.Duration
+	// FanOutWorkers is how many goroutines share the fan-out of each
+	// broadcast to a room of at least fanOutMinRecipients clients; 0 or 1
+	// fans out on Run's goroutine alone. Each client still receives
+	// messages in order.
+	FanOutWorkers int
+	// HealthDropRate is how many slow-consumer drops within a minute make
+	// /health report degraded, and HealthMaxGoroutines how many running
+	// goroutines do; 0 disables either check.
+	HealthDropRate      int
+	HealthMaxGoroutines int
+	// EvictionGrace is how long a connection replaced by a force=1
+	// reconnect may spend flushing its queued frames before the close
+	// frame; 0 closes it without flushing.
+	EvictionGrace time.Duration
+
+	// SendBuffer is how many outbound frames each client may have queued.
+	// Larger buffers ride out bursts to slow clients before the
+	// backpressure policy applies, at the cost of memory per client.
+	SendBuffer int
+	// WarmupRate, if positive, paces the history replayed to a new client
+	// at this many messages per second instead of queuing it on the send
+	// buffer, which cuts replays short once it is full. A full history
+	// must replay in less than PongWait.
+	WarmupRate int
+	// PriorityBuffer is how many priority frames each client may have
+	// queued on its priority lane; 0 disables the lane, delivering
+	// priority messages like any other.
+	PriorityBuffer int
+
+	// MessageTTL, if positive, makes WritePump discard relayed messages
+	// that have waited in a client's send buffer for longer, since late
+	// delivery is worse than none for real-time streams. Control frames
+	// and replayed history are never discarded.
+	MessageTTL time.Duration
+
+	// ChunkSize is the largest piece of a relayed message written at once
+	// to clients that connected with ?chunked=1, letting smaller messages
+	// through between pieces; 0 disables chunking.
+	ChunkSize int
+
+	// BatchMaxMessages above 1 makes WritePump coalesce up to that many
+	// queued relayed frames of the same type into one WebSocket message, of
+	// at most BatchMaxBytes (0 for no limit) unless a single frame is
+	// larger, waiting at most BatchFlushInterval for more frames (0 to
+	// take only those already queued). Batched frames are concatenated, so
+	// message boundaries are lost; server notices are never batched.
+	BatchMaxMessages   int
+	BatchMaxBytes      int
+	BatchFlushInterval time.Duration
+
+	// HistorySize is how many recent messages each room keeps for replay
+	// to newly connected clients; 0 disables history.
+	HistorySize int
+
+	// RateLimit and RateBurst bound the messages per second each client may
+	// publish; GlobalRateLimit and GlobalRateBurst bound all clients
+	// together. A rate of 0 disables the limit. Clients exceeding a limit
+	// get a rate_limited error frame and are disconnected after
+	// RateLimitMaxViolations rejected messages, if that is positive.
+	RateLimit              float64
+	RateBurst              int
+	GlobalRateLimit        float64
+	GlobalRateBurst        int
+	RateLimitMaxViolations int
+
+	// BanStrikes, if positive, disconnects a client after that many runs
+	// of rate-limited messages and refuses its username and IP address
+	// for BanCooldown.
+	BanStrikes  int
+	BanCooldown time.Duration
+
+	// ConnectionRateLimit and ConnectionRateBurst bound how many WebSocket
+	// upgrades are accepted per second across all clients; 0 disables it.
+	ConnectionRateLimit float64
+	ConnectionRateBurst int
+
+	// MaxConnBytesPerSec caps the bytes per second each connection may
+	// send and, separately, receive; 0 disables it. Unlike RateLimit it
+	// paces traffic instead of rejecting messages.
+	MaxConnBytesPerSec int
+
+	// MaxConnsPerIP caps the WebSocket and SSE connections open from one
+	// IP address; 0 disables it. ProxyHeaders names the headers, such as
+	// X-Forwarded-For, that carry the client's address when behind a
+	// proxy; without them the connection's own address is used.
+	// TrustedProxies, if set, limits believing those headers to
+	// connections from these networks; see clientIP.
+	MaxConnsPerIP  int
+	ProxyHeaders   []string
+	TrustedProxies []*net.IPNet
+
+	// MaxMessageBytes is the largest message a client may send. Larger
+	// messages get an error frame and the connection is closed.
+	MaxMessageBytes int64
+
+	// Subprotocols lists the WebSocket subprotocols the server accepts, in
+	// order of preference. With StrictSubprotocols, a client that offers
+	// subprotocols but none of these is rejected instead of being upgraded
+	// without one.
+	Subprotocols       []string
+	StrictSubprotocols bool
+
+	// Compression negotiates permessage-deflate with clients that offer it.
+	// It trades CPU for bandwidth: every outbound frame is deflated once per
+	// recipient, which pays off for large text payloads but mostly wastes
+	// cycles on already-compressed binary data such as audio or images.
+	// CompressionLevel ranges from -2 (Huffman only) to 9 (best compression).
+	Compression      bool
+	CompressionLevel int
+
+	// Sink archives every relayed message; NopSink, the default, keeps
+	// nothing.
+	Sink MessageSink
+
+	// Transformers rewrite each message before fan-out, in order; a
+	// transformer error drops the message. Messages from peers were
+	// transformed where they were published and are not transformed
+	// again. Empty by default.
+	Transformers []Transformer
+
+	// ContentPolicy blocks text messages matching its patterns before they
+	// are broadcast; nil when off. ContentPolicyAction says whether the
+	// sender is only told, ContentPolicyDrop, or also disconnected,
+	// ContentPolicyDisconnect.
+	ContentPolicy       *ContentPolicy
+	ContentPolicyAction string
+
+	// Schema, if set, is the JSON Schema each frame from a JSON protocol
+	// client must conform to; frames that do not are rejected with a
+	// schema_violation error.
+	Schema *JSONSchema
+
+	// Quota caps what each user may publish per QuotaWindow, with
+	// QuotaOverrides replacing it for particular usernames. Messages over
+	// quota are rejected with an error frame, and with QuotaDisconnect the
+	// client is also disconnected.
+	Quota           Quota
+	QuotaOverrides  map[string]Quota
+	QuotaWindow     time.Duration
+	QuotaDisconnect bool
+
+	// LatencyTracking measures the relay latency of each message, from
+	// being read to being queued for every recipient, and reports
+	// percentiles in /stats and /metrics.
+	LatencyTracking bool
+
+	// AllowAnonymous gives WebSocket clients that connect without a
+	// username a generated one, announced in a welcome frame, instead of
+	// rejecting them with 400.
+	AllowAnonymous bool
+
+	// SenderSequence stamps each JSON protocol envelope with a per-sender
+	// sequence number, so receivers can check a sender's stream for gaps
+	// and reordering. It restarts at 1, marked by sender_reset, whenever
+	// the sender connects.
+	SenderSequence bool
+
+	// Peers lists the /peer URLs of other instances to forward local
+	// messages to; see federation.go. NodeID marks the messages this
+	// instance originates, and PeerToken authenticates it to its peers.
+	Peers     []string
+	NodeID    string
+	PeerToken string
+
+	// MaxBufferedBytes, if positive, opens a circuit breaker once the
+	// payload bytes queued for all clients exceed it, applying
+	// CircuitBreakerPolicy until they fall back below 80% of it.
+	MaxBufferedBytes     int64
+	CircuitBreakerPolicy string
+
+	// DedupWindow suppresses a message identical to one the same user sent
+	// to the same room within this window, such as a retransmission after
+	// a reconnect; 0 disables deduplication.
+	DedupWindow time.Duration
+
+	// BackpressurePolicy decides what happens to a client whose send buffer
+	// is full; BackpressureTimeout applies to BackpressureBlock.
+	BackpressurePolicy  string
+	BackpressureTimeout time.Duration
+}
+
+// DefaultHubConfig returns the hub settings used when nothing is configured.
+func DefaultHubConfig() HubConfig {
+	return HubConfig{
+		Shards:              runtime.GOMAXPROCS(0),
+		PingInterval:        54 * time.Second,
+		PongWait:            60 * time.Second,
+		WriteWait:           10 * time.Second,
+		HistorySize:         100,
+		SendBuffer:          256,
+		PriorityBuffer:      64,
+		ChunkSize:           64 * 1024,
+		Sink:                NopSink{},
+		QuotaWindow:         24 * time.Hour,
+		ContentPolicyAction: ContentPolicyDrop,
+
+		EvictionGrace: 2 * time.Second,
+		BanCooldown:   5 * time.Minute,
+
+		LogSummaryInterval: 30 * time.Second,
+
+		SaturationThreshold: 0.9,
+		SaturationPeriod:    10 * time.Second,
+		HealthDropRate:      10,
+
+		Subprotocols: []string{SubprotocolJSON, SubprotocolBinary, SubprotocolMsgpack, SubprotocolRaw},
+
+		MaxMessageBytes: 10 * 1024 * 1024, // 10MB
+
+		RateLimit: 1000,
+		RateBurst: 2000,
+
+		CompressionLevel: 1,
+
+		BackpressurePolicy:  BackpressureDropClient,
+		BackpressureTimeout: 100 * time.Millisecond,
+
+		CircuitBreakerPolicy: CircuitRejectPublishes,
+
+		NodeID: newNodeID(),
+	}
+}
+
+// Validate reports every setting that would make the hub misbehave.
+func (c HubConfig) Validate() error {
+	var errs []error
+	if c.MaxClients < 0 {
+		errs = append(errs, fmt.Errorf("invalid max clients %d: must be zero or positive", c.MaxClients))
+	}
+	if c.PingInterval <= 0 {
+		errs = append(errs, fmt.Errorf("invalid ping interval %s: must be positive", c.PingInterval))
+	}
+	if c.PongWait <= 0 {
+		errs = append(errs, fmt.Errorf("invalid pong wait %s: must be positive", c.PongWait))
+	}
+	if c.WriteWait <= 0 {
+		errs = append(errs, fmt.Errorf("invalid write wait %s: must be positive", c.WriteWait))
+	}
+	if c.Quota.Messages < 0 || c.Quota.Bytes < 0 {
+		errs = append(errs, fmt.Errorf("quotas must be zero or positive"))
+	}
+	users := make([]string, 0, len(c.QuotaOverrides))
+	for user := range c.QuotaOverrides {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		if q := c.QuotaOverrides[user]; q.Messages < 0 || q.Bytes < 0 {
+			errs = append(errs, fmt.Errorf("invalid quota override for %q: quotas must be zero or positive", user))
+		}
+	}
+	if c.QuotaWindow <= 0 {
+		errs = append(errs, fmt.Errorf("invalid quota window %s: must be positive", c.QuotaWindow))
+	}
+	if c.DedupWindow < 0 {
+		errs = append(errs, fmt.Errorf("invalid dedup window %s: must be zero or positive", c.DedupWindow))
+	}
+	if c.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid idle timeout %s: must be zero or positive", c.IdleTimeout))
+	}
+	if c.MaxConnLifetime < 0 {
+		errs = append(errs, fmt.Errorf("invalid max connection lifetime %s: must be zero or positive", c.MaxConnLifetime))
+	}
+	if c.SaturationThreshold <= 0 || c.SaturationThreshold > 1 {
+		errs = append(errs, fmt.Errorf("invalid saturation threshold %g: must be greater than 0 and at most 1", c.SaturationThreshold))
+	}
+	if c.SaturationPeriod < 0 {
+		errs = append(errs, fmt.Errorf("invalid saturation period %s: must be zero or positive", c.SaturationPeriod))
+	}
+	if c.FanOutWorkers < 0 {
+		errs = append(errs, fmt.Errorf("invalid fan-out workers %d: must be zero or positive", c.FanOutWorkers))
+	}
+	if c.HealthDropRate < 0 {
+		errs = append(errs, fmt.Errorf("invalid health drop rate %d: must be zero or positive", c.HealthDropRate))
+	}
+	if c.HealthMaxGoroutines < 0 {
+		errs = append(errs, fmt.Errorf("invalid health max goroutines %d: must be zero or positive", c.HealthMaxGoroutines))
+	}
+	if c.LogSummaryInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid log summary interval %s: must be zero or positive", c.LogSummaryInterval))
+	}
+	if c.EvictionGrace < 0 {
+		errs = append(errs, fmt.Errorf("invalid eviction grace %s: must be zero or positive", c.EvictionGrace))
+	}
+	if c.MessageTTL < 0 {
+		errs = append(errs, fmt.Errorf("invalid message TTL %s: must be zero or positive", c.MessageTTL))
+	}
+	if c.Shards < 1 {
+		errs = append(errs, fmt.Errorf("invalid shard count %d: must be at least 1", c.Shards))
+	}
+	if c.MaxMessageBytes <= 0 {
+		errs = append(errs, fmt.Errorf("invalid max message bytes %d: must be positive", c.MaxMessageBytes))
+	}
+	if c.BatchMaxMessages < 0 || c.BatchMaxBytes < 0 || c.BatchFlushInterval < 0 {
+		errs = append(errs, fmt.Errorf("batch limits and flush interval must be zero or positive"))
+	}
+	if c.ChunkSize < 0 {
+		errs = append(errs, fmt.Errorf("invalid chunk size %d: must be zero or positive", c.ChunkSize))
+	}
+	if c.SendBuffer < 1 {
+		errs = append(errs, fmt.Errorf("invalid send buffer %d: must be a positive integer", c.SendBuffer))
+	}
+	if c.WarmupRate < 0 {
+		errs = append(errs, fmt.Errorf("invalid warmup rate %d: must be zero or positive", c.WarmupRate))
+	}
+	if c.WarmupRate > 0 && c.HistorySize > 0 && float64(c.HistorySize)/float64(c.WarmupRate) >= c.PongWait.Seconds() {
+		errs = append(errs, fmt.Errorf("invalid warmup rate %d: replaying %d messages must take less than the pong wait %s", c.WarmupRate, c.HistorySize, c.PongWait))
+	}
+	if c.PriorityBuffer < 0 {
+		errs = append(errs, fmt.Errorf("invalid priority buffer %d: must be zero or positive", c.PriorityBuffer))
+	}
+	if c.HistorySize < 0 {
+		errs = append(errs, fmt.Errorf("invalid history size %d: must be zero or positive", c.HistorySize))
+	}
+	if c.RateLimit < 0 || c.GlobalRateLimit < 0 {
+		errs = append(errs, fmt.Errorf("rate limits must be zero or positive"))
+	}
+	if c.ConnectionRateLimit < 0 || c.ConnectionRateBurst < 0 {
+		errs = append(errs, fmt.Errorf("connection rate limit and burst must be zero or positive"))
+	}
+	if c.RateBurst < 0 || c.GlobalRateBurst < 0 || c.RateLimitMaxViolations < 0 {
+		errs = append(errs, fmt.Errorf("rate burst and max violations must be zero or positive"))
+	}
+	if c.MaxConnBytesPerSec < 0 {
+		errs = append(errs, fmt.Errorf("invalid max connection bytes per second %d: must be zero or positive", c.MaxConnBytesPerSec))
+	}
+	if c.MaxConnsPerIP < 0 {
+		errs = append(errs, fmt.Errorf("invalid max connections per IP %d: must be zero or positive", c.MaxConnsPerIP))
+	}
+	if c.BanStrikes < 0 {
+		errs = append(errs, fmt.Errorf("invalid ban strikes %d: must be zero or positive", c.BanStrikes))
+	}
+	if c.BanStrikes > 0 && c.BanCooldown <= 0 {
+		errs = append(errs, fmt.Errorf("invalid ban cooldown %s: must be positive", c.BanCooldown))
+	}
+	if c.CompressionLevel < -2 || c.CompressionLevel > 9 {
+		errs = append(errs, fmt.Errorf("invalid compression level %d: must be between -2 and 9", c.CompressionLevel))
+	}
+	switch c.BackpressurePolicy {
+	case BackpressureDropClient, BackpressureDropMessage, BackpressureDropOldest:
+	case BackpressureBlock:
+		if c.BackpressureTimeout <= 0 {
+			errs = append(errs, fmt.Errorf("invalid backpressure timeout %s: must be positive", c.BackpressureTimeout))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid backpressure policy %q: must be %s, %s, %s or %s",
+			c.BackpressurePolicy, BackpressureDropClient, BackpressureDropMessage, BackpressureDropOldest, BackpressureBlock))
+	}
+	for _, peer := range c.Peers {
+		if u, err := url.Parse(peer); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid peer %q: must be a ws:// or wss:// URL", peer))
+		}
+	}
+	if c.NodeID == "" {
+		errs = append(errs, fmt.Errorf("node ID must not be empty"))
+	}
+	if c.MaxBufferedBytes < 0 {
+		errs = append(errs, fmt.Errorf("invalid max buffered bytes %d: must be zero or positive", c.MaxBufferedBytes))
+	}
+	switch c.CircuitBreakerPolicy {
+	case CircuitRejectPublishes, CircuitDropSlowest:
+	default:
+		errs = append(errs, fmt.Errorf("invalid circuit breaker policy %q: must be %s or %s",
+			c.CircuitBreakerPolicy, CircuitRejectPublishes, CircuitDropSlowest))
+	}
+	switch c.ContentPolicyAction {
+	case ContentPolicyDrop, ContentPolicyDisconnect:
+	default:
+		errs = append(errs, fmt.Errorf("invalid content policy action %q: must be %s or %s",
+			c.ContentPolicyAction, ContentPolicyDrop, ContentPolicyDisconnect))
+	}
+	if c.PingInterval >= c.PongWait {
+		errs = append(errs, fmt.Errorf("ping interval %s must be shorter than pong wait %s", c.PingInterval, c.PongWait))
+	}
+	if c.HeartbeatInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid heartbeat interval %s: must be zero or positive", c.HeartbeatInterval))
+	} else if c.HeartbeatInterval > 0 && c.HeartbeatInterval >= c.PongWait {
+		errs = append(errs, fmt.Errorf("heartbeat interval %s must be shorter than pong wait %s", c.HeartbeatInterval, c.PongWait))
+	}
+	return errors.Join(errs...)
 }
 
+// Hub relays messages between clients. Run is the only goroutine that adds
+// or removes clients, and the only one that closes a client's send channel.
+// Clients live in shards, each guarding its own map; mu guards the server
+// statistics and shutdown state.
 type Hub struct {
-	clients    map[string]*Client
+	config     HubConfig
+	shards     []*hubShard
 	broadcast  chan Message
+	direct     chan directMessage
 	register   chan *Client
 	unregister chan *Client
-	mu         sync.RWMutex
-	startTime  time.Time
-	stats      ServerStats
+	kicks      chan kickRequest
+	// announcements carries operator notices for every client; see
+	// announce.go
+	announcements chan announceRequest
+
+	// bytesSent is the payload bytes written to all clients. Every
+	// WritePump adds to it, so it is atomic rather than guarded by mu;
+	// readers copy it into ServerStats.TotalBytesSent.
+	bytesSent atomic.Uint64
+	// panicsRecovered counts the panics recoverPanic survived, on any of
+	// the hub's goroutines; readers copy it into
+	// ServerStats.PanicsRecovered.
+	panicsRecovered atomic.Uint64
+	// droppedMessages counts the frames the backpressure policy discarded
+	// across all clients; readers copy it into
+	// ServerStats.DroppedMessages.
+	droppedMessages atomic.Uint64
+	// bufferedBytes is the payload bytes queued on all clients' send
+	// channels, and circuitOpen is set while it is over MaxBufferedBytes;
+	// see circuit.go. sheds asks Run to drop the slowest clients.
+	bufferedBytes atomic.Int64
+	circuitOpen   atomic.Bool
+	sheds         chan struct{}
+
+	mu sync.RWMutex
+	// startTime is when the server started, or when /admin/stats/reset
+	// last zeroed stats, and the base of the rates
+	startTime time.Time
+	stats     ServerStats
+	connected int // clients across all shards
+
+	// saturatedSince is when the broadcast channel became saturated, zero
+	// while it is not; maintained by watchBroadcast
+	saturatedSince time.Time
+	// recentDrops holds the times of the latest slow-consumer drops, for
+	// HealthDropRate
+	recentDrops []time.Time
+
+	// history holds recent messages per room and rotations the fair
+	// broadcast order of each room's clients; only used by Run
+	history map[string]*history
+	// sequences holds each room's last sequence number; only used by Run.
+	// Unlike history it outlives the room emptying, so a client resuming
+	// into an empty room learns how much it lost.
+	sequences map[string]uint64
+	rotations map[string]*rotation
+
+	// dedup suppresses repeated messages; nil when off, only used by Run
+	dedup *dedupCache
+
+	// peers are the links to the instances in Peers; peerReceived and
+	// peerDiscarded count the messages accepted from peers and those
+	// dropped as malformed or looped back
+	peers         []*peerLink
+	peerReceived  atomic.Uint64
+	peerDiscarded atomic.Uint64
+
+	// fanOutJobs feeds the fan-out workers; nil when FanOutWorkers is off
+	fanOutJobs chan *fanOutJob
+
+	// archive queues messages for config.Sink; nil when archiving is off.
+	// Run closes it on shutdown and archived is closed once it has drained.
+	archive  chan Message
+	archived chan struct{}
+
+	// quotas tracks per-user publishing quotas; nil when none are set
+	quotas *quotaTracker
+
+	// latency records how long messages take from ReadPump to the last
+	// recipient's send buffer; nil when LatencyTracking is off
+	latency *latencyHistogram
+
+	// globalLimiter throttles messages across all clients and connLimiter
+	// throttles new connections; each is nil when off
+	globalLimiter *tokenBucket
+	connLimiter   *tokenBucket
+	// publishLimiters applies RateLimit to HTTP publishers; nil when off
+	publishLimiters *publishLimiters
+	// bans refuses clients in cooldown; nil when BanStrikes is off
+	bans *banList
+	// ipLimits counts connections per IP; nil when MaxConnsPerIP is off
+	ipLimits *ipLimiter
+
+	// Shutdown coordination: running is set once Run has started, quit asks
+	// Run to stop, done is closed once it has, closing rejects new
+	// connections and pumps tracks WritePumps still flushing.
+	running   bool
+	quit      chan struct{}
+	done      chan struct{}
+	closing   bool
+	closeOnce sync.Once
+	// draining, set through /admin/drain, rejects new connections while
+	// existing ones carry on
+	draining bool
+	pumps    sync.WaitGroup
 }
 
 type Message struct {
+	Room string `json:"room"`
 	From string `json:"from"`
+	Type int    `json:"type"` // websocket.TextMessage or websocket.BinaryMessage
 	Data []byte `json:"data"`
+
+	// Topic is the topic named by a JSON protocol message, if any
+	Topic string `json:"topic,omitempty"`
+	// Seq is the message's sequence number in its room, assigned by Run
+	Seq uint64 `json:"seq,omitempty"`
+	// Envelope marks a JSON protocol envelope, which gets Seq in its payload
+	Envelope bool `json:"-"`
+	// Origin is the node ID of the peer a federated message came from,
+	// empty for messages that originated here
+	Origin string `json:"-"`
+	// Priority queues the message on recipients' priority lanes
+	Priority bool `json:"priority,omitempty"`
+	// Selector limits delivery to clients whose metadata matches it
+	Selector selector `json:"-"`
+
+	// Received is when ReadPump read the message, for latency tracking
+	Received time.Time `json:"-"`
+}
+
+// frame is a message queued on a client's send channel, carrying the
+// WebSocket frame type it is written with.
+type frame struct {
+	messageType int
+	data        []byte
+
+	// queued is when a relayed message was queued, for MessageTTL; it is
+	// zero for frames that never expire
+	queued time.Time
+
+	// control marks a server notice rather than relayed data; binary
+	// holds its binary protocol form, if prepared, for writeFrame
+	control bool
+	binary  []byte
+
+	// priority routes a relayed message to the client's priority lane
+	priority bool
+
+	// backlog, if set, makes this frame stand for a whole replay, written
+	// at WarmupRate; see warmup.go
+	backlog []frame
+}
+
+// evictable reports whether the drop-oldest policy may discard f to make
+// room: relayed messages may go, but not server notices, such as the
+// welcome, resume and ack frames, nor a replay backlog, which stands for
+// the whole replay.
+func (f frame) evictable() bool {
+	return !f.control && f.backlog == nil
+}
+
+// textFrame wraps a control message, such as a JSON notice, as a text frame.
+func textFrame(data []byte) frame {
+	return frame{messageType: websocket.TextMessage, data: data, control: true}
+}
+
+// directMessage is a frame addressed to a single client. It is delivered by
+// Run, which owns closing send, so it cannot race with the client leaving.
+type directMessage struct {
+	client *Client
+	frame  frame
 }
 
 type ServerStats struct {
-	TotalConnections   uint64
-	TotalMessages      uint64
-	TotalBytesRelayed  uint64
+	TotalConnections     uint64
+	TotalMessages        uint64
+	TotalBytesRelayed    uint64    // inbound payload bytes, counted once per message
+	TotalBytesSent       uint64    // outbound bytes, counted once per recipient
+	PeakConnections      int       // highest number of concurrent clients
+	PeakTime             time.Time // when PeakConnections was reached
+	DroppedClients       uint64    // clients disconnected for a full send buffer
+	DroppedMessages      uint64    // frames discarded for a full send buffer by drop-message or drop-oldest
+	DeduplicatedMessages uint64    // repeated messages suppressed by DedupWindow
+	SinkDropped          uint64    // messages not archived because the sink fell behind
+	ExpiredMessages      uint64    // queued messages discarded after MessageTTL
+	TransformFailures    uint64    // messages dropped by a transformer error
+	BlockedMessages      uint64    // messages refused by the content policy
+	SchemaRejections     uint64    // JSON protocol frames not conforming to the schema
+	UpgradeFailures      uint64    // WebSocket handshakes that failed after passing checks
+	CircuitTrips         uint64    // times the circuit breaker opened
+	ShedClients          uint64    // clients dropped by the circuit breaker
+	PanicsRecovered      uint64    // panics recovered from in the hub; see recover.go
+
+	// CompressedConnections counts connected clients that negotiated
+	// permessage-deflate; like the connected count, it is guarded by h.mu
+	CompressedConnections int
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for simplicity
-	},
-	ReadBufferSize:  1024 * 1024, // 1MB
-	WriteBufferSize: 1024 * 1024, // 1MB
+// upgrader is configured by configureUpgrader: CheckOrigin from the
+// ALLOWED_ORIGINS setting and the buffers from READ_BUFFER_SIZE and
+// WRITE_BUFFER_SIZE
+var upgrader = websocket.Upgrader{}
+
+// configureUpgrader applies cfg to upgrader and returns the buffer bytes
+// each idle connection holds.
+func configureUpgrader(cfg *Config) int {
+	upgrader.CheckOrigin = newOriginChecker(cfg.AllowedOrigins)
+	upgrader.EnableCompression = cfg.Hub.Compression
+	upgrader.Subprotocols = cfg.Hub.Subprotocols
+	upgrader.ReadBufferSize = cfg.ReadBufferSize
+	upgrader.WriteBufferSize = cfg.WriteBufferSize
+	upgrader.WriteBufferPool = nil
+	perConn := cfg.ReadBufferSize + cfg.WriteBufferSize
+	if cfg.WriteBufferPool {
+		// Pooled write buffers are only held while a message is written
+		upgrader.WriteBufferPool = &sync.Pool{}
+		perConn = cfg.ReadBufferSize
+	}
+	return perConn
+}
+
+// offersCompression reports whether the client offered the
+// permessage-deflate extension, which the upgrader accepts whenever
+// compression is enabled. Gorilla does not expose the negotiated
+// extensions, so the request is inspected instead.
+func offersCompression(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newOriginChecker returns a CheckOrigin function that accepts only the
+// listed origins. A "*" entry accepts every origin, and an empty list falls
+// back to requiring the Origin host to match the request Host. Requests
+// without an Origin header come from non-browser clients and are accepted.
+func newOriginChecker(allowed []string) func(r *http.Request) bool {
+	allowAll := false
+	for _, origin := range allowed {
+		if origin == "*" {
+			allowAll = true
+		}
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || allowAll {
+			return true
+		}
+		if len(allowed) == 0 {
+			if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+				return true
+			}
+		}
+		for _, a := range allowed {
+			if strings.EqualFold(a, origin) {
+				return true
+			}
+		}
+		slog.Warn("Rejected WebSocket upgrade from disallowed origin", "event", "origin_rejected", "origin", origin, "remote_addr", r.RemoteAddr)
+		return false
+	}
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		clients:    make(map[string]*Client),
-		broadcast:  make(chan Message, 256),
+func NewHub(config HubConfig) *Hub {
+	h := &Hub{
+		config:     config,
+		shards:     newShards(config.Shards),
+		broadcast:  make(chan Message, broadcastBuffer),
+		direct:     make(chan directMessage, 256),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
-		startTime:  time.Now(),
+		kicks:      make(chan kickRequest),
+
+		announcements: make(chan announceRequest),
+
+		sheds:     make(chan struct{}, 1),
+		startTime: time.Now(),
+		history:   make(map[string]*history),
+		sequences: make(map[string]uint64),
+		rotations: make(map[string]*rotation),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+		peers:     newPeerLinks(config.Peers),
+	}
+	if config.GlobalRateLimit > 0 {
+		h.globalLimiter = newTokenBucket(config.GlobalRateLimit, config.GlobalRateBurst)
+	}
+	if config.MaxConnsPerIP > 0 {
+		h.ipLimits = newIPLimiter(config.MaxConnsPerIP)
+	}
+	if config.BanStrikes > 0 {
+		h.bans = newBanList(config.BanCooldown)
+	}
+	if config.RateLimit > 0 {
+		h.publishLimiters = newPublishLimiters(config.RateLimit, config.RateBurst)
+	}
+	if config.ConnectionRateLimit > 0 {
+		h.connLimiter = newTokenBucket(config.ConnectionRateLimit, config.ConnectionRateBurst)
+	}
+	if config.FanOutWorkers > 1 {
+		h.fanOutJobs = make(chan *fanOutJob, config.FanOutWorkers)
+	}
+	if config.DedupWindow > 0 {
+		h.dedup = newDedupCache(config.DedupWindow)
+	}
+	if config.LatencyTracking {
+		h.latency = &latencyHistogram{}
 	}
+	if config.Quota.enabled() || len(config.QuotaOverrides) > 0 {
+		h.quotas = newQuotaTracker(config.QuotaWindow, config.Quota, config.QuotaOverrides)
+	}
+	if _, nop := config.Sink.(NopSink); config.Sink != nil && !nop {
+		h.archive = make(chan Message, archiveBuffer)
+		h.archived = make(chan struct{})
+		go h.runArchive()
+	}
+	return h
 }
 
 func (h *Hub) Run() {
+	defer close(h.done)
+	h.mu.Lock()
+	h.running = true
+	h.mu.Unlock()
+	go h.watchBroadcast()
+	if h.config.MaxBufferedBytes > 0 {
+		go h.watchBuffered()
+	}
+	for _, link := range h.peers {
+		go link.run(h)
+	}
+	if h.fanOutJobs != nil {
+		for i := 0; i < h.config.FanOutWorkers; i++ {
+			go h.fanOutWorker()
+		}
+		defer close(h.fanOutJobs)
+	}
+	summary, stopSummary := h.summaryTicker()
+	defer stopSummary()
+	var lastSummary logSummary
+	for !h.serve(summary, &lastSummary) {
+		// serve recovered from a panic; carry on with the next event
+	}
+}
+
+// serve handles the hub's events until quit, returning true, or until
+// handling one panics, returning false once recoverPanic has logged it.
+func (h *Hub) serve(summary <-chan time.Time, lastSummary *logSummary) (stopped bool) {
+	defer h.recoverPanic("hub")
 	for {
 		select {
 		case client := <-h.register:
-			h.mu.Lock()
-			h.clients[client.username] = client
-			h.stats.TotalConnections++
-			h.mu.Unlock()
-			log.Printf("User '%s' connected. Total users: %d", client.username, len(h.clients))
+			if client.force {
+				h.evict(client.room, client.username)
+			}
+			if !h.addClient(client) {
+				// Lost a race with another connection for the username
+				close(client.send)
+				continue
+			}
+			h.mu.RLock()
+			total := h.clientCount()
+			h.mu.RUnlock()
+			slog.Debug("User connected", "event", "connect", "username", client.username, "room", client.room, "total_users", total)
+			h.announcePresence(client, "join")
+			h.replayHistory(client)
 
 		case client := <-h.unregister:
-			h.mu.Lock()
-			if _, ok := h.clients[client.username]; ok {
-				delete(h.clients, client.username)
-				close(client.send)
+			removed := h.removeClient(client)
+			h.mu.RLock()
+			total := h.clientCount()
+			h.mu.RUnlock()
+			if removed {
+				slog.Debug("User disconnected", "event", "disconnect", "username", client.username, "room", client.room, "total_users", total)
+				h.announcePresence(client, "leave")
 			}
-			h.mu.Unlock()
-			log.Printf("User '%s' disconnected. Total users: %d", client.username, len(h.clients))
 
 		case message := <-h.broadcast:
+			if h.dedup != nil && h.dedup.duplicate(message, time.Now()) {
+				h.mu.Lock()
+				h.stats.DeduplicatedMessages++
+				h.mu.Unlock()
+				continue
+			}
+			// Peers forward messages already transformed, and only those
+			// the transformers let through
+			if message.Origin == "" {
+				var ok bool
+				if message, ok = h.transform(message); !ok {
+					continue
+				}
+				h.forwardToPeers(message)
+			}
+			message = h.sequence(message)
+
 			h.mu.Lock()
 			h.stats.TotalMessages++
 			h.stats.TotalBytesRelayed += uint64(len(message.Data))
 			h.mu.Unlock()
-			
-			h.mu.RLock()
-			// Send to all clients except the sender
-			for username, client := range h.clients {
-				if username != message.From {
-					select {
-					case client.send <- message.Data:
-					default:
-						close(client.send)
-						delete(h.clients, username)
-					}
+			h.archiveMessage(message)
+
+			if h.config.HistorySize > 0 {
+				hist, ok := h.history[message.Room]
+				if !ok {
+					hist = newHistory(h.config.HistorySize)
+					h.history[message.Room] = hist
 				}
+				hist.add(message)
 			}
-			h.mu.RUnlock()
+
+			// Send to all clients in the sender's room that want the
+			// message, which excludes the sender unless it asked for echo,
+			// starting from a different client each time so none is
+			// systematically last when buffers fill. Clients the
+			// backpressure policy gives up on are collected and removed
+			// below, since the rotation must not change while it is walked.
+			out := frame{messageType: message.Type, data: message.Data, priority: message.Priority}
+			if h.config.MessageTTL > 0 {
+				out.queued = time.Now()
+			}
+			slow := h.fanOut(message, out)
+
+			if h.latency != nil {
+				h.latency.observe(time.Since(message.Received), message.Room, message.Seq)
+			}
+
+			for _, client := range slow {
+				client.closeWith(CloseSlowConsumer, "send buffer full", nil)
+				if h.removeClient(client) {
+					h.mu.Lock()
+					h.stats.DroppedClients++
+					h.noteDrop(time.Now())
+					h.mu.Unlock()
+					slog.Warn("User dropped: send buffer full", "event", "drop", "username", client.username, "room", client.room, "buffer_capacity", cap(client.send), "policy", h.config.BackpressurePolicy)
+					h.announcePresence(client, "leave")
+				}
+			}
+
+		case dm := <-h.direct:
+			h.sendTo(dm.client, dm.frame)
+
+		case req := <-h.kicks:
+			h.handleKick(req)
+
+		case req := <-h.announcements:
+			h.handleAnnounce(req)
+
+		case <-h.sheds:
+			h.shedSlowest()
+
+		case <-summary:
+			h.logConnectionSummary(lastSummary)
+
+		case <-h.quit:
+			// Closing send lets each WritePump flush what is already queued
+			// and then write a close frame to its client.
+			var clients []*Client
+			h.forEachClient(func(client *Client) {
+				clients = append(clients, client)
+			})
+			for _, client := range clients {
+				client.closeWith(websocket.CloseGoingAway, "server shutdown", nil)
+				h.removeClient(client)
+			}
+			if h.archive != nil {
+				close(h.archive)
+			}
+			slog.Info("Hub stopped, all clients closed", "event", "hub_stopped")
+			return true
+		}
+	}
+}
+
+// Shutdown stops accepting new clients, closes every connection once its
+// pending messages are flushed and waits for Run and the write pumps to exit.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.closeOnce.Do(func() {
+		h.mu.Lock()
+		h.closing = true
+		h.mu.Unlock()
+		close(h.quit)
+	})
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		h.pumps.Wait()
+		if h.archived != nil {
+			<-h.archived
+		}
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver queues data on a client's send buffer, applying the backpressure
+// policy if it is full. It reports false when the client should be dropped.
+// It takes no lock: only one goroutine may queue frames on a client at a
+// time, either Run or, while Run waits for them, the fan-out worker the
+// client is assigned to.
+func (h *Hub) deliver(client *Client, f frame) bool {
+	queue := client.send
+	if f.priority && client.priority != nil {
+		queue = client.priority
+	}
+	select {
+	case queue <- f:
+		client.enqueued(f)
+		return true
+	default:
+	}
+
+	switch h.config.BackpressurePolicy {
+	case BackpressureDropMessage:
+		h.countDropped(client)
+		return true
+	case BackpressureDropOldest:
+		// Only Run and, while it waits, the fan-out worker delivering to
+		// this client queue frames on it, so once one is taken off there
+		// is room; WritePump may have made room meanwhile too. Nothing
+		// can be pinned meanwhile either, so with nothing pinned the
+		// oldest frame is evictable. Otherwise it might not be, and f is
+		// dropped instead, as with drop-message.
+		if client.pinned.Load() == 0 {
+			select {
+			case old := <-queue:
+				client.dequeued(old)
+				h.countDropped(client)
+			default:
+			}
+		}
+		select {
+		case queue <- f:
+			client.enqueued(f)
+		default:
+			h.countDropped(client)
+		}
+		return true
+	case BackpressureBlock:
+		timer := time.NewTimer(h.config.BackpressureTimeout)
+		defer timer.Stop()
+		select {
+		case queue <- f:
+			client.enqueued(f)
+			return true
+		case <-timer.C:
+			return false
 		}
+	default:
+		return false
 	}
 }
 
+// countDropped counts a frame the backpressure policy discarded for
+// client.
+func (h *Hub) countDropped(client *Client) {
+	client.droppedMessages.Add(1)
+	h.droppedMessages.Add(1)
+}
+
+// replayHistory queues the room's recent messages on a newly registered
+// client, oldest first, before any live traffic reaches it. Messages the
+// same username sent earlier are skipped unless it echoes, as they would
+// be live. Unless paced by WarmupRate, replay stops early rather than
+// overflow the client's send buffer.
+func (h *Hub) replayHistory(client *Client) {
+	hist, ok := h.history[client.room]
+	if client.resume {
+		h.resume(client, hist)
+		return
+	}
+	if !ok {
+		return
+	}
+	n := client.replay
+	if n < 0 || n > hist.len() {
+		n = hist.len()
+	}
+	var frames []frame
+	for _, message := range hist.last(n) {
+		if client.receives(message) {
+			frames = append(frames, frame{messageType: message.Type, data: message.Data})
+		}
+	}
+	h.queueReplay(client, frames)
+}
+
+// receives reports whether a message relayed in the client's room is
+// delivered to it: senders only get their own messages back with echo,
+// and stream and topic filters and the message's selector apply.
+func (c *Client) receives(m Message) bool {
+	if m.From == c.username && !c.echo {
+		return false
+	}
+	return c.wantsStream(m.Data) && c.wantsTopic(m.Topic) && m.Selector.matches(c.metadata)
+}
+
+// clientCount returns the number of connected clients across all rooms.
+// The caller must hold h.mu.
+func (h *Hub) clientCount() int {
+	return h.connected
+}
+
+// ReadPump relays the client's messages to the hub. When it returns, the
+// client is unregistered, which closes send; WritePump then flushes what
+// is queued, writes the close frame and closes the connection.
 func (c *Client) ReadPump() {
 	defer func() {
-		c.hub.unregister <- c
-		c.conn.Close()
+		c.hub.ipLimits.release(c.ip)
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
 	}()
 
-	c.conn.SetReadLimit(10 * 1024 * 1024) // 10MB max message
-	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	c.conn.SetReadDeadline(time.Now().Add(c.hub.config.PongWait))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		c.conn.SetReadDeadline(time.Now().Add(c.hub.config.PongWait))
 		return nil
 	})
 
-	for {
-		_, data, err := c.conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+	for {
+		messageType, data, err := c.readMessage()
+		if err == errMessageTooLarge {
+			slog.Warn("User disconnected: message too large", "event", "message_too_large", "username", c.username, "room", c.room, "limit", c.hub.config.MaxMessageBytes)
+			c.closeWith(websocket.CloseMessageTooBig, "message too large", newErrorFrame(http.StatusRequestEntityTooLarge, "message_too_large", fmt.Sprintf("messages are limited to %d bytes", c.hub.config.MaxMessageBytes)))
+			break
+		}
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				slog.Warn("WebSocket error", "event", "read_error", "username", c.username, "room", c.room, "error", err)
+			}
+			break
+		}
+		c.messagesReceived.Add(1)
+		c.bytesReceived.Add(uint64(len(data)))
+		c.lastReadTime.Store(time.Now().UnixNano())
+		c.throttle(c.readBandwidth, len(data))
+
+		if c.protocol == ProtocolBinary {
+			payload, ok := c.readBinaryFrame(messageType, data)
+			if !ok {
+				continue
+			}
+			messageType, data = websocket.BinaryMessage, payload
+		} else if messageType == websocket.TextMessage && c.protocol == ProtocolJSON && c.handleControl(data) {
+			continue
+		} else if messageType == websocket.TextMessage && c.handlePong(data) {
+			// Raw payloads are relayed unchanged, queries included; only
+			// the heartbeat, which the server asked for, is answered
+			continue
+		}
+
+		if c.mode == ModeSubscriber {
+			continue
+		}
+
+		if !c.allowMessage() {
+			c.violations++
+			if c.strike() {
+				c.hub.bans.ban(c.username, c.ip)
+				slog.Warn("User banned: repeatedly rate limited", "event", "ban", "username", c.username, "room", c.room, "strikes", c.strikes, "cooldown", c.hub.config.BanCooldown.String())
+				c.closeWith(CloseBanned, "banned", bannedFrame)
+				break
+			}
+			limit := c.hub.config.RateLimitMaxViolations
+			if limit > 0 && c.violations >= limit {
+				slog.Warn("User disconnected: rate limit exceeded", "event", "rate_limit_disconnect", "username", c.username, "room", c.room, "violations", c.violations)
+				c.closeWith(CloseRateLimited, "rate limited", rateLimitedFrame)
+				break
+			}
+			var id json.RawMessage
+			if c.protocol == ProtocolJSON {
+				id = envelopeID(data)
+			}
+			c.reject(id, throttleNotice, "rate_limited")
+			continue
+		}
+		c.throttled = false
+
+		// The content policy and the schema judge the frame as sent, and
+		// quotas charge for it, so the envelope's from and ts cannot trip
+		// them
+		content := data
+		var topic string
+		var id json.RawMessage
+		var priority bool
+		var sel selector
+		if c.protocol == ProtocolJSON {
+			stamped, in, ok := c.stampEnvelope(data)
+			if !ok {
+				c.sendDirect(invalidJSONFrame)
+				continue
+			}
+			messageType, data, topic, id = websocket.TextMessage, stamped, in.Topic, in.ID
+			priority = in.Priority
+			var err error
+			if sel, err = parseSelector(in.Selector); err != nil {
+				c.reject(id, newErrorFrame(http.StatusBadRequest, "invalid_selector", err.Error()), "invalid_selector")
+				continue
+			}
+			if err := c.hub.schemaViolation(content, c.username, c.room); err != nil {
+				c.reject(id, newErrorFrame(http.StatusBadRequest, "schema_violation", err.Error()), "schema_violation")
+				continue
+			}
+		}
+
+		if c.hub.rejectingPublishes() {
+			c.reject(id, overloadedFrame, "overloaded")
+			continue
+		}
+
+		if c.hub.blockedContent(messageType, content, c.username, c.room) {
+			if c.hub.config.ContentPolicyAction == ContentPolicyDisconnect {
+				c.closeWith(websocket.ClosePolicyViolation, "content blocked", contentBlockedFrame)
+				break
+			}
+			c.reject(id, contentBlockedFrame, "content_blocked")
+			continue
+		}
+
+		if c.hub.quotas != nil && !c.hub.quotas.charge(c.username, len(content)) {
+			if c.hub.config.QuotaDisconnect {
+				slog.Warn("User disconnected: quota exceeded", "event", "quota_disconnect", "username", c.username, "room", c.room)
+				c.closeWith(CloseQuotaExceeded, "quota exceeded", quotaExceededFrame)
+				break
+			}
+			c.reject(id, quotaExceededFrame, "quota_exceeded")
+			continue
+		}
+
+		// Broadcast the raw message to all other clients
+		select {
+		case c.hub.broadcast <- Message{
+			Room: c.room,
+			From: c.username,
+			Type: messageType,
+			Data: data,
+
+			Topic:    topic,
+			Envelope: c.protocol == ProtocolJSON,
+			Priority: priority,
+			Selector: sel,
+			Received: time.Now(),
+		}:
+		case <-c.hub.done:
+			return
+		}
+		if c.protocol == ProtocolJSON && c.hub.config.SenderSequence {
+			c.senderSeq++
+		}
+		if id != nil {
+			c.ack(id)
+		}
+	}
+}
+
+// throttleNotice is sent to a client whose message was dropped by a rate limit
+var throttleNotice = newErrorFrame(http.StatusTooManyRequests, "rate_limited", "message dropped by the rate limit")
+
+// bannedFrame is sent before disconnecting a client that collected
+// BanStrikes strikes
+var bannedFrame = newErrorFrame(http.StatusForbidden, "banned", "repeatedly rate limited")
+
+// rateLimitedFrame is sent before disconnecting a client that exceeded
+// RateLimitMaxViolations
+var rateLimitedFrame = newErrorFrame(http.StatusTooManyRequests, "rate_limited", "too many messages over the rate limit")
+
+// idleTimeoutFrame is sent before disconnecting a client that has been
+// silent for longer than IdleTimeout
+var idleTimeoutFrame = newErrorFrame(http.StatusRequestTimeout, "idle_timeout", "no message sent within the idle timeout")
+
+var errMessageTooLarge = errors.New("message exceeds size limit")
+
+// readMessage reads the next message. MaxMessageBytes is enforced here
+// rather than with SetReadLimit, which would make gorilla send its own close
+// frame before the client could be told why.
+func (c *Client) readMessage() (int, []byte, error) {
+	messageType, r, err := c.conn.NextReader()
+	if err != nil {
+		return 0, nil, err
+	}
+	limit := c.hub.config.MaxMessageBytes
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if int64(len(data)) > limit {
+		return messageType, nil, errMessageTooLarge
+	}
+	return messageType, data, nil
+}
+
+// closeWith records why the server is about to disconnect the client: the
+// close code and reason for the close frame, and optionally a farewell frame
+// to send just before it. Call it before the client is removed.
+func (c *Client) closeWith(code int, reason string, farewell []byte) {
+	c.closeMu.Lock()
+	c.closeCode = code
+	c.closeReason = reason
+	c.farewell = farewell
+	c.closeMu.Unlock()
+}
+
+// takeFarewell returns and clears the pending farewell frame.
+func (c *Client) takeFarewell() []byte {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	data := c.farewell
+	c.farewell = nil
+	return data
+}
+
+// closeMessage returns the payload of the close frame to send, a normal
+// closure unless closeWith recorded a reason.
+func (c *Client) closeMessage() []byte {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closeCode == 0 {
+		return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	}
+	return websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+}
+
+// handleControl answers data if it is a JSON control frame, a quota query,
+// subscription, roster query or heartbeat pong, reporting whether it was
+// one. Control frames are never relayed. Only JSON and binary protocol
+// clients send control frames; a raw client's frames are all relayed.
+func (c *Client) handleControl(data []byte) bool {
+	if c.handlePong(data) {
+		return true
+	}
+	if c.hub.quotas != nil && isQuotaQuery(data) {
+		status, _ := json.Marshal(c.hub.quotas.status(c.username))
+		c.sendDirect(status)
+		return true
+	}
+	if patterns, ok := parseSubscribe(data); ok {
+		c.subscribe(patterns)
+		return true
+	}
+	if isWhoQuery(data) {
+		c.sendFrame(c.roster())
+		return true
+	}
+	return false
+}
+
+// allowMessage applies the client's own rate limit and then the hub-wide one.
+func (c *Client) allowMessage() bool {
+	if c.limiter != nil && !c.limiter.allow() {
+		return false
+	}
+	if c.hub.globalLimiter != nil && !c.hub.globalLimiter.allow() {
+		return false
+	}
+	return true
+}
+
+// sendDirect queues a frame for this client alone via the hub.
+// Control frames are JSON, so they are written as text.
+func (c *Client) sendDirect(data []byte) {
+	c.sendFrame(textFrame(data))
+}
+
+// sendFrame queues f for this client alone via the hub.
+func (c *Client) sendFrame(f frame) {
+	select {
+	case c.hub.direct <- directMessage{client: c, frame: f}:
+	case <-c.hub.done:
+	}
+}
+
+// WritePump writes queued frames and keepalive pings to the connection.
+// Any failed write ends it and closes the connection, so a half-dead
+// socket is torn down at once rather than at the next ping: the read in
+// ReadPump then fails and unregisters the client.
+func (c *Client) WritePump() {
+	ticker := time.NewTicker(c.hub.config.PingInterval)
+	defer func() {
+		ticker.Stop()
+		c.stopWarmup()
+		c.conn.Close()
+		go c.releaseQueued()
+		c.hub.pumps.Done()
+	}()
+
+	// The idle timer fires when the client could first have gone silent
+	// for IdleTimeout and is rearmed for the remainder if it has spoken
+	// since. It stays nil, blocking forever, when the timeout is off.
+	var idleTimer *time.Timer
+	var idle <-chan time.Time
+	if timeout := c.hub.config.IdleTimeout; timeout > 0 {
+		idleTimer = time.NewTimer(timeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	// Heartbeats likewise never fire when HeartbeatInterval is off.
+	var heartbeat <-chan time.Time
+	if interval := c.hub.config.HeartbeatInterval; interval > 0 {
+		heartbeatTicker := time.NewTicker(interval)
+		defer heartbeatTicker.Stop()
+		heartbeat = heartbeatTicker.C
+	}
+
+	// The lifetime timer likewise stays nil when MaxConnLifetime is off.
+	var lifetime <-chan time.Time
+	if maxLifetime := c.hub.config.MaxConnLifetime; maxLifetime > 0 {
+		lifetimeTimer := time.NewTimer(maxLifetime - time.Since(c.connectedAt))
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
+	}
+
+	for {
+		// While a replay backlog is paced out, live traffic waits behind
+		// it; everything else, pings included, is serviced meanwhile
+		send, pace := c.send, (<-chan time.Time)(nil)
+		if c.warmup != nil {
+			send, pace = nil, c.warmup.ticker.C
+		}
+		select {
+		case message, ok := <-send:
+			if ok {
+				c.dequeued(message)
+			}
+			if c.drainExpired() {
+				// Evicted and out of grace: drop what is still queued
+				c.conn.SetWriteDeadline(time.Now().Add(c.hub.config.WriteWait))
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage())
+				return
+			}
+			// Priority frames go ahead of message, and out before the
+			// close frame
+			if err := c.flushPriority(); err != nil {
+				c.logWriteError(err)
+				return
+			}
+			c.conn.SetWriteDeadline(c.writeDeadline())
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage())
+				return
+			}
+			if c.expired(message) {
+				continue
+			}
+			if message.backlog != nil {
+				if err := c.startWarmup(message.backlog); err != nil {
+					c.logWriteError(err)
+					return
+				}
+				continue
+			}
+			if c.needsChunking(message) {
+				closed, err := c.writeChunked(message)
+				if closed {
+					c.conn.SetWriteDeadline(time.Now().Add(c.hub.config.WriteWait))
+					c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage())
+					return
+				}
+				if err != nil {
+					c.logWriteError(err)
+					return
+				}
+				continue
+			}
+			// Batches glue frames together with no delimiter, so only
+			// relayed data of JSON-encoded clients is batched: msgpack
+			// notices are not self-delimiting, and binary protocol
+			// frames need their own prefix
+			if c.hub.config.BatchMaxMessages > 1 && c.encoding == (jsonEncoding{}) && !c.chunked && !message.control {
+				closed, err := c.writeBatch(message)
+				if closed {
+					c.conn.SetWriteDeadline(time.Now().Add(c.hub.config.WriteWait))
+					c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage())
+					return
+				}
+				if err != nil {
+					c.logWriteError(err)
+					return
+				}
+				continue
+			}
+			if err := c.writeFrame(message); err != nil {
+				c.logWriteError(err)
+				return
+			}
+			c.countSent(1, len(message.data))
+
+		case <-pace:
+			if err := c.writeWarmup(); err != nil {
+				c.logWriteError(err)
+				return
+			}
+
+		case f := <-c.priority:
+			if err := c.writePriority(f); err != nil {
+				c.logWriteError(err)
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.config.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.logWriteError(err)
+				return
+			}
+
+		case now := <-heartbeat:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.config.WriteWait))
+			if err := c.writeFrame(textFrame(heartbeatFrame(now))); err != nil {
+				c.logWriteError(err)
+				return
+			}
+
+		case <-idle:
+			silent := time.Since(time.Unix(0, c.lastReadTime.Load()))
+			if remaining := c.hub.config.IdleTimeout - silent; remaining > 0 {
+				idleTimer.Reset(remaining)
+				continue
+			}
+			// Closing the connection ends ReadPump, which unregisters the
+			// client through Run as for any other disconnect.
+			slog.Info("User disconnected: idle timeout", "event", "idle_timeout", "username", c.username, "room", c.room, "idle", silent.Round(time.Second).String())
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.config.WriteWait))
+			c.writeFrame(textFrame(idleTimeoutFrame))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(CloseIdleTimeout, "idle timeout"))
+			return
+
+		case <-lifetime:
+			// Like the idle timeout, ReadPump sees the close and
+			// unregisters the client.
+			slog.Debug("Connection recycled: max lifetime reached", "event", "max_lifetime", "username", c.username, "room", c.room, "lifetime", time.Since(c.connectedAt).Round(time.Second).String())
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.config.WriteWait))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "max connection lifetime"))
+			return
+		}
+	}
+}
+
+// countSent records messages written to the client and their payload
+// bytes, both for the client and the server-wide outbound total. With
+// MaxConnBytesPerSec it then holds the writer back until the bytes fit
+// the connection's bandwidth.
+func (c *Client) countSent(messages, bytes int) {
+	c.messagesSent.Add(uint64(messages))
+	c.bytesSent.Add(uint64(bytes))
+	c.hub.bytesSent.Add(uint64(bytes))
+	c.throttle(c.writeBandwidth, bytes)
+}
+
+// writeDeadline is the deadline for the next write: WriteWait from now,
+// but no later than the end of an evicted client's grace.
+func (c *Client) writeDeadline() time.Time {
+	deadline := time.Now().Add(c.hub.config.WriteWait)
+	if drain := c.drainDeadline.Load(); drain != 0 && drain < deadline.UnixNano() {
+		return time.Unix(0, drain)
+	}
+	return deadline
+}
+
+// drainExpired reports whether the client was evicted and its grace for
+// flushing queued frames is over.
+func (c *Client) drainExpired() bool {
+	drain := c.drainDeadline.Load()
+	return drain != 0 && time.Now().UnixNano() >= drain
+}
+
+// expired reports whether f has outlived MessageTTL in the send buffer,
+// counting it if so.
+func (c *Client) expired(f frame) bool {
+	if f.queued.IsZero() || time.Since(f.queued) <= c.hub.config.MessageTTL {
+		return false
+	}
+	c.hub.mu.Lock()
+	c.hub.stats.ExpiredMessages++
+	c.hub.mu.Unlock()
+	return true
+}
+
+// logWriteError records a write that failed and ended WritePump.
+func (c *Client) logWriteError(err error) {
+	slog.Debug("WebSocket write failed", "event", "write_error", "username", c.username, "room", c.room, "error", err)
+}
+
+func HandleWebSocket(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkRequestURI(w, r) {
+			return
+		}
+
+		// Extract room and username from URL path
+		vars := mux.Vars(r)
+		username := vars["username"]
+		room := vars["room"]
+		if room == "" {
+			room = defaultRoom
+		}
+
+		anonymous := false
+		if username == "" {
+			if !hub.config.AllowAnonymous {
+				http.Error(w, "Username required in URL", http.StatusBadRequest)
+				return
 			}
-			break
+			username, anonymous = hub.anonymousUsername(room), true
+		}
+		if err := validateUsername(username); err != nil {
+			http.Error(w, "Invalid username: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ip := hub.clientIP(r)
+		if !checkBan(w, hub, username, ip) {
+			return
 		}
 
-		// Broadcast the raw message to all other clients
-		c.hub.broadcast <- Message{
-			From: c.username,
-			Data: data,
+		mode := r.URL.Query().Get("mode")
+		switch mode {
+		case "":
+			mode = ModePublisher
+		case ModePublisher, ModeSubscriber:
+		default:
+			http.Error(w, "mode must be publisher or subscriber", http.StatusBadRequest)
+			return
 		}
-	}
-}
 
-func (c *Client) WritePump() {
-	ticker := time.NewTicker(54 * time.Second)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
+		protocol := r.URL.Query().Get("protocol")
+		switch protocol {
+		case "":
+			protocol = ProtocolRaw
+		case ProtocolRaw, ProtocolJSON, ProtocolBinary:
+		default:
+			http.Error(w, "protocol must be raw, json or binary", http.StatusBadRequest)
+			return
+		}
+		encoding := r.URL.Query().Get("encoding")
+		switch encoding {
+		case "":
+			encoding = EncodingJSON
+		case EncodingJSON, EncodingMsgpack:
+			if protocol == ProtocolBinary {
+				http.Error(w, "encoding does not apply to the binary protocol", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "encoding must be json or msgpack", http.StatusBadRequest)
+			return
+		}
 
-	for {
-		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		replay := -1
+		if value := r.URL.Query().Get("replay"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				http.Error(w, "replay must be a non-negative integer", http.StatusBadRequest)
 				return
 			}
-			c.conn.WriteMessage(websocket.BinaryMessage, message)
+			replay = n
+		}
 
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+		var since uint64
+		_, resume := r.URL.Query()["since"]
+		if resume {
+			n, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+			if err != nil {
+				http.Error(w, "since must be a non-negative integer", http.StatusBadRequest)
 				return
 			}
+			since = n
 		}
-	}
-}
 
-func HandleWebSocket(hub *Hub) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Extract username from URL path
-		vars := mux.Vars(r)
-		username := vars["username"]
-		
-		if username == "" {
-			http.Error(w, "Username required in URL", http.StatusBadRequest)
+		streams, err := parseStreams(r.URL.Query().Get("streams"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metadata, err := parseMetadata(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Check if username already exists
+		if hub.connLimiter != nil {
+			if ok, wait := hub.connLimiter.take(); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too many connection attempts", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		// Check if username already exists in this room. With force=1 the
+		// existing connection is evicted by Run on registration instead, and
+		// the replacement does not count against the capacity it frees.
+		force := r.URL.Query().Get("force") == "1"
+		existing := hub.lookup(room, username) != nil
+		if existing && !force {
+			http.Error(w, "Username already connected", http.StatusConflict)
+			return
+		}
 		hub.mu.RLock()
-		if _, exists := hub.clients[username]; exists {
+		if hub.closing {
 			hub.mu.RUnlock()
-			http.Error(w, "Username already connected", http.StatusConflict)
+			http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if hub.draining {
+			hub.mu.RUnlock()
+			http.Error(w, "Server draining", http.StatusServiceUnavailable)
+			return
+		}
+		if hub.config.MaxClients > 0 && !existing && hub.clientCount() >= hub.config.MaxClients {
+			hub.mu.RUnlock()
+			http.Error(w, "Server at connection capacity", http.StatusServiceUnavailable)
 			return
 		}
 		hub.mu.RUnlock()
 
+		if hub.config.StrictSubprotocols {
+			if offered := websocket.Subprotocols(r); len(offered) > 0 && !supportsSubprotocol(hub.config.Subprotocols, offered) {
+				http.Error(w, "Unsupported subprotocol", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// From here the connection counts against the IP limit until
+		// ReadPump ends, or until this handler gives up on it
+		if !checkIPLimit(w, hub, ip) {
+			return
+		}
+
 		// Upgrade to WebSocket
+		// On failure the upgrader has already answered the client with an
+		// HTTP error; nothing was registered, so only the IP slot is held
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Printf("WebSocket upgrade failed: %v", err)
+			hub.ipLimits.release(ip)
+			hub.mu.Lock()
+			hub.stats.UpgradeFailures++
+			hub.mu.Unlock()
+			slog.Warn("WebSocket upgrade failed", "event", "upgrade_failed", "username", username, "room", room,
+				"remote_addr", r.RemoteAddr, "ip", ip, "origin", r.Header.Get("Origin"), "error", err)
 			return
 		}
+		if hub.config.Compression {
+			// Only takes effect if the client negotiated permessage-deflate
+			conn.EnableWriteCompression(true)
+			conn.SetCompressionLevel(hub.config.CompressionLevel)
+		}
+		if r.URL.Query().Get("protocol") == "" {
+			switch conn.Subprotocol() {
+			case SubprotocolJSON:
+				protocol = ProtocolJSON
+			case SubprotocolBinary:
+				protocol = ProtocolBinary
+			case SubprotocolMsgpack:
+				if r.URL.Query().Get("encoding") == "" {
+					encoding = EncodingMsgpack
+				}
+			}
+		}
 
 		client := &Client{
 			conn:     conn,
-			send:     make(chan []byte, 256),
+			send:     make(chan frame, hub.config.SendBuffer),
 			username: username,
+			room:     room,
+			mode:     mode,
+			protocol: protocol,
 			hub:      hub,
+			encoding: newControlEncoding(protocol, encoding),
+
+			subprotocol: conn.Subprotocol(),
+			replay:      replay,
+			resume:      resume,
+			since:       since,
+			presence:    r.URL.Query().Get("presence") == "1",
+			echo:        r.URL.Query().Get("echo") == "1",
+			streams:     streams,
+			force:       force,
+			metadata:    metadata,
+
+			compressed: hub.config.Compression && offersCompression(r),
+			chunked:    hub.config.ChunkSize > 0 && r.URL.Query().Get("chunked") == "1",
+
+			remoteAddr:  conn.RemoteAddr().String(),
+			ip:          ip,
+			connectedAt: time.Now(),
+		}
+		client.lastReadTime.Store(time.Now().UnixNano())
+		if hub.config.PriorityBuffer > 0 {
+			client.priority = make(chan frame, hub.config.PriorityBuffer)
+		}
+		if hub.config.RateLimit > 0 {
+			client.limiter = newTokenBucket(hub.config.RateLimit, hub.config.RateBurst)
+		}
+		client.readBandwidth = newBandwidthBucket(hub.config.MaxConnBytesPerSec)
+		client.writeBandwidth = newBandwidthBucket(hub.config.MaxConnBytesPerSec)
+		if anonymous {
+			// Queued before registering, so it precedes replay and live
+			// traffic
+			welcome := textFrame(newWelcomeFrame(username, room))
+			client.send <- welcome
+			client.enqueued(welcome)
 		}
 
-		hub.register <- client
+		hub.pumps.Add(1)
+		select {
+		case hub.register <- client:
+		case <-hub.done:
+			hub.pumps.Done()
+			hub.ipLimits.release(ip)
+			conn.Close()
+			return
+		}
 
 		go client.WritePump()
 		go client.ReadPump()
 	}
 }
 
-func HandleBenchmark(hub *Hub) http.HandlerFunc {
+// HandleBenchmark reports the server's throughput. With ?load=1 it first
+// runs a load test through load, which is nil when load tests are disabled.
+func HandleBenchmark(hub *Hub, load *loadGenerator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Run a quick self-test benchmark
 		startTime := time.Now()
-		
+
+		var loadResults *loadResult
+		if r.URL.Query().Get("load") == "1" {
+			if load == nil {
+				http.Error(w, "Load test disabled: set BENCHMARK_LOAD=1", http.StatusForbidden)
+				return
+			}
+			clients, messages, err := parseLoadParams(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			result, err := load.run(clients, messages)
+			if err != nil {
+				slog.Error("Load test failed", "event", "load_test_failed", "error", err)
+				http.Error(w, "Load test failed: "+err.Error(), http.StatusBadGateway)
+				return
+			}
+			loadResults = &result
+		}
+
 		hub.mu.RLock()
-		clientCount := len(hub.clients)
+		clientCount := hub.clientCount()
 		stats := hub.stats
 		uptime := time.Since(hub.startTime)
 		hub.mu.RUnlock()
-		
+		messagesPerSecond, bandwidthMbps := throughput(stats, uptime)
+
 		// Perform some quick tests
 		testResults := map[string]interface{}{
 			"timestamp": time.Now().UTC().Format(time.RFC3339),
 			"server": map[string]interface{}{
-				"version": ServerVersion,
-				"uptime_seconds": uptime.Seconds(),
+				"version":         ServerVersion,
+				"uptime_seconds":  uptime.Seconds(),
 				"connected_users": clientCount,
 			},
 			"metrics": map[string]interface{}{
-				"total_messages": stats.TotalMessages,
-				"total_bytes": stats.TotalBytesRelayed,
-				"messages_per_second": float64(stats.TotalMessages) / uptime.Seconds(),
-				"bandwidth_mbps": float64(stats.TotalBytesRelayed*8) / (uptime.Seconds() * 1000000),
+				"total_messages":      stats.TotalMessages,
+				"total_bytes":         stats.TotalBytesRelayed,
+				"messages_per_second": messagesPerSecond,
+				"bandwidth_mbps":      bandwidthMbps,
 			},
 			"test_duration_ms": time.Since(startTime).Milliseconds(),
 		}
-		
+		if loadResults != nil {
+			testResults["load"] = loadResults
+		}
+
 		// Generate markdown report
 		markdown := generateBenchmarkReport(testResults)
-		
+
 		// Return based on Accept header
 		accept := r.Header.Get("Accept")
 		if strings.Contains(accept, "text/markdown") {
@@ -252,9 +2005,9 @@ func HandleBenchmark(hub *Hub) http.HandlerFunc {
 		} else {
 			// Default to JSON with markdown included
 			response := map[string]interface{}{
-				"results": testResults,
+				"results":         testResults,
 				"report_markdown": markdown,
-				"report_html": markdownToHTML(markdown),
+				"report_html":     markdownToHTML(markdown),
 			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(response)
@@ -264,17 +2017,17 @@ func HandleBenchmark(hub *Hub) http.HandlerFunc {
 
 func generateBenchmarkReport(results map[string]interface{}) string {
 	var report strings.Builder
-	
+
 	report.WriteString("# WebSocket Relay Server - Performance Report\n\n")
 	report.WriteString(fmt.Sprintf("**Generated:** %s\n\n", results["timestamp"]))
-	
+
 	report.WriteString("## Server Status\n\n")
 	if server, ok := results["server"].(map[string]interface{}); ok {
 		report.WriteString(fmt.Sprintf("- **Version:** %v\n", server["version"]))
 		report.WriteString(fmt.Sprintf("- **Uptime:** %.0f seconds\n", server["uptime_seconds"]))
 		report.WriteString(fmt.Sprintf("- **Connected Users:** %v\n", server["connected_users"]))
 	}
-	
+
 	report.WriteString("\n## Performance Metrics\n\n")
 	if metrics, ok := results["metrics"].(map[string]interface{}); ok {
 		report.WriteString(fmt.Sprintf("- **Total Messages:** %v\n", metrics["total_messages"]))
@@ -282,11 +2035,22 @@ func generateBenchmarkReport(results map[string]interface{}) string {
 		report.WriteString(fmt.Sprintf("- **Throughput:** %.2f msg/s\n", metrics["messages_per_second"]))
 		report.WriteString(fmt.Sprintf("- **Bandwidth:** %.2f Mbps\n", metrics["bandwidth_mbps"]))
 	}
-	
+
+	if load, ok := results["load"].(*loadResult); ok {
+		report.WriteString("\n## Load Test\n\n")
+		report.WriteString(fmt.Sprintf("- **Clients:** %d\n", load.Clients))
+		report.WriteString(fmt.Sprintf("- **Messages:** %d sent, %d of %d deliveries\n", load.MessagesSent, load.MessagesDelivered, load.MessagesExpected))
+		report.WriteString(fmt.Sprintf("- **Throughput:** %.2f msg/s\n", load.MessagesPerSecond))
+		report.WriteString(fmt.Sprintf("- **Latency:** avg %.2fms, p50 %.2fms, p95 %.2fms, p99 %.2fms\n", load.LatencyAvgMs, load.LatencyP50Ms, load.LatencyP95Ms, load.LatencyP99Ms))
+		if load.TimedOut {
+			report.WriteString("- **Warning:** timed out before every message was delivered\n")
+		}
+	}
+
 	report.WriteString("\n## Test Information\n\n")
 	report.WriteString(fmt.Sprintf("- **Test Duration:** %vms\n", results["test_duration_ms"]))
 	report.WriteString(fmt.Sprintf("- **Deployment:** %s\n", getEnvOrDefault("BUILD_COMMIT", "unknown")))
-	
+
 	return report.String()
 }
 
@@ -309,7 +2073,7 @@ func markdownToHTML(markdown string) string {
 </head>
 <body>
 `
-	
+
 	// Convert markdown to HTML (basic conversion)
 	lines := strings.Split(markdown, "\n")
 	for _, line := range lines {
@@ -325,58 +2089,251 @@ func markdownToHTML(markdown string) string {
 			html += fmt.Sprintf("<p>%s</p>\n", line)
 		}
 	}
-	
+
 	html += "</body></html>"
 	return html
 }
 
+// HandleHealth is the liveness probe and the detailed server overview. Its
+// status is healthy, degraded or unhealthy, with reasons for the latter
+// two; only unhealthy answers 503.
 func HandleHealth(hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		hub.mu.RLock()
-		users := make([]string, 0, len(hub.clients))
-		for username := range hub.clients {
+		var users []string
+		rooms := make(map[string][]string)
+		perUser := make(map[string]map[string]interface{})
+		hub.forEachClient(func(client *Client) {
+			username := displayUsername(client.username)
 			users = append(users, username)
+			rooms[client.room] = append(rooms[client.room], username)
+			if perUser[client.room] == nil {
+				perUser[client.room] = make(map[string]interface{})
+			}
+			perUser[client.room][username] = map[string]interface{}{
+				"mode":              client.mode,
+				"messages_sent":     client.messagesSent.Load(),
+				"bytes_sent":        client.bytesSent.Load(),
+				"messages_received": client.messagesReceived.Load(),
+				"bytes_received":    client.bytesReceived.Load(),
+				"dropped_messages":  client.droppedMessages.Load(),
+				"compressed":        client.compressed,
+			}
+		})
+		if users == nil {
+			users = []string{}
 		}
-		clientCount := len(hub.clients)
+
+		hub.mu.RLock()
+		clientCount := hub.clientCount()
 		stats := hub.stats
-		uptime := time.Since(hub.startTime)
+		startTime := hub.startTime
+		uptime := time.Since(startTime)
+		saturated := !hub.saturatedSince.IsZero()
+		status, reasons := hub.healthStatus()
 		hub.mu.RUnlock()
-
-		// Prepare deployment info
-		deploymentInfo := map[string]interface{}{
-			"commit":    getEnvOrDefault("BUILD_COMMIT", "unknown"),
-			"timestamp": getEnvOrDefault("BUILD_TIME", time.Now().UTC().Format(time.RFC3339)),
-			"actor":     getEnvOrDefault("BUILD_ACTOR", "manual"),
-			"run_id":    getEnvOrDefault("BUILD_RUN_ID", ""),
-			"run_url":   getEnvOrDefault("BUILD_RUN_URL", ""),
-		}
+		stats.TotalBytesSent = hub.bytesSent.Load()
+		stats.PanicsRecovered = hub.panicsRecovered.Load()
+		stats.DroppedMessages = hub.droppedMessages.Load()
+		messagesPerSecond, bandwidthMbps := throughput(stats, uptime)
 
 		health := map[string]interface{}{
-			"status":  "healthy",
-			"version": ServerVersion,
-			"deployment": deploymentInfo,
+			"status":     status,
+			"reasons":    reasons,
+			"version":    ServerVersion,
+			"deployment": deploymentInfo(),
 			"server": map[string]interface{}{
-				"uptime_seconds":      uptime.Seconds(),
-				"start_time":         hub.startTime.UTC().Format(time.RFC3339),
-				"current_time":       time.Now().UTC().Format(time.RFC3339),
+				"uptime_seconds": uptime.Seconds(),
+				"start_time":     startTime.UTC().Format(time.RFC3339),
+				"current_time":   time.Now().UTC().Format(time.RFC3339),
 			},
 			"metrics": map[string]interface{}{
-				"connected_users":      clientCount,
-				"users":               users,
-				"total_connections":   stats.TotalConnections,
-				"total_messages":      stats.TotalMessages,
-				"total_bytes_relayed": stats.TotalBytesRelayed,
-				"messages_per_second": float64(stats.TotalMessages) / uptime.Seconds(),
-				"bandwidth_mbps":      float64(stats.TotalBytesRelayed*8) / (uptime.Seconds() * 1000000),
+				"connected_users":          clientCount,
+				"users":                    users,
+				"rooms":                    rooms,
+				"per_user":                 perUser,
+				"total_connections":        stats.TotalConnections,
+				"peak_connections":         stats.PeakConnections,
+				"peak_time":                formatPeakTime(stats.PeakTime),
+				"total_messages":           stats.TotalMessages,
+				"total_bytes_relayed":      stats.TotalBytesRelayed,
+				"total_bytes_sent":         stats.TotalBytesSent,
+				"dropped_clients":          stats.DroppedClients,
+				"dropped_messages":         stats.DroppedMessages,
+				"expired_messages":         stats.ExpiredMessages,
+				"transform_failures":       stats.TransformFailures,
+				"blocked_messages":         stats.BlockedMessages,
+				"schema_rejections":        stats.SchemaRejections,
+				"upgrade_failures":         stats.UpgradeFailures,
+				"panics_recovered":         stats.PanicsRecovered,
+				"deduplicated_messages":    stats.DeduplicatedMessages,
+				"compressed_connections":   stats.CompressedConnections,
+				"broadcast_queue_depth":    len(hub.broadcast),
+				"broadcast_queue_capacity": cap(hub.broadcast),
+				"broadcast_saturated":      saturated,
+				"buffered_bytes":           hub.bufferedBytes.Load(),
+				"circuit_open":             hub.circuitOpen.Load(),
+				"messages_per_second":      messagesPerSecond,
+				"bandwidth_mbps":           bandwidthMbps,
 			},
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if status == healthUnhealthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
 		json.NewEncoder(w).Encode(health)
 	}
 }
 
+// HandleReady is the readiness probe. Unlike /health, which only shows the
+// process is alive, it answers 503 until the hub is running, while the
+// broadcast channel has been saturated for SaturationPeriod, while
+// draining and once graceful shutdown has begun, so load balancers stop
+// sending new clients.
+func HandleReady(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hub.mu.RLock()
+		running, closing, draining := hub.running, hub.closing, hub.draining
+		saturated := hub.config.SaturationPeriod > 0 && hub.saturated()
+		hub.mu.RUnlock()
+
+		status, code := "ready", http.StatusOK
+		switch {
+		case closing:
+			status, code = "shutting_down", http.StatusServiceUnavailable
+		case !running:
+			status, code = "starting", http.StatusServiceUnavailable
+		case draining:
+			status, code = "draining", http.StatusServiceUnavailable
+		case saturated:
+			status, code = "saturated", http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"status": status})
+	}
+}
+
+// deploymentInfo describes the running build from the BUILD_* environment.
+func deploymentInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"commit":    getEnvOrDefault("BUILD_COMMIT", "unknown"),
+		"timestamp": getEnvOrDefault("BUILD_TIME", time.Now().UTC().Format(time.RFC3339)),
+		"actor":     getEnvOrDefault("BUILD_ACTOR", "manual"),
+		"run_id":    getEnvOrDefault("BUILD_RUN_ID", ""),
+		"run_url":   getEnvOrDefault("BUILD_RUN_URL", ""),
+	}
+}
+
+// HandleVersion serves the server version and build metadata. The payload
+// only changes on redeploy, so clients and proxies may cache it briefly.
+func HandleVersion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version := deploymentInfo()
+		version["version"] = ServerVersion
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		json.NewEncoder(w).Encode(version)
+	}
+}
+
+// HandleStats serves the numeric server metrics only. Unlike /health it
+// neither lists users nor walks the client map, so it is cheap to poll.
+func HandleStats(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hub.mu.RLock()
+		response := hub.statsReport(false)
+		hub.mu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// statsReport returns the figures served by /stats. With reset it also
+// zeroes the atomic counters as it reads them, for resetStats. The caller
+// holds h.mu, for writing when resetting.
+func (h *Hub) statsReport(reset bool) map[string]interface{} {
+	take := func(counter *atomic.Uint64) uint64 {
+		if reset {
+			return counter.Swap(0)
+		}
+		return counter.Load()
+	}
+	stats := h.stats
+	stats.TotalBytesSent = take(&h.bytesSent)
+	stats.PanicsRecovered = take(&h.panicsRecovered)
+	stats.DroppedMessages = take(&h.droppedMessages)
+	uptime := time.Since(h.startTime)
+	messagesPerSecond, bandwidthMbps := throughput(stats, uptime)
+
+	response := map[string]interface{}{
+		"uptime_seconds":           uptime.Seconds(),
+		"connected_users":          h.clientCount(),
+		"total_connections":        stats.TotalConnections,
+		"peak_connections":         stats.PeakConnections,
+		"peak_time":                formatPeakTime(stats.PeakTime),
+		"total_messages":           stats.TotalMessages,
+		"total_bytes_relayed":      stats.TotalBytesRelayed,
+		"total_bytes_sent":         stats.TotalBytesSent,
+		"broadcast_queue_depth":    len(h.broadcast),
+		"broadcast_queue_capacity": cap(h.broadcast),
+		"broadcast_saturated":      !h.saturatedSince.IsZero(),
+		"buffered_bytes":           h.bufferedBytes.Load(),
+		"circuit_open":             h.circuitOpen.Load(),
+		"circuit_trips":            stats.CircuitTrips,
+		"shed_clients":             stats.ShedClients,
+		"dropped_messages":         stats.DroppedMessages,
+		"blocked_messages":         stats.BlockedMessages,
+		"schema_rejections":        stats.SchemaRejections,
+		"upgrade_failures":         stats.UpgradeFailures,
+		"panics_recovered":         stats.PanicsRecovered,
+		"messages_per_second":      messagesPerSecond,
+		"bandwidth_mbps":           bandwidthMbps,
+	}
+	if len(h.peers) > 0 {
+		response["node_id"] = h.config.NodeID
+		response["peers"] = h.peerStatus(take)
+		response["peer_messages_received"] = take(&h.peerReceived)
+		response["peer_messages_discarded"] = take(&h.peerDiscarded)
+	}
+	if h.latency != nil {
+		read := h.latency.quantiles
+		if reset {
+			read = h.latency.takeQuantiles
+		}
+		latencies, _ := read(latencyQuantiles)
+		response["latency_p50_ms"] = milliseconds(latencies[0])
+		response["latency_p95_ms"] = milliseconds(latencies[1])
+		response["latency_p99_ms"] = milliseconds(latencies[2])
+	}
+	return response
+}
+
+// formatPeakTime renders the time of peak connections, empty before the
+// first client connects.
+func formatPeakTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// throughput returns the average message rate and bandwidth since startup.
+// Within the first second the averages are meaningless and dividing by a
+// near-zero uptime would yield +Inf or NaN, which JSON cannot encode, so
+// both rates are reported as zero.
+func throughput(stats ServerStats, uptime time.Duration) (messagesPerSecond, bandwidthMbps float64) {
+	seconds := uptime.Seconds()
+	if seconds < 1 {
+		return 0, 0
+	}
+	return float64(stats.TotalMessages) / seconds, float64(stats.TotalBytesRelayed*8) / (seconds * 1000000)
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -384,46 +2341,297 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+// newRouter registers the server's endpoints for hub. load runs the
+// benchmark endpoint's load tests; it is nil when they are disabled.
+func newRouter(cfg *Config, hub *Hub, load *loadGenerator) *mux.Router {
+	adminToken := cfg.operatorToken()
+
+	// Signed tokens, when configured, replace the shared AUTH_TOKEN
+	wsAuth := func(next http.HandlerFunc) http.HandlerFunc {
+		if cfg.TokenSecret != "" {
+			return requireSignedToken(cfg.TokenSecret, next)
+		}
+		return requireToken(cfg.AuthToken, next)
+	}
+
+	router := mux.NewRouter()
+
+	// WebSocket endpoint with username in URL (joins the default room)
+	router.HandleFunc("/ws/{username}", wsAuth(HandleWebSocket(hub)))
+
+	// WebSocket endpoint scoped to a room
+	router.HandleFunc("/ws/{room}/{username}", wsAuth(HandleWebSocket(hub)))
+
+	// WebSocket endpoints without a username, for AllowAnonymous
+	router.HandleFunc("/ws", wsAuth(HandleWebSocket(hub)))
+	router.HandleFunc("/ws/", wsAuth(HandleWebSocket(hub)))
+	router.HandleFunc("/ws/{room}/", wsAuth(HandleWebSocket(hub)))
+
+	// Echo for connectivity tests, outside the relay; signed tokens name a
+	// username, so only AUTH_TOKEN guards it
+	router.HandleFunc("/ws-echo", requireToken(cfg.AuthToken, HandleEcho(hub)))
+
+	// Server-Sent Events for receive-only consumers
+	router.HandleFunc("/sse/{username}", wsAuth(HandleSSE(hub))).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/sse/{room}/{username}", wsAuth(HandleSSE(hub))).Methods(http.MethodGet, http.MethodOptions)
+
+	// HTTP publishing for producers that cannot hold a WebSocket open
+	publishAuth := func(next http.HandlerFunc) http.HandlerFunc {
+		return requirePublishCredential(cfg.TokenSecret, adminToken, next)
+	}
+	router.HandleFunc("/publish/{username}", publishAuth(HandlePublish(hub))).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/publish/{room}/{username}", publishAuth(HandlePublish(hub))).Methods(http.MethodPost, http.MethodOptions)
+
+	// Health check endpoint
+	router.HandleFunc("/health", gzipResponse(HandleHealth(hub)))
+
+	// Readiness probe
+	router.HandleFunc("/ready", HandleReady(hub))
+
+	// Operator endpoints
+	router.HandleFunc("/admin/kick/{username}", requireAdminToken(adminToken, HandleKick(hub))).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/admin/kick/{room}/{username}", requireAdminToken(adminToken, HandleKick(hub))).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/admin/connections", requireAdminToken(adminToken, HandleConnections(hub))).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/admin/announce", requireAdminToken(adminToken, HandleAnnounce(hub))).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/admin/drain", requireAdminToken(adminToken, HandleDrain(hub, true))).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/admin/stats/reset", requireAdminToken(adminToken, HandleStatsReset(hub))).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/admin/undrain", requireAdminToken(adminToken, HandleDrain(hub, false))).Methods(http.MethodPost, http.MethodOptions)
+
+	// Federation: other instances forward their messages here
+	router.HandleFunc("/peer", requireAdminToken(adminToken, HandlePeer(hub)))
+
+	// Runtime diagnostics for leak hunting
+	adminAuth := func(next http.HandlerFunc) http.HandlerFunc {
+		return requireAdminToken(adminToken, next)
+	}
+	router.HandleFunc("/debug/runtime", adminAuth(HandleRuntime(hub))).Methods(http.MethodGet, http.MethodOptions)
+	if cfg.Pprof {
+		registerPprof(router, adminAuth)
+		bannerf("🔬 pprof profiles enabled on /debug/pprof/")
+	}
+
+	// Build metadata endpoint
+	router.HandleFunc("/version", HandleVersion())
+
+	// Lightweight metrics endpoint for frequent polling
+	router.HandleFunc("/stats", gzipResponse(HandleStats(hub)))
+
+	// Prometheus metrics
+	router.HandleFunc("/metrics", gzipResponse(HandleMetrics(hub)))
+
+	// Benchmark endpoint
+	router.HandleFunc("/test/benchmark", HandleBenchmark(hub, load))
+
+	// CORS middleware
+	router.Use(corsMiddleware(cfg.CORSOrigins, cfg.CORSMethods, cfg.CORSHeaders, cfg.CORSCredentials))
+
+	return router
+}
+
 func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if cfg != nil && cfg.CheckConfig {
+		os.Exit(checkConfig(cfg, err))
+	}
+	if err != nil {
+		log.Fatalf("❌ Invalid configuration: %v", err)
+	}
+	if err := setupLogging(cfg.LogFormat, cfg.LogLevel); err != nil {
+		log.Fatalf("❌ Invalid configuration: %v", err)
+	}
+	if cfg.MintToken != "" {
+		fmt.Println(mintToken(cfg.TokenSecret, cfg.MintToken, time.Now().Add(cfg.TokenTTL)))
+		return
+	}
+	bannerEnabled = !cfg.Quiet && cfg.LogFormat != "json"
+
 	// Log deployment information on startup
-	log.Printf("🚀 WebSocket Relay Server v%s starting", ServerVersion)
-	log.Printf("📦 Deployment: Commit=%s, Actor=%s, Time=%s", 
+	bannerf("🚀 WebSocket Relay Server v%s starting", ServerVersion)
+	bannerf("📦 Deployment: Commit=%s, Actor=%s, Time=%s",
 		getEnvOrDefault("BUILD_COMMIT", "unknown"),
 		getEnvOrDefault("BUILD_ACTOR", "manual"),
 		getEnvOrDefault("BUILD_TIME", time.Now().UTC().Format(time.RFC3339)))
-	
-	hub := NewHub()
+	if cfg.TokenSecret != "" {
+		bannerf("🔐 WebSocket connections require a token signed with TOKEN_SECRET")
+	} else if cfg.AuthToken != "" {
+		bannerf("🔐 WebSocket connections require AUTH_TOKEN")
+	}
+	if cfg.Hub.Compression {
+		bannerf("🗜️ permessage-deflate compression enabled (level %d)", cfg.Hub.CompressionLevel)
+	}
+	if cfg.Hub.MaxClients > 0 {
+		bannerf("👥 Max clients: %d", cfg.Hub.MaxClients)
+	}
+	bannerf("📬 Send buffer: %d frames per client", cfg.Hub.SendBuffer)
+	bannerf("⏱️ Write timeout: %s, pings every %s, pong wait %s", cfg.Hub.WriteWait, cfg.Hub.PingInterval, cfg.Hub.PongWait)
+	if cfg.Hub.MaxConnBytesPerSec > 0 {
+		bannerf("🚦 Bandwidth: %d B/s per connection each way", cfg.Hub.MaxConnBytesPerSec)
+	}
+
+	perConn := configureUpgrader(cfg)
+	bannerf("📐 I/O buffers: %d B read, %d B write (pooled: %t), ~%.1f MiB per 1000 connections",
+		cfg.ReadBufferSize, cfg.WriteBufferSize, cfg.WriteBufferPool, float64(perConn)*1000/(1<<20))
+
+	sink, err := newSink(cfg.Sink, cfg.SinkPath)
+	if err != nil {
+		log.Fatalf("❌ Invalid configuration: %v", err)
+	}
+	if cfg.Sink != SinkNone {
+		bannerf("🗄️ Archiving messages to %s sink %s", cfg.Sink, cfg.SinkPath)
+	}
+	cfg.Hub.Sink = sink
+
+	if cfg.Hub.TrustedProxies, err = parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("❌ Invalid configuration: %v", err)
+	}
+	if len(cfg.TrustedProxies) > 0 {
+		bannerf("🛡️ Trusting forwarded client IPs from %s", strings.Join(cfg.TrustedProxies, ", "))
+	}
+
+	if cfg.Hub.ContentPolicy, err = newContentPolicy(cfg.BlockedContent, cfg.BlockedContentIgnoreCase); err != nil {
+		log.Fatalf("❌ Invalid configuration: %v", err)
+	}
+	if cfg.Hub.ContentPolicy != nil {
+		bannerf("🚫 Content policy: %d blocked patterns, action %s", len(cfg.BlockedContent), cfg.Hub.ContentPolicyAction)
+	}
+
+	if cfg.Hub.Schema, err = loadJSONSchema(cfg.SchemaFile); err != nil {
+		log.Fatalf("❌ Invalid configuration: %v", err)
+	}
+	if cfg.Hub.Schema != nil {
+		bannerf("🧩 Validating JSON protocol messages against %s", cfg.SchemaFile)
+	}
+
+	if cfg.Hub.Transformers, err = newTransformers(cfg.Transformers); err != nil {
+		log.Fatalf("❌ Invalid configuration: %v", err)
+	}
+	if len(cfg.Transformers) > 0 {
+		bannerf("🔧 Message transformers: %s", strings.Join(cfg.Transformers, ", "))
+	}
+
+	adminToken := cfg.operatorToken()
+	cfg.Hub.PeerToken = adminToken
+	if len(cfg.Hub.Peers) > 0 {
+		bannerf("🌐 Federating with %d peers as node %s", len(cfg.Hub.Peers), cfg.Hub.NodeID)
+	}
+
+	hub := NewHub(cfg.Hub)
 	go hub.Run()
 
-	router := mux.NewRouter()
-	
-	// WebSocket endpoint with username in URL
-	router.HandleFunc("/ws/{username}", HandleWebSocket(hub))
-	
-	// Health check endpoint
-	router.HandleFunc("/health", HandleHealth(hub))
-	
-	// Benchmark endpoint
-	router.HandleFunc("/test/benchmark", HandleBenchmark(hub))
-	
-	// CORS middleware
-	router.Use(func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-			
-			if r.Method == "OPTIONS" {
-				w.WriteHeader(http.StatusOK)
-				return
+	connectAddr := cfg.ListenAddr
+	if strings.HasPrefix(connectAddr, ":") {
+		connectAddr = "localhost" + connectAddr
+	}
+	scheme := "ws"
+	if cfg.TLSCertFile != "" {
+		scheme = "wss"
+	}
+	var load *loadGenerator
+	if cfg.BenchmarkLoad {
+		load = &loadGenerator{hub: hub, baseURL: scheme + "://" + connectAddr, token: cfg.AuthToken, tokenSecret: cfg.TokenSecret}
+		if cfg.TLSCertFile != "" {
+			// The load clients connect to this very server, whose
+			// certificate need not name localhost
+			load.dialer = &websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		}
+		if cfg.UnixSocket != "" {
+			load.baseURL = scheme + "://localhost"
+			load.dialer = &websocket.Dialer{NetDial: func(string, string) (net.Conn, error) {
+				return net.Dial("unix", cfg.UnixSocket)
+			}}
+			if cfg.TLSCertFile != "" {
+				load.dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 			}
-			
-			next.ServeHTTP(w, r)
-		})
-	})
+		}
+		bannerf("🏋️ Load tests enabled on /test/benchmark?load=1")
+	}
+
+	router := newRouter(cfg, hub, load)
+
+	listener, err := listen(cfg)
+	if err != nil {
+		log.Fatalf("❌ Server failed: %v", err)
+	}
+	if cfg.UnixSocket != "" {
+		bannerf("📡 Server listening on unix socket %s", cfg.UnixSocket)
+	} else {
+		bannerf("📡 Server listening on %s", cfg.ListenAddr)
+		bannerf("🔗 Connect via: %s://%s/ws/{username}", scheme, connectAddr)
+	}
+	if cfg.TLSCertFile != "" {
+		bannerf("🔒 TLS enabled, HTTP/2 negotiated for non-WebSocket requests")
+	} else if cfg.H2C {
+		bannerf("🔓 h2c enabled: HTTP/2 over cleartext for clients with prior knowledge")
+	}
+	if !bannerEnabled {
+		addr := cfg.ListenAddr
+		if cfg.UnixSocket != "" {
+			addr = "unix:" + cfg.UnixSocket
+		}
+		logStartup(addr, cfg.Hub)
+	}
+
+	server := &http.Server{
+		Addr:    cfg.ListenAddr,
+		Handler: router,
+	}
+	if cfg.H2C {
+		enableH2C(server)
+	}
 
-	port := ":8080"
-	log.Printf("📡 Server listening on %s", port)
-	log.Printf("🔗 Connect via: ws://localhost%s/ws/{username}", port)
-	log.Fatal(http.ListenAndServe(port, router))
-}
\ No newline at end of file
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		serve := server.Serve
+		if cfg.TLSCertFile != "" {
+			// ServeTLS negotiates HTTP/2 via ALPN. WebSocket upgrades
+			// need HTTP/1.1, which browsers fall back to as long as
+			// HTTP/2 does not advertise extended CONNECT (off by default)
+			serve = func(l net.Listener) error { return server.ServeTLS(l, cfg.TLSCertFile, cfg.TLSKeyFile) }
+		}
+		if err := serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("❌ Server failed: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	if bannerEnabled {
+		log.Printf("🛑 Shutting down, waiting up to %s for clients to drain", cfg.ShutdownTimeout)
+	} else {
+		slog.Info("Server shutting down", "event", "shutdown", "timeout", cfg.ShutdownTimeout.String())
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Close the hijacked WebSocket connections, which http.Server.Shutdown
+	// does not track, while still serving HTTP so /ready can report the
+	// shutdown and new upgrades get a 503; then stop the HTTP server.
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Hub shutdown: %v", err)
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+	if cfg.UnixSocket != "" {
+		// Closing the listener normally unlinks the socket already
+		if err := os.Remove(cfg.UnixSocket); err != nil && !os.IsNotExist(err) {
+			log.Printf("Removing unix socket: %v", err)
+		}
+	}
+	if closer, ok := sink.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Message sink close: %v", err)
+		}
+	}
+	if bannerEnabled {
+		log.Printf("👋 Server stopped")
+	} else {
+		slog.Info("Server stopped", "event", "stopped")
+	}
+}
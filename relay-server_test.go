@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	// Connection events and the banner are noise in test output
+	log.SetOutput(io.Discard)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	bannerEnabled = false
+	os.Exit(m.Run())
+}
+
+// startHub runs a hub with config until the test ends.
+func startHub(tb testing.TB, config HubConfig) *Hub {
+	tb.Helper()
+	hub := NewHub(config)
+	go hub.Run()
+	tb.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := hub.Shutdown(ctx); err != nil {
+			tb.Errorf("hub shutdown: %v", err)
+		}
+	})
+	return hub
+}
+
+// newTestClient returns a client of hub without a connection or pumps,
+// whose send buffer holds buffer frames; nothing drains it unless the
+// test does.
+func newTestClient(hub *Hub, room, username string, buffer int) *Client {
+	client := &Client{
+		send:        make(chan frame, buffer),
+		username:    username,
+		room:        room,
+		mode:        ModePublisher,
+		protocol:    ProtocolRaw,
+		hub:         hub,
+		encoding:    jsonEncoding{},
+		replay:      -1,
+		connectedAt: time.Now(),
+	}
+	client.lastReadTime.Store(time.Now().UnixNano())
+	return client
+}
+
+// joinHub registers client with its hub and waits until Run has added it.
+func joinHub(tb testing.TB, client *Client) *Client {
+	tb.Helper()
+	client.hub.register <- client
+	waitFor(tb, "client "+client.username+" to register", func() bool {
+		return client.hub.lookup(client.room, client.username) == client
+	})
+	return client
+}
+
+// relay hands the hub a binary message from username in room, as
+// ReadPump would.
+func relay(hub *Hub, room, username string, data []byte) {
+	hub.broadcast <- Message{Room: room, From: username, Type: websocket.BinaryMessage, Data: data, Received: time.Now()}
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(tb testing.TB, what string, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// hubStats returns a copy of the hub's statistics.
+func hubStats(hub *Hub) ServerStats {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	return hub.stats
+}
+
+// queued returns the frames waiting on a client's send buffer without
+// waiting for more, and whether the buffer has been closed.
+func queued(client *Client) (frames []frame, closed bool) {
+	for {
+		select {
+		case f, ok := <-client.send:
+			if !ok {
+				return frames, true
+			}
+			frames = append(frames, f)
+		default:
+			return frames, false
+		}
+	}
+}
+
+// testServer serves the server's routes for a running hub.
+type testServer struct {
+	*httptest.Server
+	hub *Hub
+}
+
+// newTestServer serves the routes for a hub configured with the defaults
+// as adjusted by configure, which may be nil.
+func newTestServer(tb testing.TB, configure func(*Config)) *testServer {
+	tb.Helper()
+	srv := newUnstartedTestServer(tb, configure)
+	srv.Start()
+	return srv
+}
+
+// newUnstartedTestServer is newTestServer for tests that set the server
+// up further, e.g. for TLS, before starting it.
+func newUnstartedTestServer(tb testing.TB, configure func(*Config)) *testServer {
+	tb.Helper()
+	cfg := &Config{
+		ShutdownTimeout: 5 * time.Second,
+		TokenTTL:        time.Hour,
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		WriteBufferPool: true,
+		Hub:             DefaultHubConfig(),
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	configureUpgrader(cfg)
+	hub := startHub(tb, cfg.Hub)
+	srv := httptest.NewUnstartedServer(newRouter(cfg, hub, nil))
+	tb.Cleanup(srv.Close)
+	return &testServer{Server: srv, hub: hub}
+}
+
+// wsURL returns the WebSocket URL of path on the server.
+func (s *testServer) wsURL(path string) string {
+	return "ws" + strings.TrimPrefix(s.URL, "http") + path
+}
+
+// dial opens a WebSocket to path, failing the test if the upgrade does
+// not succeed. The connection is closed when the test ends.
+func (s *testServer) dial(tb testing.TB, path string, header http.Header) *websocket.Conn {
+	tb.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(s.wsURL(path), header)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		tb.Fatalf("dial %s: %v (HTTP %d)", path, err, status)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// connect dials /ws/room/username with query, which may be empty, and
+// waits until the hub has registered the client.
+func (s *testServer) connect(tb testing.TB, room, username, query string) *websocket.Conn {
+	tb.Helper()
+	path := "/ws/" + room + "/" + username
+	if query != "" {
+		path += "?" + query
+	}
+	conn := s.dial(tb, path, nil)
+	waitFor(tb, username+" to register", func() bool {
+		return s.hub.lookup(room, username) != nil
+	})
+	return conn
+}
+
+// dialStatus attempts a WebSocket upgrade to path and returns the HTTP
+// status of the response, 101 if it succeeded.
+func (s *testServer) dialStatus(tb testing.TB, path string, header http.Header) (int, http.Header) {
+	tb.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(s.wsURL(path), header)
+	if err == nil {
+		tb.Cleanup(func() { conn.Close() })
+	}
+	if resp == nil {
+		tb.Fatalf("dial %s: %v", path, err)
+	}
+	return resp.StatusCode, resp.Header
+}
+
+// readFrame reads the next message from conn, failing the test if none
+// arrives within a few seconds.
+func readFrame(tb testing.TB, conn *websocket.Conn) (int, []byte) {
+	tb.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		tb.Fatalf("read: %v", err)
+	}
+	return messageType, data
+}
+
+// expectSilence fails the test if conn receives a message within wait.
+func expectSilence(tb testing.TB, conn *websocket.Conn, wait time.Duration) {
+	tb.Helper()
+	conn.SetReadDeadline(time.Now().Add(wait))
+	if _, data, err := conn.ReadMessage(); err == nil {
+		tb.Fatalf("unexpected message %q", data)
+	}
+}
+
+// countingConn counts the bytes read from a connection.
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestSlowClientRemovedWhenFlooded(t *testing.T) {
+	hub := startHub(t, DefaultHubConfig())
+	slow := joinHub(t, newTestClient(hub, "r", "slow", 1))
+	fast := joinHub(t, newTestClient(hub, "r", "fast", 200))
+
+	for i := 0; i < 200; i++ {
+		relay(hub, "r", "sender", []byte{byte(i)})
+	}
+	waitFor(t, "the slow client to be dropped", func() bool {
+		return hub.lookup("r", "slow") == nil
+	})
+	// ReadPump unregisters a dropped client too once its connection
+	// closes; that must not close send a second time
+	hub.unregister <- slow
+	waitFor(t, "the flood to be relayed", func() bool {
+		return hubStats(hub).TotalMessages == 200
+	})
+
+	if _, closed := queued(slow); !closed {
+		t.Error("slow client's send buffer was not closed")
+	}
+	if got := hubStats(hub).DroppedClients; got != 1 {
+		t.Errorf("DroppedClients = %d, want 1", got)
+	}
+	if n := hub.panicsRecovered.Load(); n != 0 {
+		t.Errorf("hub recovered from %d panics", n)
+	}
+	if hub.lookup("r", "fast") != fast {
+		t.Error("fast client was removed")
+	}
+	if frames, _ := queued(fast); len(frames) != 200 {
+		t.Errorf("fast client got %d frames, want 200", len(frames))
+	}
+}
+
+func TestMaxClientsRejectsWith503(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.MaxClients = 2 })
+	srv.connect(t, "r", "alice", "")
+	srv.connect(t, "r", "bob", "")
+
+	if status, _ := srv.dialStatus(t, "/ws/r/carol", nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("third connection got HTTP %d, want 503", status)
+	}
+	if got := srv.hub.lookup("r", "carol"); got != nil {
+		t.Error("rejected client was registered")
+	}
+}
+
+func TestCompressedClientReceivesBinaryFrames(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.Compression = true })
+	dialer := websocket.Dialer{EnableCompression: true}
+	receiver, _, err := dialer.Dial(srv.wsURL("/ws/r/bob"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	sender := srv.connect(t, "r", "alice", "")
+	waitFor(t, "bob to register", func() bool { return srv.hub.lookup("r", "bob") != nil })
+	if !srv.hub.lookup("r", "bob").compressed {
+		t.Error("bob not marked as compressed")
+	}
+
+	payload := []byte(strings.Repeat(`{"sensor":"temp","value":21.5}`, 100))
+	sender.WriteMessage(websocket.BinaryMessage, payload)
+	messageType, data := readFrame(t, receiver)
+	if messageType != websocket.BinaryMessage || string(data) != string(payload) {
+		t.Fatalf("got type %d, %d bytes; want the binary payload back", messageType, len(data))
+	}
+}
+
+// BenchmarkRelayCompression compares the bytes a receiver reads off the
+// wire for a compressible message with permessage-deflate off and on.
+func BenchmarkRelayCompression(b *testing.B) {
+	payload := []byte(strings.Repeat(`{"sensor":"temp","value":21.5}`, 128))
+	for _, compression := range []bool{false, true} {
+		name := "off"
+		if compression {
+			name = "on"
+		}
+		b.Run(name, func(b *testing.B) {
+			srv := newTestServer(b, func(cfg *Config) {
+				cfg.Hub.Compression = compression
+				cfg.Hub.RateLimit = 0
+			})
+			var wire atomic.Int64
+			dialer := websocket.Dialer{
+				EnableCompression: true,
+				NetDial: func(network, addr string) (net.Conn, error) {
+					conn, err := net.Dial(network, addr)
+					return countingConn{Conn: conn, read: &wire}, err
+				},
+			}
+			receiver, _, err := dialer.Dial(srv.wsURL("/ws/r/bob"), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer receiver.Close()
+			sender := srv.connect(b, "r", "alice", "")
+			waitFor(b, "bob to register", func() bool { return srv.hub.lookup("r", "bob") != nil })
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			wire.Store(0)
+			for i := 0; i < b.N; i++ {
+				if err := sender.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := receiver.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(wire.Load())/float64(b.N), "wire-B/op")
+		})
+	}
+}
+
+func TestRatesAreZeroRightAfterStart(t *testing.T) {
+	hub := NewHub(DefaultHubConfig())
+	for _, endpoint := range []struct {
+		name    string
+		handler http.HandlerFunc
+		metrics func(map[string]interface{}) map[string]interface{}
+	}{
+		{"/health", HandleHealth(hub), func(body map[string]interface{}) map[string]interface{} {
+			metrics, _ := body["metrics"].(map[string]interface{})
+			return metrics
+		}},
+		{"/stats", HandleStats(hub), func(body map[string]interface{}) map[string]interface{} { return body }},
+	} {
+		w := httptest.NewRecorder()
+		endpoint.handler(w, httptest.NewRequest(http.MethodGet, endpoint.name, nil))
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: invalid JSON %q: %v", endpoint.name, w.Body.String(), err)
+		}
+		metrics := endpoint.metrics(body)
+		for _, key := range []string{"messages_per_second", "bandwidth_mbps"} {
+			if metrics[key] != 0.0 {
+				t.Errorf("%s: %s = %v, want 0", endpoint.name, key, metrics[key])
+			}
+		}
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	stats := ServerStats{TotalMessages: 100, TotalBytesRelayed: 1_000_000}
+	for _, uptime := range []time.Duration{0, time.Nanosecond, 999 * time.Millisecond} {
+		if mps, mbps := throughput(stats, uptime); mps != 0 || mbps != 0 {
+			t.Errorf("throughput over %s = %v, %v; want 0, 0", uptime, mps, mbps)
+		}
+	}
+	mps, mbps := throughput(stats, 10*time.Second)
+	if mps != 10 || mbps != 0.8 {
+		t.Errorf("throughput over 10s = %v, %v; want 10, 0.8", mps, mbps)
+	}
+}
+
+func TestBackpressurePolicies(t *testing.T) {
+	// The slow client's buffer holds two frames and nothing drains it
+	// unless the case does; five messages are relayed to it.
+	tests := []struct {
+		policy  string
+		drain   time.Duration // delay per frame of a draining consumer, 0 for none
+		dropped bool
+		want    []byte // frames received, in order, by the time all are relayed
+	}{
+		{policy: BackpressureDropClient, dropped: true, want: []byte{0, 1}},
+		{policy: BackpressureDropMessage, want: []byte{0, 1}},
+		{policy: BackpressureDropOldest, want: []byte{3, 4}},
+		{policy: BackpressureBlock, dropped: true, want: []byte{0, 1}},
+		{policy: BackpressureBlock, drain: 10 * time.Millisecond, want: []byte{0, 1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		name := tt.policy
+		if tt.drain > 0 {
+			name += "/draining"
+		}
+		t.Run(name, func(t *testing.T) {
+			config := DefaultHubConfig()
+			config.BackpressurePolicy = tt.policy
+			config.BackpressureTimeout = 200 * time.Millisecond
+			hub := startHub(t, config)
+			slow := joinHub(t, newTestClient(hub, "r", "slow", 2))
+
+			var received []byte
+			drained := make(chan struct{})
+			if tt.drain > 0 {
+				go func() {
+					defer close(drained)
+					for f := range slow.send {
+						received = append(received, f.data[0])
+						if len(received) == 5 {
+							return
+						}
+						time.Sleep(tt.drain)
+					}
+				}()
+			}
+			for i := 0; i < 5; i++ {
+				relay(hub, "r", "sender", []byte{byte(i)})
+			}
+			waitFor(t, "all messages to be relayed", func() bool {
+				return hubStats(hub).TotalMessages == 5
+			})
+			if tt.drain > 0 {
+				<-drained
+			} else {
+				frames, _ := queued(slow)
+				for _, f := range frames {
+					received = append(received, f.data[0])
+				}
+			}
+
+			if got := hub.lookup("r", "slow") == nil; got != tt.dropped {
+				t.Errorf("dropped = %t, want %t", got, tt.dropped)
+			}
+			if string(received) != string(tt.want) {
+				t.Errorf("received %v, want %v", received, tt.want)
+			}
+			wantDropped := uint64(0)
+			if tt.policy == BackpressureDropMessage || tt.policy == BackpressureDropOldest {
+				wantDropped = 3
+			}
+			if got := slow.droppedMessages.Load(); got != wantDropped {
+				t.Errorf("dropped messages = %d, want %d", got, wantDropped)
+			}
+			if got := hub.droppedMessages.Load(); got != wantDropped {
+				t.Errorf("hub dropped messages = %d, want %d", got, wantDropped)
+			}
+		})
+	}
+}
+
+func TestDropOldestKeepsNoticesAndBacklogs(t *testing.T) {
+	tests := map[string]frame{
+		"notice":  textFrame(newWelcomeFrame("slow", "r")),
+		"backlog": {messageType: websocket.BinaryMessage, backlog: []frame{{messageType: websocket.BinaryMessage, data: []byte{9}}}},
+	}
+	for name, head := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := DefaultHubConfig()
+			config.BackpressurePolicy = BackpressureDropOldest
+			hub := startHub(t, config)
+			slow := newTestClient(hub, "r", "slow", 2)
+			slow.send <- head
+			slow.enqueued(head)
+			joinHub(t, slow)
+
+			for i := 0; i < 5; i++ {
+				relay(hub, "r", "sender", []byte{byte(i)})
+			}
+			waitFor(t, "all messages to be relayed", func() bool {
+				return hubStats(hub).TotalMessages == 5
+			})
+			frames, _ := queued(slow)
+			if len(frames) != 2 || frames[0].control != head.control || len(frames[0].backlog) != len(head.backlog) {
+				t.Fatalf("queued %+v, want the %s first", frames, name)
+			}
+			if got := frames[1].data; len(got) != 1 || got[0] != 0 {
+				t.Errorf("queued %v behind the %s, want [0]", got, name)
+			}
+			if got := slow.droppedMessages.Load(); got != 4 {
+				t.Errorf("dropped messages = %d, want 4", got)
+			}
+		})
+	}
+}
+
+func TestFrameTypePreserved(t *testing.T) {
+	srv := newTestServer(t, nil)
+	receiver := srv.connect(t, "r", "bob", "")
+	sender := srv.connect(t, "r", "alice", "")
+
+	for _, sent := range []struct {
+		messageType int
+		data        string
+	}{
+		{websocket.TextMessage, "héllo"},
+		{websocket.BinaryMessage, "\x00\xff\x10"},
+		{websocket.TextMessage, `{"not":"a control frame"}`},
+	} {
+		if err := sender.WriteMessage(sent.messageType, []byte(sent.data)); err != nil {
+			t.Fatal(err)
+		}
+		messageType, data := readFrame(t, receiver)
+		if messageType != sent.messageType || string(data) != sent.data {
+			t.Errorf("sent type %d %q, received type %d %q", sent.messageType, sent.data, messageType, data)
+		}
+	}
+}
+
+// faultyListener hands out connections whose writes fail once broken is
+// set, as they would to a peer that vanished without closing.
+type faultyListener struct {
+	net.Listener
+	broken *atomic.Bool
+}
+
+func (l faultyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	return faultyConn{Conn: conn, broken: l.broken}, err
+}
+
+type faultyConn struct {
+	net.Conn
+	broken *atomic.Bool
+}
+
+func (c faultyConn) Write(p []byte) (int, error) {
+	if c.broken.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	return c.Conn.Write(p)
+}
+
+func TestWriteErrorUnregistersClient(t *testing.T) {
+	cfg := &Config{ReadBufferSize: 4096, WriteBufferSize: 4096, Hub: DefaultHubConfig()}
+	configureUpgrader(cfg)
+	hub := startHub(t, cfg.Hub)
+	var broken atomic.Bool
+	ts := httptest.NewUnstartedServer(newRouter(cfg, hub, nil))
+	ts.Listener = faultyListener{Listener: ts.Listener, broken: &broken}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	srv := &testServer{Server: ts, hub: hub}
+
+	srv.connect(t, "r", "alice", "")
+	broken.Store(true)
+	relay(hub, "r", "bob", []byte("hello"))
+	start := time.Now()
+	waitFor(t, "alice to be unregistered", func() bool { return hub.lookup("r", "alice") == nil })
+	// Well before the next ping would have found the connection dead
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("unregistered after %s", elapsed)
+	}
+}
+
+func TestEchoReturnsOwnMessages(t *testing.T) {
+	srv := newTestServer(t, nil)
+	echo := srv.connect(t, "r", "alice", "echo=1")
+	plain := srv.connect(t, "r", "bob", "")
+
+	echo.WriteMessage(websocket.TextMessage, []byte("from alice"))
+	if _, data := readFrame(t, echo); string(data) != "from alice" {
+		t.Fatalf("alice got %q, want her own message back", data)
+	}
+	if _, data := readFrame(t, plain); string(data) != "from alice" {
+		t.Fatalf("bob got %q, want alice's message", data)
+	}
+
+	plain.WriteMessage(websocket.TextMessage, []byte("from bob"))
+	if _, data := readFrame(t, echo); string(data) != "from bob" {
+		t.Fatalf("alice got %q, want bob's message", data)
+	}
+	expectSilence(t, plain, 100*time.Millisecond)
+}
+
+func TestMaxConnLifetimeClosesWithGoingAway(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.MaxConnLifetime = 100 * time.Millisecond })
+	start := time.Now()
+	conn := srv.connect(t, "r", "alice", "")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("connection ended with %v, want close code 1001", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("closed after %s, before its lifetime", elapsed)
+	}
+	waitFor(t, "alice to be unregistered", func() bool { return srv.hub.lookup("r", "alice") == nil })
+	// The client may reconnect at once, e.g. through another instance
+	srv.connect(t, "r", "alice", "")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"relay-server/client"
+)
+
+// connectRelay connects a client package Relay to srv as username in room
+// and waits until the hub has registered it.
+func connectRelay(t *testing.T, srv *testServer, room, username string, opts client.Options) *client.Relay {
+	t.Helper()
+	opts.Room = room
+	r, err := client.ConnectWithOptions(srv.wsURL(""), username, opts)
+	if err != nil {
+		t.Fatalf("connect %s: %v", username, err)
+	}
+	t.Cleanup(func() { r.Close() })
+	waitFor(t, username+" to register", func() bool { return srv.hub.lookup(room, username) != nil })
+	return r
+}
+
+// nextMessage returns the next message r receives, failing the test if
+// none arrives within a few seconds.
+func nextMessage(t *testing.T, r *client.Relay) []byte {
+	t.Helper()
+	select {
+	case msg, ok := <-r.Messages():
+		if !ok {
+			t.Fatal("Messages closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	srv := newTestServer(t, nil)
+	alice := connectRelay(t, srv, "r", "alice", client.Options{})
+	bob := connectRelay(t, srv, "r", "bob", client.Options{})
+
+	if err := alice.Send([]byte("hello bob")); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextMessage(t, bob); string(got) != "hello bob" {
+		t.Fatalf("bob got %q", got)
+	}
+	if err := bob.Send([]byte("hi alice")); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextMessage(t, alice); string(got) != "hi alice" {
+		t.Fatalf("alice got %q", got)
+	}
+
+	alice.Close()
+	if _, ok := <-alice.Messages(); ok {
+		t.Error("Messages still open after Close")
+	}
+	if err := alice.Send([]byte("late")); err != client.ErrClosed {
+		t.Errorf("Send after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestClientReconnectsAfterDisconnect(t *testing.T) {
+	srv := newTestServer(t, nil)
+	alice := connectRelay(t, srv, "r", "alice", client.Options{MinBackoff: 10 * time.Millisecond})
+	bob := connectRelay(t, srv, "r", "bob", client.Options{})
+
+	first := srv.hub.lookup("r", "alice")
+	first.conn.Close()
+	waitFor(t, "alice to reconnect", func() bool {
+		current := srv.hub.lookup("r", "alice")
+		return current != nil && current != first
+	})
+
+	if err := bob.Send([]byte("welcome back")); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextMessage(t, alice); string(got) != "welcome back" {
+		t.Fatalf("alice got %q", got)
+	}
+	waitFor(t, "alice's new connection to be usable", func() bool {
+		return alice.Send([]byte("thanks")) == nil
+	})
+	if got := nextMessage(t, bob); string(got) != "thanks" {
+		t.Fatalf("bob got %q", got)
+	}
+}
+
+func TestClientAnswersPings(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.Hub.PingInterval = 20 * time.Millisecond
+		cfg.Hub.PongWait = 60 * time.Millisecond
+	})
+	connectRelay(t, srv, "r", "alice", client.Options{MinBackoff: time.Hour})
+	first := srv.hub.lookup("r", "alice")
+
+	// Without pongs the server would give up after PongWait
+	time.Sleep(300 * time.Millisecond)
+	if srv.hub.lookup("r", "alice") != first {
+		t.Fatal("connection was dropped despite pings being answered")
+	}
+}
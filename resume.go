@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// Every message relayed in a room gets the room's next sequence number,
+// starting at 1 when the server starts. A client reconnecting with
+// ?since=N first receives a resume frame carrying the room's current
+// sequence, then the buffered messages after N. JSON protocol envelopes
+// carry their "seq", so such clients always know where to resume from.
+
+// resumeFrame opens the connection of a client that asked for ?since=.
+// Lost counts messages after Since that had already been evicted from the
+// room's history and cannot be replayed.
+type resumeFrame struct {
+	Type  string `json:"type"`
+	Room  string `json:"room"`
+	Seq   uint64 `json:"seq"`
+	Since uint64 `json:"since"`
+	Lost  uint64 `json:"lost"`
+}
+
+// sequence assigns message the next sequence number in its room and, for
+// a JSON protocol envelope, records it in the payload as "seq". Called
+// from Run only.
+func (h *Hub) sequence(message Message) Message {
+	h.sequences[message.Room]++
+	message.Seq = h.sequences[message.Room]
+	if message.Envelope && bytes.HasPrefix(message.Data, []byte("{")) {
+		data := make([]byte, 0, len(message.Data)+24)
+		data = append(data, `{"seq":`...)
+		data = strconv.AppendUint(data, message.Seq, 10)
+		data = append(data, ',')
+		message.Data = append(data, message.Data[1:]...)
+	}
+	return message
+}
+
+// resume sends a client that connected with ?since= the resume frame and
+// the buffered messages it missed, oldest first. A since beyond the
+// room's sequence, e.g. one from before a restart, replays nothing; the
+// frame's seq tells the client where the room is now. Called from Run
+// only.
+func (h *Hub) resume(client *Client, hist *history) {
+	seq := h.sequences[client.room]
+	since := client.since
+	if since > seq {
+		since = seq
+	}
+	buffered := 0
+	if hist != nil {
+		buffered = hist.len()
+	}
+	// Sequence numbers within a room are contiguous, so the buffer holds
+	// exactly the last buffered of them.
+	oldest := seq - uint64(buffered) + 1
+	var lost uint64
+	if since+1 < oldest {
+		lost = oldest - since - 1
+	}
+	handshake, _ := json.Marshal(resumeFrame{
+		Type:  "resume",
+		Room:  client.room,
+		Seq:   seq,
+		Since: client.since,
+		Lost:  lost,
+	})
+	if !h.sendTo(client, textFrame(handshake)) || hist == nil {
+		return
+	}
+	var frames []frame
+	for _, message := range hist.last(buffered) {
+		if message.Seq > since && client.receives(message) {
+			frames = append(frames, frame{messageType: message.Type, data: message.Data})
+		}
+	}
+	h.queueReplay(client, frames)
+}
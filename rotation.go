@@ -0,0 +1,42 @@
+package main
+
+// rotation keeps a room's clients in join order so broadcasts can visit
+// them fairly. Map iteration order is random per range, but under
+// backpressure the clients visited first still get the buffer space and
+// the hub's patience; starting each broadcast one position further along
+// spreads that advantage evenly instead. It is only touched by the hub's
+// Run goroutine, which is also the only one that closes send channels, so
+// no shard lock is needed while delivering.
+type rotation struct {
+	clients []*Client
+	next    int
+}
+
+// add appends a client to the end of the order.
+func (r *rotation) add(client *Client) {
+	r.clients = append(r.clients, client)
+}
+
+// remove drops a client, keeping the relative order of the others.
+func (r *rotation) remove(client *Client) {
+	for i, c := range r.clients {
+		if c == client {
+			r.clients = append(r.clients[:i], r.clients[i+1:]...)
+			if r.next > i {
+				r.next--
+			}
+			break
+		}
+	}
+	if r.next >= len(r.clients) {
+		r.next = 0
+	}
+}
+
+// advance returns the index the next broadcast starts from, one position
+// after where the previous one started, wrapping around.
+func (r *rotation) advance() int {
+	start := r.next
+	r.next = (start + 1) % len(r.clients)
+	return start
+}
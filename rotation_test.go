@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRotationAdvanceAndRemove(t *testing.T) {
+	a, b, c, d := &Client{}, &Client{}, &Client{}, &Client{}
+	r := &rotation{}
+	for _, client := range []*Client{a, b, c, d} {
+		r.add(client)
+	}
+	for i, want := range []int{0, 1, 2} {
+		if got := r.advance(); got != want {
+			t.Fatalf("advance %d = %d, want %d", i, got, want)
+		}
+	}
+	// Removing a client before the next start keeps d next
+	r.remove(a)
+	if got := r.clients[r.advance()]; got != d {
+		t.Fatal("removing an earlier client skipped the next one")
+	}
+	if got := r.clients[r.advance()]; got != b {
+		t.Fatal("rotation did not wrap around")
+	}
+	r.remove(d)
+	r.remove(c)
+	if got := r.clients[r.advance()]; got != b {
+		t.Fatal("rotation did not reset after its tail was removed")
+	}
+}
+
+func TestBroadcastStartsAtEachMemberInTurn(t *testing.T) {
+	// With unbuffered sends and a blocking policy, the hub waits on each
+	// member in visit order while one consumer takes whichever frame is
+	// offered, so the consumer sees exactly the order the hub used.
+	config := DefaultHubConfig()
+	config.BackpressurePolicy = BackpressureBlock
+	config.BackpressureTimeout = 5 * time.Second
+	hub := startHub(t, config)
+	const members, broadcasts = 4, 40
+	cases := make([]reflect.SelectCase, members)
+	for i := range cases {
+		client := joinHub(t, newTestClient(hub, "r", fmt.Sprintf("user%d", i), 0))
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(client.send)}
+	}
+
+	for i := 0; i < broadcasts; i++ {
+		relay(hub, "r", "sender", []byte{byte(i)})
+	}
+	first := make([]int, members)
+	delivered := make([]int, members)
+	for n := 0; n < members*broadcasts; n++ {
+		chosen, value, _ := reflect.Select(cases)
+		if got := value.Interface().(frame).data[0]; got != byte(n/members) {
+			t.Fatalf("frame %d was broadcast %d, want %d", n, got, n/members)
+		}
+		delivered[chosen]++
+		if n%members == 0 {
+			first[chosen]++
+		}
+	}
+	for i := range first {
+		if delivered[i] != broadcasts {
+			t.Errorf("user%d received %d of %d broadcasts", i, delivered[i], broadcasts)
+		}
+		if first[i] != broadcasts/members {
+			t.Errorf("user%d was visited first %d times, want %d", i, first[i], broadcasts/members)
+		}
+	}
+}
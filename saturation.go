@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// broadcastBuffer is the capacity of the hub's broadcast channel.
+const broadcastBuffer = 256
+
+// saturationSampleInterval is how often watchBroadcast samples the depth
+// of the broadcast channel.
+const saturationSampleInterval = 250 * time.Millisecond
+
+// watchBroadcast samples the broadcast channel's depth until Run exits,
+// recording when it became saturated, i.e. at least SaturationThreshold
+// full, and clearing that once it drains. It runs on its own goroutine
+// because a saturated channel usually means Run itself is stuck fanning
+// out.
+func (h *Hub) watchBroadcast() {
+	ticker := time.NewTicker(saturationSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			saturated := h.broadcastSaturated()
+			h.mu.Lock()
+			switch {
+			case saturated && h.saturatedSince.IsZero():
+				h.saturatedSince = time.Now()
+				slog.Warn("Broadcast queue saturated", "event", "broadcast_saturated", "depth", len(h.broadcast), "capacity", cap(h.broadcast))
+			case !saturated && !h.saturatedSince.IsZero():
+				slog.Info("Broadcast queue recovered", "event", "broadcast_recovered", "saturated_for", time.Since(h.saturatedSince).Round(time.Millisecond).String())
+				h.saturatedSince = time.Time{}
+			}
+			h.mu.Unlock()
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// broadcastSaturated reports whether the broadcast channel is at least
+// SaturationThreshold full right now.
+func (h *Hub) broadcastSaturated() bool {
+	return float64(len(h.broadcast)) >= h.config.SaturationThreshold*float64(cap(h.broadcast))
+}
+
+// saturated reports whether the broadcast channel has stayed saturated for
+// at least SaturationPeriod. The caller must hold h.mu.
+func (h *Hub) saturated() bool {
+	return !h.saturatedSince.IsZero() && time.Since(h.saturatedSince) >= h.config.SaturationPeriod
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBroadcastQueueDepthReported(t *testing.T) {
+	// Nothing takes messages off the queue of a hub that is not running
+	hub := NewHub(DefaultHubConfig())
+	for i := 0; i < 200; i++ {
+		relay(hub, "r", "alice", []byte{byte(i)})
+	}
+	for _, endpoint := range []struct {
+		name    string
+		handler http.HandlerFunc
+		metrics func(map[string]interface{}) map[string]interface{}
+	}{
+		{"/health", HandleHealth(hub), func(body map[string]interface{}) map[string]interface{} {
+			metrics, _ := body["metrics"].(map[string]interface{})
+			return metrics
+		}},
+		{"/stats", HandleStats(hub), func(body map[string]interface{}) map[string]interface{} { return body }},
+	} {
+		w := httptest.NewRecorder()
+		endpoint.handler(w, httptest.NewRequest(http.MethodGet, endpoint.name, nil))
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: invalid JSON %q: %v", endpoint.name, w.Body.String(), err)
+		}
+		metrics := endpoint.metrics(body)
+		if depth, capacity := metrics["broadcast_queue_depth"], metrics["broadcast_queue_capacity"]; depth != 200.0 || capacity != float64(broadcastBuffer) {
+			t.Errorf("%s: queue depth %v of %v, want 200 of %d", endpoint.name, depth, capacity, broadcastBuffer)
+		}
+	}
+}
+
+func TestReadyFailsWhileBroadcastQueueSaturated(t *testing.T) {
+	// Run blocks delivering the first message to a client that reads
+	// nothing, so the queue behind it fills up
+	config := DefaultHubConfig()
+	config.BackpressurePolicy = BackpressureBlock
+	config.BackpressureTimeout = time.Minute
+	config.SaturationPeriod = 10 * time.Millisecond
+	hub := startHub(t, config)
+	stuck := joinHub(t, newTestClient(hub, "r", "stuck", 0))
+	t.Cleanup(func() {
+		go func() {
+			for range stuck.send {
+			}
+		}()
+	})
+
+	ready := func() (int, string) {
+		w := httptest.NewRecorder()
+		HandleReady(hub)(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		var body map[string]string
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body["status"]
+	}
+	if code, status := ready(); code != http.StatusOK {
+		t.Fatalf("/ready = %d %q before saturation, want 200", code, status)
+	}
+	for i := 0; i <= broadcastBuffer; i++ {
+		relay(hub, "r", "alice", []byte{byte(i)})
+	}
+	waitFor(t, "/ready to report saturation", func() bool {
+		code, status := ready()
+		return code == http.StatusServiceUnavailable && status == "saturated"
+	})
+	hub.mu.RLock()
+	since := hub.saturatedSince
+	hub.mu.RUnlock()
+	if since.IsZero() {
+		t.Error("saturatedSince not recorded")
+	}
+}
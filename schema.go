@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// With SCHEMA_FILE, every frame a JSON protocol client sends is checked
+// against a JSON Schema before it is relayed, and frames that do not
+// conform are answered with a schema_violation error frame instead. The
+// frame is checked as sent, before the server stamps from and ts.
+//
+// Only the validation keywords that describe message shapes are
+// supported: type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, minLength, maxLength,
+// pattern, minimum, maximum, exclusiveMinimum, exclusiveMaximum, allOf,
+// anyOf, oneOf and not. Annotations such as title and description are
+// ignored. Any other keyword, notably $ref, is refused when the schema is
+// loaded rather than silently not enforced. Patterns use Go's regexp
+// syntax, which covers what schemas commonly use.
+
+// JSONSchema is a compiled schema for JSON protocol frames.
+type JSONSchema struct {
+	root *schemaNode
+}
+
+// schemaNode is one compiled (sub)schema. A boolean schema is a node with
+// only always set: true accepts everything, false nothing.
+type schemaNode struct {
+	always *bool
+
+	types      []string
+	enum       []interface{}
+	constant   interface{}
+	hasConst   bool
+	properties map[string]*schemaNode
+	required   []string
+	additional *schemaNode
+	items      *schemaNode
+
+	minItems, maxItems   *int
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+
+	allOf, anyOf, oneOf []*schemaNode
+	not                 *schemaNode
+}
+
+// schemaAnnotations are keywords that do not affect validation.
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true,
+	"description": true, "default": true, "examples": true,
+	"deprecated": true, "readOnly": true, "writeOnly": true,
+}
+
+// schemaTypes are the values the type keyword accepts.
+var schemaTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// loadJSONSchema reads and compiles the schema at path. It returns nil
+// when path is empty.
+func loadJSONSchema(path string) (*JSONSchema, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema: %w", err)
+	}
+	v, err := decodeJSONValue(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %w", path, err)
+	}
+	root, err := compileSchema(v, "#")
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %w", path, err)
+	}
+	return &JSONSchema{root: root}, nil
+}
+
+// validate reports why data, a JSON document, does not conform to the
+// schema, or nil if it does.
+func (s *JSONSchema) validate(data []byte) error {
+	v, err := decodeJSONValue(data)
+	if err != nil {
+		return err
+	}
+	return s.root.validate(v, "")
+}
+
+// schemaViolation reports why data, a frame from a JSON protocol client,
+// does not conform to the schema, counting and logging it, or nil if it
+// does or there is no schema.
+func (h *Hub) schemaViolation(data []byte, username, room string) error {
+	schema := h.config.Schema
+	if schema == nil {
+		return nil
+	}
+	err := schema.validate(data)
+	if err == nil {
+		return nil
+	}
+	h.mu.Lock()
+	h.stats.SchemaRejections++
+	h.mu.Unlock()
+	slog.Info("Message rejected by schema", "event", "schema_violation", "username", username, "room", room, "error", err)
+	return err
+}
+
+// decodeJSONValue decodes a single JSON value, keeping numbers exact.
+func decodeJSONValue(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return v, nil
+}
+
+// compileSchema compiles the schema v found at path, e.g.
+// #/properties/payload, which locates errors in the schema file.
+func compileSchema(v interface{}, path string) (*schemaNode, error) {
+	if b, ok := v.(bool); ok {
+		return &schemaNode{always: &b}, nil
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: a schema must be an object or a boolean", path)
+	}
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	n := &schemaNode{}
+	for _, key := range keys {
+		value := obj[key]
+		at := path + "/" + key
+		var err error
+		switch key {
+		case "type":
+			n.types, err = schemaTypeList(value, at)
+		case "enum":
+			list, ok := value.([]interface{})
+			if !ok {
+				err = fmt.Errorf("%s: must be an array", at)
+			}
+			n.enum = list
+		case "const":
+			n.constant, n.hasConst = value, true
+		case "properties":
+			props, ok := value.(map[string]interface{})
+			if !ok {
+				err = fmt.Errorf("%s: must be an object", at)
+				break
+			}
+			n.properties = make(map[string]*schemaNode, len(props))
+			for name, sub := range props {
+				if n.properties[name], err = compileSchema(sub, at+"/"+name); err != nil {
+					break
+				}
+			}
+		case "required":
+			n.required, err = schemaStringList(value, at)
+		case "additionalProperties":
+			n.additional, err = compileSchema(value, at)
+		case "items":
+			n.items, err = compileSchema(value, at)
+		case "minItems":
+			n.minItems, err = schemaCount(value, at)
+		case "maxItems":
+			n.maxItems, err = schemaCount(value, at)
+		case "minLength":
+			n.minLength, err = schemaCount(value, at)
+		case "maxLength":
+			n.maxLength, err = schemaCount(value, at)
+		case "pattern":
+			s, ok := value.(string)
+			if !ok {
+				err = fmt.Errorf("%s: must be a string", at)
+				break
+			}
+			if n.pattern, err = regexp.Compile(s); err != nil {
+				err = fmt.Errorf("%s: %v", at, err)
+			}
+		case "minimum":
+			n.minimum, err = schemaNumber(value, at)
+		case "maximum":
+			n.maximum, err = schemaNumber(value, at)
+		case "exclusiveMinimum":
+			n.exclusiveMinimum, err = schemaNumber(value, at)
+		case "exclusiveMaximum":
+			n.exclusiveMaximum, err = schemaNumber(value, at)
+		case "allOf":
+			n.allOf, err = schemaList(value, at)
+		case "anyOf":
+			n.anyOf, err = schemaList(value, at)
+		case "oneOf":
+			n.oneOf, err = schemaList(value, at)
+		case "not":
+			n.not, err = compileSchema(value, at)
+		default:
+			if !schemaAnnotations[key] {
+				err = fmt.Errorf("%s: unsupported schema keyword %q", path, key)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func schemaTypeList(v interface{}, at string) ([]string, error) {
+	if s, ok := v.(string); ok {
+		v = []interface{}{s}
+	}
+	types, err := schemaStringList(v, at)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if !schemaTypes[t] {
+			return nil, fmt.Errorf("%s: unknown type %q", at, t)
+		}
+	}
+	return types, nil
+}
+
+func schemaStringList(v interface{}, at string) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: must be an array of strings", at)
+	}
+	out := make([]string, len(list))
+	for i, item := range list {
+		if out[i], ok = item.(string); !ok {
+			return nil, fmt.Errorf("%s: must be an array of strings", at)
+		}
+	}
+	return out, nil
+}
+
+func schemaList(v interface{}, at string) ([]*schemaNode, error) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%s: must be a non-empty array of schemas", at)
+	}
+	out := make([]*schemaNode, len(list))
+	for i, item := range list {
+		var err error
+		if out[i], err = compileSchema(item, at+"/"+strconv.Itoa(i)); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func schemaCount(v interface{}, at string) (*int, error) {
+	num, ok := v.(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("%s: must be a non-negative integer", at)
+	}
+	n, err := num.Int64()
+	if err != nil || n < 0 || n > math.MaxInt32 {
+		return nil, fmt.Errorf("%s: must be a non-negative integer", at)
+	}
+	count := int(n)
+	return &count, nil
+}
+
+func schemaNumber(v interface{}, at string) (*float64, error) {
+	num, ok := v.(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("%s: must be a number", at)
+	}
+	f, err := num.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("%s: must be a number", at)
+	}
+	return &f, nil
+}
+
+// validate reports the first way v, found at the JSON pointer path, fails
+// the schema.
+func (n *schemaNode) validate(v interface{}, path string) error {
+	if n.always != nil {
+		if !*n.always {
+			return schemaErrorf(path, "no value is allowed here")
+		}
+		return nil
+	}
+	if len(n.types) > 0 && !matchesSchemaType(v, n.types) {
+		return schemaErrorf(path, "expected %s, got %s", strings.Join(n.types, " or "), jsonTypeOf(v))
+	}
+	if n.hasConst && !jsonEqual(v, n.constant) {
+		return schemaErrorf(path, "must be %s", compactJSON(n.constant))
+	}
+	if n.enum != nil {
+		found := false
+		for _, allowed := range n.enum {
+			if jsonEqual(v, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return schemaErrorf(path, "must be one of %s", compactJSON(n.enum))
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range n.required {
+			if _, ok := v[name]; !ok {
+				return schemaErrorf(path, "missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sub, ok := n.properties[name]
+			if !ok {
+				sub = n.additional
+			}
+			if sub == nil {
+				continue
+			}
+			if err := sub.validate(v[name], path+"/"+escapePointer(name)); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if n.minItems != nil && len(v) < *n.minItems {
+			return schemaErrorf(path, "must have at least %d items", *n.minItems)
+		}
+		if n.maxItems != nil && len(v) > *n.maxItems {
+			return schemaErrorf(path, "must have at most %d items", *n.maxItems)
+		}
+		if n.items != nil {
+			for i, item := range v {
+				if err := n.items.validate(item, path+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if n.minLength != nil && length < *n.minLength {
+			return schemaErrorf(path, "must be at least %d characters long", *n.minLength)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			return schemaErrorf(path, "must be at most %d characters long", *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(v) {
+			return schemaErrorf(path, "must match %q", n.pattern.String())
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if n.minimum != nil && f < *n.minimum {
+			return schemaErrorf(path, "must be at least %v", *n.minimum)
+		}
+		if n.maximum != nil && f > *n.maximum {
+			return schemaErrorf(path, "must be at most %v", *n.maximum)
+		}
+		if n.exclusiveMinimum != nil && f <= *n.exclusiveMinimum {
+			return schemaErrorf(path, "must be greater than %v", *n.exclusiveMinimum)
+		}
+		if n.exclusiveMaximum != nil && f >= *n.exclusiveMaximum {
+			return schemaErrorf(path, "must be less than %v", *n.exclusiveMaximum)
+		}
+	}
+
+	for _, sub := range n.allOf {
+		if err := sub.validate(v, path); err != nil {
+			return err
+		}
+	}
+	if n.anyOf != nil {
+		matched := false
+		for _, sub := range n.anyOf {
+			if sub.validate(v, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return schemaErrorf(path, "matches none of the anyOf schemas")
+		}
+	}
+	if n.oneOf != nil {
+		matches := 0
+		for _, sub := range n.oneOf {
+			if sub.validate(v, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return schemaErrorf(path, "must match exactly one of the oneOf schemas, matches %d", matches)
+		}
+	}
+	if n.not != nil && n.not.validate(v, path) == nil {
+		return schemaErrorf(path, "matches a schema it must not")
+	}
+	return nil
+}
+
+// schemaErrorf describes a schema violation at the JSON pointer path.
+func schemaErrorf(path, format string, args ...interface{}) error {
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...))
+}
+
+// escapePointer escapes a property name for use in a JSON pointer.
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+// matchesSchemaType reports whether v is of any of types. Whole numbers
+// count as integers however they are written, e.g. 1.0.
+func matchesSchemaType(v interface{}, types []string) bool {
+	actual := jsonTypeOf(v)
+	for _, t := range types {
+		if t == actual {
+			return true
+		}
+		if num, ok := v.(json.Number); ok && t == "integer" {
+			if f, err := num.Float64(); err == nil && f == math.Trunc(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonTypeOf names the JSON type of a value decoded with UseNumber.
+func jsonTypeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// jsonEqual reports whether two decoded JSON values are equal, comparing
+// numbers by value so 1 and 1.0 are the same.
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fa, errA := a.Float64()
+		fb, errB := b.Float64()
+		return errA == nil && errB == nil && fa == fb
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+// compactJSON renders a schema value for an error message.
+func compactJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// mustCompileSchema compiles a schema given as JSON text.
+func mustCompileSchema(tb testing.TB, schema string) *JSONSchema {
+	tb.Helper()
+	v, err := decodeJSONValue([]byte(schema))
+	if err != nil {
+		tb.Fatalf("schema %s: %v", schema, err)
+	}
+	root, err := compileSchema(v, "#")
+	if err != nil {
+		tb.Fatalf("schema %s: %v", schema, err)
+	}
+	return &JSONSchema{root: root}
+}
+
+func TestSchemaKeywords(t *testing.T) {
+	tests := []struct {
+		keyword string
+		schema  string
+		doc     string
+		valid   bool
+	}{
+		{"type", `{"type":"string"}`, `"hi"`, true},
+		{"type", `{"type":"string"}`, `1`, false},
+		{"type", `{"type":["string","null"]}`, `null`, true},
+		{"type", `{"type":["string","null"]}`, `false`, false},
+		{"type", `{"type":"integer"}`, `3`, true},
+		{"type", `{"type":"integer"}`, `3.0`, true},
+		{"type", `{"type":"integer"}`, `3.5`, false},
+		{"type", `{"type":"number"}`, `3.5`, true},
+		{"type", `{"type":"object"}`, `[]`, false},
+		{"type", `{"type":"array"}`, `[]`, true},
+		{"type", `{"type":"boolean"}`, `true`, true},
+
+		{"enum", `{"enum":["chat","join",1]}`, `"join"`, true},
+		{"enum", `{"enum":["chat","join",1]}`, `1.0`, true},
+		{"enum", `{"enum":["chat","join",1]}`, `"leave"`, false},
+		{"enum", `{"enum":[{"a":[1]}]}`, `{"a":[1]}`, true},
+		{"enum", `{"enum":[{"a":[1]}]}`, `{"a":[2]}`, false},
+
+		{"const", `{"const":"chat"}`, `"chat"`, true},
+		{"const", `{"const":"chat"}`, `"Chat"`, false},
+		{"const", `{"const":null}`, `null`, true},
+		{"const", `{"const":null}`, `0`, false},
+
+		{"properties", `{"properties":{"n":{"type":"integer"}}}`, `{"n":1}`, true},
+		{"properties", `{"properties":{"n":{"type":"integer"}}}`, `{"n":"1"}`, false},
+		{"properties", `{"properties":{"n":{"type":"integer"}}}`, `{}`, true},
+		{"properties", `{"properties":{"n":{"type":"integer"}}}`, `"not an object"`, true},
+
+		{"required", `{"required":["type","payload"]}`, `{"type":"chat","payload":1}`, true},
+		{"required", `{"required":["type","payload"]}`, `{"type":"chat"}`, false},
+		{"required", `{"required":["type"]}`, `{"type":null}`, true},
+
+		{"additionalProperties", `{"properties":{"a":true},"additionalProperties":false}`, `{"a":1}`, true},
+		{"additionalProperties", `{"properties":{"a":true},"additionalProperties":false}`, `{"a":1,"b":2}`, false},
+		{"additionalProperties", `{"additionalProperties":{"type":"string"}}`, `{"x":"y"}`, true},
+		{"additionalProperties", `{"additionalProperties":{"type":"string"}}`, `{"x":1}`, false},
+
+		{"items", `{"items":{"type":"integer"}}`, `[1,2,3]`, true},
+		{"items", `{"items":{"type":"integer"}}`, `[1,"2"]`, false},
+		{"items", `{"items":false}`, `[]`, true},
+		{"items", `{"items":false}`, `[null]`, false},
+		{"minItems", `{"minItems":2}`, `[1]`, false},
+		{"maxItems", `{"maxItems":2}`, `[1,2]`, true},
+		{"maxItems", `{"maxItems":2}`, `[1,2,3]`, false},
+
+		{"minLength", `{"minLength":2}`, `"ab"`, true},
+		{"minLength", `{"minLength":2}`, `"a"`, false},
+		{"minLength", `{"minLength":2}`, `"é"`, false},
+		{"maxLength", `{"maxLength":2}`, `"éé"`, true},
+		{"maxLength", `{"maxLength":2}`, `"abc"`, false},
+
+		{"minimum", `{"minimum":1}`, `1`, true},
+		{"minimum", `{"minimum":1}`, `0.99`, false},
+		{"maximum", `{"maximum":10}`, `10`, true},
+		{"maximum", `{"maximum":10}`, `10.5`, false},
+		{"exclusiveMinimum", `{"exclusiveMinimum":1}`, `1`, false},
+		{"exclusiveMinimum", `{"exclusiveMinimum":1}`, `1.01`, true},
+		{"exclusiveMaximum", `{"exclusiveMaximum":10}`, `10`, false},
+		{"exclusiveMaximum", `{"exclusiveMaximum":10}`, `9`, true},
+		{"minimum", `{"minimum":1}`, `"0"`, true},
+
+		{"pattern", `{"pattern":"^[a-z]+$"}`, `"chat"`, true},
+		{"pattern", `{"pattern":"^[a-z]+$"}`, `"Chat"`, false},
+		{"pattern", `{"pattern":"a"}`, `"banana"`, true},
+
+		{"allOf", `{"allOf":[{"type":"integer"},{"minimum":5}]}`, `7`, true},
+		{"allOf", `{"allOf":[{"type":"integer"},{"minimum":5}]}`, `3`, false},
+		{"anyOf", `{"anyOf":[{"type":"string"},{"minimum":5}]}`, `"x"`, true},
+		{"anyOf", `{"anyOf":[{"type":"string"},{"minimum":5}]}`, `9`, true},
+		{"anyOf", `{"anyOf":[{"type":"string"},{"type":"null"}]}`, `9`, false},
+		{"oneOf", `{"oneOf":[{"type":"integer"},{"minimum":5}]}`, `3`, true},
+		{"oneOf", `{"oneOf":[{"type":"integer"},{"minimum":5}]}`, `7`, false},
+		{"oneOf", `{"oneOf":[{"type":"integer"},{"minimum":5}]}`, `"x"`, true},
+		{"oneOf", `{"oneOf":[{"type":"integer"},{"type":"string"}]}`, `null`, false},
+		{"not", `{"not":{"type":"null"}}`, `1`, true},
+		{"not", `{"not":{"type":"null"}}`, `null`, false},
+
+		{"boolean schema", `true`, `{"anything":[1]}`, true},
+		{"boolean schema", `false`, `1`, false},
+		{"annotations", `{"title":"t","description":"d","$schema":"x","type":"string"}`, `"s"`, true},
+	}
+	for _, tt := range tests {
+		err := mustCompileSchema(t, tt.schema).validate([]byte(tt.doc))
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: schema %s on %s = %v, want valid %t", tt.keyword, tt.schema, tt.doc, err, tt.valid)
+		}
+	}
+}
+
+func TestSchemaErrorsLocateTheViolation(t *testing.T) {
+	schema := mustCompileSchema(t, `{"properties":{"payload":{"properties":{"tags":{"items":{"type":"string"}}}}}}`)
+	err := schema.validate([]byte(`{"payload":{"tags":["a",2]}}`))
+	if err == nil || !strings.HasPrefix(err.Error(), "/payload/tags/1: ") {
+		t.Errorf("error = %v, want it located at /payload/tags/1", err)
+	}
+}
+
+func TestSchemaRefusedAtLoadTime(t *testing.T) {
+	tests := []struct {
+		schema string
+		want   string
+	}{
+		{`{"$ref":"#/definitions/msg"}`, `unsupported schema keyword "$ref"`},
+		{`{"properties":{"payload":{"$ref":"#"}}}`, `#/properties/payload: unsupported schema keyword "$ref"`},
+		{`{"anyOf":[{"type":"string"},{"$ref":"#"}]}`, `#/anyOf/1: unsupported schema keyword "$ref"`},
+		{`{"patternProperties":{}}`, `unsupported schema keyword "patternProperties"`},
+		{`{"type":"text"}`, `unknown type "text"`},
+		{`{"type":7}`, `must be an array of strings`},
+		{`{"enum":"chat"}`, `must be an array`},
+		{`{"required":"type"}`, `must be an array of strings`},
+		{`{"minLength":-1}`, `must be a non-negative integer`},
+		{`{"maxItems":1.5}`, `must be a non-negative integer`},
+		{`{"minimum":"1"}`, `must be a number`},
+		{`{"pattern":"("}`, `#/pattern`},
+		{`{"allOf":[]}`, `must be a non-empty array of schemas`},
+		{`{"not":1}`, `a schema must be an object or a boolean`},
+		{`[]`, `a schema must be an object or a boolean`},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		path := filepath.Join(dir, "schema.json")
+		if err := os.WriteFile(path, []byte(tt.schema), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		schema, err := loadJSONSchema(path)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%d: loading %s = %v, %v; want an error containing %q", i, tt.schema, schema, err, tt.want)
+		}
+	}
+	if schema, err := loadJSONSchema(""); schema != nil || err != nil {
+		t.Errorf("loadJSONSchema(\"\") = %v, %v; want no schema", schema, err)
+	}
+}
+
+func TestSchemaViolationsAreNotRelayed(t *testing.T) {
+	schema := mustCompileSchema(t, `{
+		"type": "object",
+		"required": ["type", "payload"],
+		"properties": {"type": {"enum": ["chat"]}, "payload": {"type": "string", "maxLength": 10}}
+	}`)
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.Schema = schema })
+	receiver := srv.connect(t, "r", "bob", "")
+	sender := srv.connect(t, "r", "alice", "protocol=json")
+
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","payload":"far too long to pass"}`))
+	_, data := readFrame(t, sender)
+	if f := decodeErrorFrame(t, data); f.Reason != "schema_violation" || !strings.HasPrefix(f.Detail, "/payload: ") {
+		t.Errorf("violation answered with %s", data)
+	}
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","payload":"hi"}`))
+	if _, data := readFrame(t, receiver); !strings.Contains(string(data), `"payload":"hi"`) {
+		t.Errorf("bob received %s, want only the conforming message", data)
+	}
+	if n := hubStats(srv.hub).SchemaRejections; n != 1 {
+		t.Errorf("SchemaRejections = %d, want 1", n)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// hubShard holds the clients whose usernames hash to it, so lookups and
+// membership changes for different users don't contend on a single lock.
+// A room's members are spread across all shards.
+type hubShard struct {
+	mu      sync.RWMutex
+	clients map[string]map[string]*Client // room -> username -> client
+}
+
+func newShards(n int) []*hubShard {
+	shards := make([]*hubShard, n)
+	for i := range shards {
+		shards[i] = &hubShard{clients: make(map[string]map[string]*Client)}
+	}
+	return shards
+}
+
+// shardFor returns the shard that owns username.
+func (h *Hub) shardFor(username string) *hubShard {
+	f := fnv.New32a()
+	f.Write([]byte(username))
+	return h.shards[f.Sum32()%uint32(len(h.shards))]
+}
+
+// lookup returns the client connected as username in room, or nil.
+func (h *Hub) lookup(room, username string) *Client {
+	s := h.shardFor(username)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.clients[room][username]
+}
+
+// addClient puts the client in its shard. It reports false if another
+// connection claimed the username in the meantime. Called from Run only.
+func (h *Hub) addClient(client *Client) bool {
+	s := h.shardFor(client.username)
+	s.mu.Lock()
+	room, ok := s.clients[client.room]
+	if !ok {
+		room = make(map[string]*Client)
+		s.clients[client.room] = room
+	}
+	if _, taken := room[client.username]; taken {
+		s.mu.Unlock()
+		return false
+	}
+	room[client.username] = client
+	s.mu.Unlock()
+
+	r, ok := h.rotations[client.room]
+	if !ok {
+		r = &rotation{}
+		h.rotations[client.room] = r
+	}
+	r.add(client)
+
+	h.mu.Lock()
+	h.connected++
+	if client.compressed {
+		h.stats.CompressedConnections++
+	}
+	h.stats.TotalConnections++
+	if h.connected > h.stats.PeakConnections {
+		h.stats.PeakConnections = h.connected
+		h.stats.PeakTime = time.Now()
+	}
+	h.mu.Unlock()
+	return true
+}
+
+// removeClient deletes the client from its room and closes its send channel.
+// It is a no-op if the client was already removed or its username has since
+// been taken by another connection, so send is closed exactly once.
+// Called from Run only.
+func (h *Hub) removeClient(client *Client) bool {
+	s := h.shardFor(client.username)
+	s.mu.Lock()
+	room := s.clients[client.room]
+	if room[client.username] != client {
+		s.mu.Unlock()
+		return false
+	}
+	delete(room, client.username)
+	if farewell := client.takeFarewell(); farewell != nil {
+		trySend(client, textFrame(farewell))
+	}
+	close(client.send)
+	if len(room) == 0 {
+		delete(s.clients, client.room)
+	}
+	s.mu.Unlock()
+
+	if r, ok := h.rotations[client.room]; ok {
+		r.remove(client)
+		if len(r.clients) == 0 {
+			delete(h.rotations, client.room)
+		}
+	}
+
+	h.mu.Lock()
+	h.connected--
+	if client.compressed {
+		h.stats.CompressedConnections--
+	}
+	h.mu.Unlock()
+
+	if !h.roomExists(client.room) {
+		delete(h.history, client.room)
+	}
+	return true
+}
+
+// roomExists reports whether any shard has clients in room.
+func (h *Hub) roomExists(room string) bool {
+	for _, s := range h.shards {
+		s.mu.RLock()
+		_, ok := s.clients[room]
+		s.mu.RUnlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// forEachInRoom calls fn for every client in room, one shard at a time with
+// that shard's read lock held, so fn may safely send to client.send but must
+// not add or remove clients.
+func (h *Hub) forEachInRoom(room string, fn func(*Client)) {
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for _, client := range s.clients[room] {
+			fn(client)
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// forEachClient calls fn for every connected client with the same locking
+// as forEachInRoom.
+func (h *Hub) forEachClient(fn func(*Client)) {
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for _, room := range s.clients {
+			for _, client := range room {
+				fn(client)
+			}
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// sendTo queues a frame for a single client without blocking, provided it
+// is still connected. It reports whether the frame was queued.
+func (h *Hub) sendTo(client *Client, f frame) bool {
+	s := h.shardFor(client.username)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.clients[client.room][client.username] != client {
+		return false
+	}
+	return trySend(client, f)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestShardsSpreadUsersAndRoomsSpanShards(t *testing.T) {
+	config := DefaultHubConfig()
+	config.Shards = 4
+	hub := startHub(t, config)
+	for i := 0; i < 40; i++ {
+		joinHub(t, newTestClient(hub, "r", fmt.Sprintf("user%d", i), 1))
+	}
+	for i, s := range hub.shards {
+		s.mu.RLock()
+		n := len(s.clients["r"])
+		s.mu.RUnlock()
+		if n == 0 {
+			t.Errorf("shard %d holds none of 40 users", i)
+		}
+	}
+	relay(hub, "r", "user0", []byte("hi"))
+	for i := 1; i < 40; i++ {
+		client := hub.lookup("r", fmt.Sprintf("user%d", i))
+		waitFor(t, client.username+" to receive the message", func() bool { return len(client.send) == 1 })
+	}
+}
+
+// benchmarkFanOut measures how long the hub takes to deliver one message to
+// each of clients receivers in a room. Each receiver drains its send buffer
+// on its own goroutine, as its WritePump would. If during is set, it runs
+// alongside until the benchmark ends.
+func benchmarkFanOut(b *testing.B, config HubConfig, clients int, during func(hub *Hub, stop <-chan struct{})) {
+	config.SendBuffer = 16
+	hub := startHub(b, config)
+	var delivered sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		client := newTestClient(hub, "r", fmt.Sprintf("user%d", i), config.SendBuffer)
+		hub.register <- client
+		go func() {
+			for range client.send {
+				delivered.Done()
+			}
+		}()
+	}
+	waitFor(b, "receivers to register", func() bool {
+		hub.mu.RLock()
+		defer hub.mu.RUnlock()
+		return hub.clientCount() == clients
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if during != nil {
+		go during(hub, stop)
+	}
+	data := []byte("tick")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		delivered.Add(clients)
+		relay(hub, "r", "sender", data)
+		delivered.Wait()
+	}
+	b.StopTimer()
+}
+
+// BenchmarkFanOutShards compares fan-out to 5k clients with one shard, as
+// before sharding, and with the default of one per CPU, while other
+// goroutines look clients up as connection handlers do.
+func BenchmarkFanOutShards(b *testing.B) {
+	counts := []int{1}
+	if n := runtime.GOMAXPROCS(0); n > 1 {
+		counts = append(counts, n)
+	}
+	for _, shards := range counts {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			config := DefaultHubConfig()
+			config.Shards = shards
+			lookups := func(hub *Hub, stop <-chan struct{}) {
+				var wg sync.WaitGroup
+				for g := 0; g < runtime.GOMAXPROCS(0); g++ {
+					wg.Add(1)
+					go func(g int) {
+						defer wg.Done()
+						for i := g; ; i++ {
+							select {
+							case <-stop:
+								return
+							default:
+							}
+							hub.lookup("r", fmt.Sprintf("user%d", i%5000))
+						}
+					}(g)
+				}
+				wg.Wait()
+			}
+			benchmarkFanOut(b, config, 5000, lookups)
+		})
+	}
+}
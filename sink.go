@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// MessageSink archives relayed messages, e.g. for auditing. The hub hands
+// messages over through a buffered channel and calls Store from a single
+// goroutine, so a slow sink never delays the relay; messages arriving
+// while the buffer is full are dropped and counted instead.
+type MessageSink interface {
+	Store(Message) error
+}
+
+// Sink kinds selected with SINK
+const (
+	SinkNone = "none"
+	SinkFile = "file"
+)
+
+// archiveBuffer is how many messages may wait for the sink.
+const archiveBuffer = 4096
+
+// newSink returns the sink selected by kind.
+func newSink(kind, path string) (MessageSink, error) {
+	if err := checkSink(kind, path); err != nil {
+		return nil, err
+	}
+	if kind == SinkFile {
+		return openFileSink(path)
+	}
+	return NopSink{}, nil
+}
+
+// checkSink reports whether newSink would accept kind and path, without
+// opening anything.
+func checkSink(kind, path string) error {
+	switch kind {
+	case SinkNone:
+		return nil
+	case SinkFile:
+		if path == "" {
+			return fmt.Errorf("SINK_PATH is required with SINK=%s", SinkFile)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid sink %q: must be %s or %s", kind, SinkNone, SinkFile)
+	}
+}
+
+// NopSink discards every message. It is the default, and the hub skips
+// archiving altogether when it is configured.
+type NopSink struct{}
+
+// Store implements MessageSink.
+func (NopSink) Store(Message) error { return nil }
+
+// FileSink appends each message to a file as one JSON object per line.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+}
+
+// sinkRecord is the JSON line written for a message. Data is base64
+// encoded, since payloads may be binary.
+type sinkRecord struct {
+	TS   time.Time `json:"ts"`
+	Room string    `json:"room"`
+	From string    `json:"from"`
+	Type int       `json:"type"`
+	Data []byte    `json:"data"`
+
+	Topic string `json:"topic,omitempty"`
+	Seq   uint64 `json:"seq,omitempty"`
+}
+
+func openFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening sink file: %w", err)
+	}
+	return &FileSink{file: file, buf: bufio.NewWriter(file)}, nil
+}
+
+// Store implements MessageSink. Lines are buffered and flushed by Flush
+// and Close.
+func (s *FileSink) Store(m Message) error {
+	line, err := json.Marshal(sinkRecord{
+		TS:   m.Received.UTC(),
+		Room: m.Room,
+		From: m.From,
+		Type: m.Type,
+		Data: m.Data,
+
+		Topic: m.Topic,
+		Seq:   m.Seq,
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf.Write(line)
+	return s.buf.WriteByte('\n')
+}
+
+// Flush writes buffered lines to the file.
+func (s *FileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+// Close flushes buffered lines and closes the file.
+func (s *FileSink) Close() error {
+	if err := s.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// archiveMessage hands a message to the sink without blocking. Called from
+// Run only.
+func (h *Hub) archiveMessage(m Message) {
+	if h.archive == nil {
+		return
+	}
+	select {
+	case h.archive <- m:
+	default:
+		h.mu.Lock()
+		h.stats.SinkDropped++
+		h.mu.Unlock()
+	}
+}
+
+// runArchive stores queued messages until Run closes the archive channel,
+// flushing whenever the queue runs empty.
+func (h *Hub) runArchive() {
+	defer close(h.archived)
+	flusher, _ := h.config.Sink.(interface{ Flush() error })
+	for m := range h.archive {
+		h.store(m, flusher)
+	}
+}
+
+// store archives m, flushing if nothing else is waiting. A panicking sink
+// loses the message but not the archive goroutine.
+func (h *Hub) store(m Message, flusher interface{ Flush() error }) {
+	defer h.recoverPanic("sink")
+	if err := h.config.Sink.Store(m); err != nil {
+		slog.Error("Message sink failed", "event", "sink_error", "room", m.Room, "username", m.From, "error", err)
+	}
+	if flusher != nil && len(h.archive) == 0 {
+		if err := flusher.Flush(); err != nil {
+			slog.Error("Message sink flush failed", "event", "sink_error", "error", err)
+		}
+	}
+}
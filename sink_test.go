@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFileSinkArchivesRelayedMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	sink, err := newSink(SinkFile, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultHubConfig()
+	config.Sink = sink
+	hub := startHub(t, config)
+	joinHub(t, newTestClient(hub, "r", "bob", 8))
+
+	hub.broadcast <- Message{Room: "r", From: "alice", Type: websocket.TextMessage, Data: []byte("hello"), Received: time.Now()}
+	relay(hub, "r", "alice", []byte{0, 0xff})
+	waitFor(t, "both messages to be relayed", func() bool { return hubStats(hub).TotalMessages == 2 })
+
+	// Shutdown waits for the archive to drain
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := hub.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.(*FileSink).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []sinkRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record sinkRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("line %q is not JSON: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("archived %d messages, want 2", len(records))
+	}
+	want := []struct {
+		messageType int
+		data        string
+	}{{websocket.TextMessage, "hello"}, {websocket.BinaryMessage, "\x00\xff"}}
+	for i, record := range records {
+		if record.Room != "r" || record.From != "alice" || record.TS.IsZero() {
+			t.Errorf("record %d = %+v, want room r from alice with a timestamp", i, record)
+		}
+		if record.Type != want[i].messageType || string(record.Data) != want[i].data {
+			t.Errorf("record %d has type %d data %q, want type %d data %q", i, record.Type, record.Data, want[i].messageType, want[i].data)
+		}
+	}
+	if got := hubStats(hub).SinkDropped; got != 0 {
+		t.Errorf("SinkDropped = %d, want 0", got)
+	}
+}
+
+func TestCheckSink(t *testing.T) {
+	tests := []struct {
+		kind, path string
+		valid      bool
+	}{
+		{SinkNone, "", true},
+		{SinkFile, "/var/log/relay.jsonl", true},
+		{SinkFile, "", false},
+		{"kafka", "", false},
+	}
+	for _, tt := range tests {
+		if err := checkSink(tt.kind, tt.path); (err == nil) != tt.valid {
+			t.Errorf("checkSink(%q, %q) = %v, want valid %t", tt.kind, tt.path, err, tt.valid)
+		}
+	}
+}
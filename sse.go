@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// HandleSSE streams a room's messages as Server-Sent Events to consumers
+// such as dashboards that cannot use WebSockets. The connection joins the
+// room as a receive-only client, so it counts towards MaxClients, shows up
+// in presence and can be kicked like any other. Its send channel is
+// drained here instead of by WritePump, and the client is unregistered
+// once the request ends.
+//
+// Text frames become "data:" events, one line per payload line; binary
+// frames become "binary" events carrying the payload in base64.
+func HandleSSE(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkRequestURI(w, r) {
+			return
+		}
+		vars := mux.Vars(r)
+		username := vars["username"]
+		room := vars["room"]
+		if room == "" {
+			room = defaultRoom
+		}
+		if err := validateUsername(username); err != nil {
+			http.Error(w, "Invalid username: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ip := hub.clientIP(r)
+		if !checkBan(w, hub, username, ip) {
+			return
+		}
+		if _, ok := w.(http.Flusher); !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		replay := -1
+		if value := r.URL.Query().Get("replay"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				http.Error(w, "replay must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			replay = n
+		}
+		metadata, err := parseMetadata(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if hub.lookup(room, username) != nil {
+			http.Error(w, "Username already connected", http.StatusConflict)
+			return
+		}
+		hub.mu.RLock()
+		if hub.closing {
+			hub.mu.RUnlock()
+			http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if hub.draining {
+			hub.mu.RUnlock()
+			http.Error(w, "Server draining", http.StatusServiceUnavailable)
+			return
+		}
+		if hub.config.MaxClients > 0 && hub.clientCount() >= hub.config.MaxClients {
+			hub.mu.RUnlock()
+			http.Error(w, "Server at connection capacity", http.StatusServiceUnavailable)
+			return
+		}
+		hub.mu.RUnlock()
+		if !checkIPLimit(w, hub, ip) {
+			return
+		}
+		defer hub.ipLimits.release(ip)
+
+		client := &Client{
+			send:     make(chan frame, hub.config.SendBuffer),
+			username: username,
+			room:     room,
+			mode:     ModeSubscriber,
+			protocol: ProtocolRaw,
+			hub:      hub,
+
+			replay:   replay,
+			presence: r.URL.Query().Get("presence") == "1",
+			metadata: metadata,
+
+			remoteAddr:  r.RemoteAddr,
+			ip:          ip,
+			connectedAt: time.Now(),
+		}
+		client.writeBandwidth = newBandwidthBucket(hub.config.MaxConnBytesPerSec)
+
+		hub.pumps.Add(1)
+		defer hub.pumps.Done()
+		select {
+		case hub.register <- client:
+		case <-hub.done:
+			http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer client.releaseQueued()
+		defer func() {
+			select {
+			case hub.unregister <- client:
+			case <-hub.done:
+			}
+		}()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		ticker := time.NewTicker(hub.config.PingInterval)
+		defer ticker.Stop()
+		var lifetime <-chan time.Time
+		if maxLifetime := hub.config.MaxConnLifetime; maxLifetime > 0 {
+			lifetimeTimer := time.NewTimer(maxLifetime)
+			defer lifetimeTimer.Stop()
+			lifetime = lifetimeTimer.C
+		}
+		var buf bytes.Buffer
+		for {
+			buf.Reset()
+			select {
+			case f, ok := <-client.send:
+				if !ok {
+					// Removed by the hub: kicked or shutting down, or the
+					// username was taken before this client registered
+					return
+				}
+				client.dequeued(f)
+				if client.expired(f) {
+					continue
+				}
+				// A paced replay backlog is written at once; the stream's
+				// own flow control paces it
+				frames := []frame{f}
+				if f.backlog != nil {
+					frames = f.backlog
+				}
+				size := 0
+				for _, f := range frames {
+					writeSSEEvent(&buf, f)
+					size += len(f.data)
+				}
+				rc.SetWriteDeadline(time.Now().Add(hub.config.WriteWait))
+				if _, err := w.Write(buf.Bytes()); err != nil {
+					client.logWriteError(err)
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					client.logWriteError(err)
+					return
+				}
+				client.countSent(len(frames), size)
+
+			case <-ticker.C:
+				// A comment line keeps proxies from timing out the stream
+				rc.SetWriteDeadline(time.Now().Add(hub.config.WriteWait))
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+
+			case <-lifetime:
+				// Ending the response makes EventSource reconnect,
+				// possibly to another instance
+				slog.Debug("Connection recycled: max lifetime reached", "event", "max_lifetime", "username", username, "room", room)
+				return
+
+			case <-r.Context().Done():
+				slog.Debug("SSE client went away", "event", "sse_disconnect", "username", username, "room", room)
+				return
+			}
+		}
+	}
+}
+
+// writeSSEEvent encodes f as a Server-Sent Event.
+func writeSSEEvent(buf *bytes.Buffer, f frame) {
+	if f.messageType == websocket.BinaryMessage {
+		buf.WriteString("event: binary\ndata: ")
+		buf.WriteString(base64.StdEncoding.EncodeToString(f.data))
+		buf.WriteString("\n\n")
+		return
+	}
+	for _, line := range bytes.Split(f.data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimSuffix(line, []byte("\r")))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+}
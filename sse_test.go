@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sseEvent is an event read off a stream: its name, empty for plain
+// events, and its data lines. Comments have only a comment.
+type sseEvent struct {
+	name    string
+	data    []string
+	comment string
+}
+
+// sseStream is an open event stream.
+type sseStream struct {
+	resp   *http.Response
+	events chan sseEvent
+	cancel context.CancelFunc
+}
+
+// openSSE requests the stream of room for username and waits until the
+// hub has registered it. The stream is closed when the test ends.
+func (s *testServer) openSSE(tb testing.TB, room, username string) *sseStream {
+	tb.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/sse/"+room+"/"+username, nil)
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		tb.Fatalf("open stream: %v", err)
+	}
+	tb.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		tb.Fatalf("open stream: HTTP %d", resp.StatusCode)
+	}
+	waitFor(tb, username+" to register", func() bool {
+		return s.hub.lookup(room, username) != nil
+	})
+
+	stream := &sseStream{resp: resp, events: make(chan sseEvent, 64), cancel: cancel}
+	go func() {
+		defer close(stream.events)
+		scanner := bufio.NewScanner(resp.Body)
+		var ev sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				stream.events <- ev
+				ev = sseEvent{}
+			case strings.HasPrefix(line, ":"):
+				ev.comment = strings.TrimSpace(line[1:])
+			case strings.HasPrefix(line, "event: "):
+				ev.name = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				ev.data = append(ev.data, line[len("data: "):])
+			}
+		}
+	}()
+	return stream
+}
+
+// next returns the next event that is not a comment, failing the test if
+// none arrives within a few seconds.
+func (s *sseStream) next(tb testing.TB) sseEvent {
+	tb.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev, ok := <-s.events:
+			if !ok {
+				tb.Fatal("stream ended")
+			}
+			if ev.comment == "" {
+				return ev
+			}
+		case <-timeout:
+			tb.Fatal("timed out waiting for an event")
+		}
+	}
+}
+
+func TestSSEStreamsRoomMessages(t *testing.T) {
+	srv := newTestServer(t, nil)
+	stream := srv.openSSE(t, "r", "dashboard")
+	if got := stream.resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+	alice := srv.connect(t, "r", "alice", "")
+	carol := srv.connect(t, "other", "carol", "")
+
+	alice.WriteMessage(websocket.TextMessage, []byte("first line\r\nsecond line"))
+	if ev := stream.next(t); ev.name != "" || strings.Join(ev.data, "|") != "first line|second line" {
+		t.Errorf("text message became %+v, want one data line per payload line", ev)
+	}
+	alice.WriteMessage(websocket.BinaryMessage, []byte{0, 1, 0xff})
+	if ev := stream.next(t); ev.name != "binary" || len(ev.data) != 1 || ev.data[0] != base64.StdEncoding.EncodeToString([]byte{0, 1, 0xff}) {
+		t.Errorf("binary message became %+v, want a binary event in base64", ev)
+	}
+
+	// Messages of other rooms are not streamed, so the next event is
+	// alice's
+	carol.WriteMessage(websocket.TextMessage, []byte("elsewhere"))
+	alice.WriteMessage(websocket.TextMessage, []byte("last"))
+	if ev := stream.next(t); len(ev.data) != 1 || ev.data[0] != "last" {
+		t.Errorf("got %+v, want only the message of the stream's room", ev)
+	}
+}
+
+func TestSSEDisconnectUnregisters(t *testing.T) {
+	srv := newTestServer(t, nil)
+	stream := srv.openSSE(t, "r", "dashboard")
+	stream.cancel()
+	waitFor(t, "the stream to unregister", func() bool {
+		return srv.hub.lookup("r", "dashboard") == nil
+	})
+	// The username is free again
+	srv.openSSE(t, "r", "dashboard")
+}
+
+func TestSSEWithWritePumpFeatures(t *testing.T) {
+	// Pings, batching, paced replays and drop-oldest all have code paths
+	// of their own in WritePump, which SSE clients, without a conn, never
+	// run
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.Hub.PingInterval = 20 * time.Millisecond
+		cfg.Hub.BatchMaxMessages = 8
+		cfg.Hub.BatchFlushInterval = 10 * time.Millisecond
+		cfg.Hub.HistorySize = 5
+		cfg.Hub.WarmupRate = 1000
+		cfg.Hub.SendBuffer = 2
+		cfg.Hub.BackpressurePolicy = BackpressureDropOldest
+	})
+	alice := srv.connect(t, "r", "alice", "")
+	for _, msg := range []string{"h1", "h2", "h3"} {
+		alice.WriteMessage(websocket.TextMessage, []byte(msg))
+	}
+	waitFor(t, "the history to fill", func() bool { return hubStats(srv.hub).TotalMessages == 3 })
+
+	stream := srv.openSSE(t, "r", "dashboard")
+	for _, want := range []string{"h1", "h2", "h3"} {
+		if ev := stream.next(t); len(ev.data) != 1 || ev.data[0] != want {
+			t.Fatalf("replay event %+v, want %s", ev, want)
+		}
+	}
+
+	// A burst overflows the two-frame buffer, evicting the oldest
+	for i := 0; i < 50; i++ {
+		alice.WriteMessage(websocket.TextMessage, []byte("burst"))
+	}
+	alice.WriteMessage(websocket.TextMessage, []byte("newest"))
+	for {
+		ev := stream.next(t)
+		if len(ev.data) == 1 && ev.data[0] == "newest" {
+			break
+		}
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev, ok := <-stream.events:
+			if !ok {
+				t.Fatal("stream ended")
+			}
+			if ev.comment == "ping" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a ping comment")
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Messages may carry several logical streams over one connection by
+// starting with a big-endian 2-byte stream ID. The server relays frames
+// unchanged; clients connecting with ?streams=1,3,7 only receive frames
+// for those streams, and everyone else receives all of them.
+
+// parseStreams parses a comma-separated list of stream IDs. An empty value
+// returns nil, meaning every stream.
+func parseStreams(value string) (map[uint16]struct{}, error) {
+	items := splitList(value)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	streams := make(map[uint16]struct{}, len(items))
+	for _, item := range items {
+		id, err := strconv.ParseUint(item, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stream ID %q: must be between 0 and 65535", item)
+		}
+		streams[uint16(id)] = struct{}{}
+	}
+	return streams, nil
+}
+
+// wantsStream reports whether the client subscribes to the stream data
+// belongs to. Frames too short to carry a stream ID only reach clients
+// without a stream filter.
+func (c *Client) wantsStream(data []byte) bool {
+	if c.streams == nil {
+		return true
+	}
+	if len(data) < 2 {
+		return false
+	}
+	_, ok := c.streams[binary.BigEndian.Uint16(data)]
+	return ok
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Signed tokens scope a connection to one username until an expiry. A token
+// is the base64url encoded JSON claims and their HMAC-SHA256 signature,
+// joined by a dot: <claims>.<signature>.
+
+var (
+	errTokenInvalid = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+)
+
+// tokenClaims is the payload of a signed token.
+type tokenClaims struct {
+	Username string `json:"sub"`
+	Expires  int64  `json:"exp"` // Unix seconds
+}
+
+// mintToken returns a token signed with secret that lets username connect
+// until expires.
+func mintToken(secret, username string, expires time.Time) string {
+	claims, _ := json.Marshal(tokenClaims{Username: username, Expires: expires.Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokenSignature(secret, payload))
+}
+
+// verifyToken checks token's signature and expiry and returns its claims.
+func verifyToken(secret, token string, now time.Time) (tokenClaims, error) {
+	var claims tokenClaims
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, errTokenInvalid
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, tokenSignature(secret, payload)) {
+		return claims, errTokenInvalid
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(raw, &claims) != nil || claims.Username == "" {
+		return claims, errTokenInvalid
+	}
+	if now.Unix() >= claims.Expires {
+		return claims, errTokenExpired
+	}
+	return claims, nil
+}
+
+func tokenSignature(secret, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// requireSignedToken wraps a WebSocket handler so it only runs when the
+// request carries a valid, unexpired token signed with secret for the
+// username in the URL. A bad or expired token gets 401 and a token for
+// another user 403. A URL without a username, as anonymous clients use,
+// accepts a valid token for any user: the client is given a generated
+// username, so it cannot act as the one in the token. An empty secret
+// disables the check.
+func requireSignedToken(secret string, next http.HandlerFunc) http.HandlerFunc {
+	if secret == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := verifyToken(secret, requestToken(r), time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="relay", error="invalid_token"`)
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if username := mux.Vars(r)["username"]; username != "" && claims.Username != username {
+			http.Error(w, "Forbidden: token not valid for this username", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestRequireSignedToken(t *testing.T) {
+	const secret = "s3cret"
+	hour := time.Now().Add(time.Hour)
+	valid := mintToken(secret, "alice", hour)
+	payload, signature, _ := strings.Cut(valid, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"bob","exp":9999999999}`)) + "." + signature
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"valid", valid, http.StatusNoContent},
+		{"other secret", mintToken("guess", "alice", hour), http.StatusUnauthorized},
+		{"forged claims", forged, http.StatusUnauthorized},
+		{"truncated signature", valid[:len(valid)-4], http.StatusUnauthorized},
+		{"expired", mintToken(secret, "alice", time.Now().Add(-time.Second)), http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+		{"no dot", payload, http.StatusUnauthorized},
+		{"not base64", payload + ".!!!", http.StatusUnauthorized},
+		{"garbage", "not-a-token", http.StatusUnauthorized},
+		{"no username", mintToken(secret, "", hour), http.StatusUnauthorized},
+		{"other username", mintToken(secret, "bob", hour), http.StatusForbidden},
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/ws/{room}/{username}", requireSignedToken(secret, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws/r/alice", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("got HTTP %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestVerifyTokenExpiry(t *testing.T) {
+	expires := time.Unix(1_700_000_000, 0)
+	token := mintToken("s3cret", "alice", expires)
+	claims, err := verifyToken("s3cret", token, expires.Add(-time.Second))
+	if err != nil || claims.Username != "alice" || claims.Expires != expires.Unix() {
+		t.Fatalf("verifyToken before expiry = %+v, %v", claims, err)
+	}
+	if _, err := verifyToken("s3cret", token, expires); err != errTokenExpired {
+		t.Fatalf("verifyToken at expiry = %v, want %v", err, errTokenExpired)
+	}
+}
+
+func TestSignedTokenOverWebSocket(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.TokenSecret = "s3cret" })
+	token := mintToken("s3cret", "alice", time.Now().Add(time.Hour))
+	if status, _ := srv.dialStatus(t, "/ws/r/alice?token="+token, nil); status != http.StatusSwitchingProtocols {
+		t.Fatalf("valid token got HTTP %d, want 101", status)
+	}
+	if status, _ := srv.dialStatus(t, "/ws/r/bob?token="+token, nil); status != http.StatusForbidden {
+		t.Fatalf("alice's token for bob got HTTP %d, want 403", status)
+	}
+}
+
+func TestSignedTokenForAnonymousClients(t *testing.T) {
+	token := mintToken("s3cret", "alice", time.Now().Add(time.Hour))
+	for _, anonymous := range []bool{true, false} {
+		t.Run(fmt.Sprintf("anonymous=%t", anonymous), func(t *testing.T) {
+			srv := newTestServer(t, func(cfg *Config) {
+				cfg.TokenSecret = "s3cret"
+				cfg.Hub.AllowAnonymous = anonymous
+			})
+			if status, _ := srv.dialStatus(t, "/ws/r/", nil); status != http.StatusUnauthorized {
+				t.Errorf("anonymous connection without a token got HTTP %d, want 401", status)
+			}
+			if status, _ := srv.dialStatus(t, "/ws/r/?token=guess", nil); status != http.StatusUnauthorized {
+				t.Errorf("anonymous connection with a bad token got HTTP %d, want 401", status)
+			}
+			if !anonymous {
+				if status, _ := srv.dialStatus(t, "/ws/r/?token="+token, nil); status != http.StatusBadRequest {
+					t.Errorf("connection without a username got HTTP %d, want 400", status)
+				}
+				return
+			}
+			conn := srv.dial(t, "/ws/r/?token="+token, nil)
+			_, data := readFrame(t, conn)
+			var welcome struct {
+				Type, Username string
+			}
+			if err := json.Unmarshal(data, &welcome); err != nil || welcome.Type != "welcome" || !strings.HasPrefix(welcome.Username, anonymousPrefix) {
+				t.Fatalf("anonymous client got %s, want a welcome with a generated username", data)
+			}
+			// The token's own username is still only valid for alice
+			if status, _ := srv.dialStatus(t, "/ws/r/bob?token="+token, nil); status != http.StatusForbidden {
+				t.Errorf("alice's token for bob got HTTP %d, want 403", status)
+			}
+		})
+	}
+}
+
+// welcomedUsername reads the welcome frame from conn and returns the
+// username it gives.
+func welcomedUsername(tb testing.TB, conn *websocket.Conn) string {
+	tb.Helper()
+	_, data := readFrame(tb, conn)
+	var welcome welcomeFrame
+	if err := json.Unmarshal(data, &welcome); err != nil || welcome.Type != "welcome" || !strings.HasPrefix(welcome.Username, anonymousPrefix) {
+		tb.Fatalf("anonymous client got %s, want a welcome with a generated username", data)
+	}
+	return welcome.Username
+}
+
+func TestAnonymousClientsWithoutTokenSecret(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.AllowAnonymous = true })
+	bob := srv.connect(t, "r", "bob", "")
+	for _, path := range []string{"/ws/r/", "/ws", "/ws/"} {
+		conn := srv.dial(t, path, nil)
+		username := welcomedUsername(t, conn)
+		room := "r"
+		if path != "/ws/r/" {
+			room = defaultRoom
+		}
+		waitFor(t, username+" to register", func() bool { return srv.hub.lookup(room, username) != nil })
+		if room != "r" {
+			continue
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("hi from "+username))
+		if _, data := readFrame(t, bob); string(data) != "hi from "+username {
+			t.Fatalf("bob got %q from the anonymous client", data)
+		}
+	}
+
+	closed := newTestServer(t, nil)
+	if status, _ := closed.dialStatus(t, "/ws/r/", nil); status != http.StatusBadRequest {
+		t.Errorf("anonymous connection without AllowAnonymous got HTTP %d, want 400", status)
+	}
+}
+
+func TestConcurrentAnonymousUsernamesAreUnique(t *testing.T) {
+	const clients = 50
+	srv := newTestServer(t, func(cfg *Config) { cfg.Hub.AllowAnonymous = true })
+	conns := make([]*websocket.Conn, clients)
+	errs := make([]error, clients)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conns[i], _, errs[i] = websocket.DefaultDialer.Dial(srv.wsURL("/ws/r/"), nil)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool, clients)
+	for i, conn := range conns {
+		if errs[i] != nil {
+			t.Fatalf("dial %d: %v", i, errs[i])
+		}
+		t.Cleanup(func() { conn.Close() })
+		username := welcomedUsername(t, conn)
+		if seen[username] {
+			t.Fatalf("username %s given twice", username)
+		}
+		seen[username] = true
+	}
+	waitFor(t, "every client to register", func() bool {
+		for username := range seen {
+			if srv.hub.lookup("r", username) == nil {
+				return false
+			}
+		}
+		return true
+	})
+}
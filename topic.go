@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// JSON protocol messages may name a dot-separated topic, e.g.
+// "sensor.kitchen.temp". A client subscribes by sending
+// {"type":"subscribe","topics":["sensor.*.temp","alerts.**"]} and from
+// then on only receives messages whose topic matches one of the patterns;
+// an empty list clears the subscription. Clients that never subscribe
+// receive everything.
+//
+// Patterns are matched segment by segment: "*" matches exactly one
+// segment, "**" any number of segments including none, and other segments
+// use path.Match syntax, so "temp*" or "room-?" work within a segment.
+
+// topicPattern is a compiled subscription pattern.
+type topicPattern []string
+
+// compileTopicPattern splits pattern into segments and validates them.
+func compileTopicPattern(pattern string) (topicPattern, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("empty topic pattern")
+	}
+	segments := strings.Split(pattern, ".")
+	for _, segment := range segments {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid topic pattern %q: %w", pattern, err)
+		}
+	}
+	return topicPattern(segments), nil
+}
+
+// match reports whether topic matches the pattern.
+func (p topicPattern) match(topic string) bool {
+	return matchSegments(p, strings.Split(topic, "."))
+}
+
+func matchSegments(pattern, topic []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(topic); i++ {
+				if matchSegments(pattern[1:], topic[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(topic) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], topic[0]); !ok {
+			return false
+		}
+		pattern, topic = pattern[1:], topic[1:]
+	}
+	return len(topic) == 0
+}
+
+// topicFilter is a client's subscription. ReadPump replaces it while Run
+// reads it, so the client holds it in an atomic pointer.
+type topicFilter struct {
+	patterns []topicPattern
+}
+
+// wantsTopic reports whether the client subscribes to topic. Clients
+// without a subscription receive every message, and subscribed clients
+// no message without a topic.
+func (c *Client) wantsTopic(topic string) bool {
+	filter := c.topics.Load()
+	if filter == nil {
+		return true
+	}
+	for _, pattern := range filter.patterns {
+		if pattern.match(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribeRequest is the subscription control frame.
+type subscribeRequest struct {
+	Type   string   `json:"type"`
+	Topics []string `json:"topics"`
+}
+
+// parseSubscribe reports whether data is a subscription control frame and,
+// if so, returns the requested patterns.
+func parseSubscribe(data []byte) ([]string, bool) {
+	if !bytes.Contains(data, []byte(`"subscribe"`)) {
+		return nil, false
+	}
+	var req subscribeRequest
+	if json.Unmarshal(data, &req) != nil || req.Type != "subscribe" {
+		return nil, false
+	}
+	return req.Topics, true
+}
+
+// subscribe replaces the client's subscription with patterns, or clears it
+// if there are none, and acknowledges the new subscription. Invalid
+// patterns leave the subscription unchanged.
+func (c *Client) subscribe(patterns []string) {
+	if len(patterns) == 0 {
+		c.topics.Store(nil)
+	} else {
+		filter := &topicFilter{patterns: make([]topicPattern, 0, len(patterns))}
+		for _, pattern := range patterns {
+			compiled, err := compileTopicPattern(pattern)
+			if err != nil {
+				sendError(c, http.StatusBadRequest, "invalid_pattern", err.Error())
+				return
+			}
+			filter.patterns = append(filter.patterns, compiled)
+		}
+		c.topics.Store(filter)
+	}
+	if patterns == nil {
+		patterns = []string{}
+	}
+	ack, _ := json.Marshal(subscribeRequest{Type: "subscribed", Topics: patterns})
+	c.sendDirect(ack)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTopicPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"sensor.a", "sensor.a", true},
+		{"sensor.a", "sensor.b", false},
+		{"sensor.*", "sensor.a", true},
+		{"sensor.*", "sensor.a.b", false},
+		{"sensor.*", "sensor", false},
+		{"sensor.*.temp", "sensor.kitchen.temp", true},
+		{"sensor.*.temp", "sensor.kitchen.humidity", false},
+		{"sensor.**", "sensor", true},
+		{"sensor.**", "sensor.a", true},
+		{"sensor.**", "sensor.a.b", true},
+		{"sensor.**", "sensors.a", false},
+		{"**", "anything.at.all", true},
+		{"**", "x", true},
+		{"**.temp", "sensor.kitchen.temp", true},
+		{"**.temp", "temp", true},
+		{"a.**.z", "a.z", true},
+		{"a.**.z", "a.b.c.z", true},
+		{"a.**.z", "a.b.c", false},
+		{"sensor.temp*", "sensor.temperature", true},
+		{"room-?", "room-1", true},
+		{"room-?", "room-10", false},
+		{"room-[0-4]", "room-3", true},
+		{"room-[0-4]", "room-7", false},
+	}
+	for _, tt := range tests {
+		pattern, err := compileTopicPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("compileTopicPattern(%q): %v", tt.pattern, err)
+		}
+		if got := pattern.match(tt.topic); got != tt.want {
+			t.Errorf("%q matching %q = %t, want %t", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestTopicPatternInvalid(t *testing.T) {
+	for _, pattern := range []string{"", "sensor.[", "room-[a-", `trailing.\`} {
+		if _, err := compileTopicPattern(pattern); err == nil {
+			t.Errorf("compileTopicPattern(%q) succeeded, want an error", pattern)
+		}
+	}
+}
+
+func TestUnsubscribedClientReceivesEverything(t *testing.T) {
+	client := newTestClient(nil, "r", "alice", 1)
+	for _, topic := range []string{"", "sensor.a", "alerts.fire.kitchen"} {
+		if !client.wantsTopic(topic) {
+			t.Errorf("client without a subscription refused topic %q", topic)
+		}
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	srv := newTestServer(t, nil)
+	receiver := srv.connect(t, "r", "bob", "protocol=json")
+	sender := srv.connect(t, "r", "alice", "protocol=json")
+
+	receiver.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","topics":["sensor.*"]}`))
+	_, data := readFrame(t, receiver)
+	var ack subscribeRequest
+	if err := json.Unmarshal(data, &ack); err != nil || ack.Type != "subscribed" || len(ack.Topics) != 1 || ack.Topics[0] != "sensor.*" {
+		t.Fatalf("subscription answered with %s", data)
+	}
+
+	for _, topic := range []string{"sensor.a.b", "alerts.x", "sensor.a"} {
+		sender.WriteMessage(websocket.TextMessage, []byte(`{"topic":"`+topic+`","payload":1}`))
+	}
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"payload":"no topic"}`))
+	_, data = readFrame(t, receiver)
+	var envelope struct {
+		Topic string `json:"topic"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.Topic != "sensor.a" {
+		t.Fatalf("subscriber received %s, want only the sensor.a message", data)
+	}
+
+	// An invalid pattern is refused and the subscription kept
+	receiver.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","topics":["sensor.["]}`))
+	_, data = readFrame(t, receiver)
+	var refusal errorFrame
+	if err := json.Unmarshal(data, &refusal); err != nil || refusal.Reason != "invalid_pattern" {
+		t.Fatalf("invalid subscription answered with %s", data)
+	}
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"topic":"alerts.x","payload":2}`))
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"topic":"sensor.b","payload":3}`))
+	_, data = readFrame(t, receiver)
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.Topic != "sensor.b" {
+		t.Fatalf("subscriber received %s after a refused change, want the sensor.b message", data)
+	}
+}
+
+func TestRawClientSubscribeFrameIsRelayed(t *testing.T) {
+	srv := newTestServer(t, nil)
+	receiver := srv.connect(t, "r", "bob", "")
+	sender := srv.connect(t, "r", "alice", "")
+
+	subscribe := `{"type":"subscribe","topics":["sensor.*"]}`
+	sender.WriteMessage(websocket.TextMessage, []byte(subscribe))
+	if _, data := readFrame(t, receiver); string(data) != subscribe {
+		t.Fatalf("receiver got %s, want the raw frame relayed unchanged", data)
+	}
+	if srv.hub.lookup("r", "alice").topics.Load() != nil {
+		t.Error("raw client's frame changed its subscription")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Transformer rewrites messages on their way through the hub, e.g. to
+// redact or annotate them. Transformers run in order on Run's goroutine,
+// after deduplication and before the message is counted, archived,
+// recorded for replay and fanned out, so they must be quick. Returning an
+// error drops the message.
+type Transformer interface {
+	Transform(Message) (Message, error)
+}
+
+// TransformerFunc adapts a function to the Transformer interface.
+type TransformerFunc func(Message) (Message, error)
+
+// Transform implements Transformer.
+func (f TransformerFunc) Transform(m Message) (Message, error) { return f(m) }
+
+// transformers are the built-in transformers selectable with TRANSFORMERS.
+var transformers = map[string]Transformer{
+	"sender-header": TransformerFunc(senderHeader),
+	"sender-stamp":  TransformerFunc(senderStamp),
+}
+
+// newTransformers returns the chain of built-in transformers named in
+// names, in order.
+func newTransformers(names []string) ([]Transformer, error) {
+	chain := make([]Transformer, 0, len(names))
+	for _, name := range names {
+		t, ok := transformers[name]
+		if !ok {
+			known := make([]string, 0, len(transformers))
+			for n := range transformers {
+				known = append(known, n)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown transformer %q: must be one of %s", name, strings.Join(known, ", "))
+		}
+		chain = append(chain, t)
+	}
+	return chain, nil
+}
+
+// senderHeader prepends the sender's username and a newline to the
+// payload, so raw clients can tell who sent a message. It makes JSON
+// protocol messages invalid JSON, so it suits raw rooms only.
+func senderHeader(m Message) (Message, error) {
+	data := make([]byte, 0, len(m.From)+1+len(m.Data))
+	data = append(data, m.From...)
+	data = append(data, '\n')
+	m.Data = append(data, m.Data...)
+	return m, nil
+}
+
+// The sender stamp is a fixed-size header ahead of the payload: a version
+// byte, the length of the sender's username and the username itself,
+// zero-padded to maxUsernameLength. The server fills it from the
+// connection the message arrived on, so whatever the payload holds, a
+// receiver that strips exactly senderStampSize bytes knows who sent it.
+const (
+	senderStampVersion = 1
+	senderStampSize    = 2 + maxUsernameLength
+)
+
+// senderStamp prepends the sender stamp to the payload. Like
+// senderHeader it suits raw rooms, but the fixed size keeps binary
+// payloads unambiguous. Senders whose username does not fit, which only
+// tokens and peers could supply, have their messages dropped.
+func senderStamp(m Message) (Message, error) {
+	if len(m.From) > maxUsernameLength {
+		return m, fmt.Errorf("sender %q too long for the sender stamp", displayUsername(m.From))
+	}
+	data := make([]byte, senderStampSize, senderStampSize+len(m.Data))
+	data[0] = senderStampVersion
+	data[1] = byte(len(m.From))
+	copy(data[2:], m.From)
+	m.Data = append(data, m.Data...)
+	return m, nil
+}
+
+// transform runs message through the configured chain, reporting false
+// if a transformer rejected it. Called from Run only.
+func (h *Hub) transform(message Message) (Message, bool) {
+	for _, t := range h.config.Transformers {
+		out, err := t.Transform(message)
+		if err != nil {
+			h.mu.Lock()
+			h.stats.TransformFailures++
+			h.mu.Unlock()
+			slog.Warn("Message dropped by transformer", "event", "transform_error", "username", message.From, "room", message.Room, "error", err)
+			return message, false
+		}
+		message = out
+	}
+	return message, true
+}
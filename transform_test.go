@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// parseSenderStamp splits data into the sender named by its stamp and the
+// payload, as a receiver would.
+func parseSenderStamp(tb testing.TB, data []byte) (string, []byte) {
+	tb.Helper()
+	if len(data) < senderStampSize {
+		tb.Fatalf("%d byte message is shorter than the sender stamp", len(data))
+	}
+	if data[0] != senderStampVersion {
+		tb.Fatalf("sender stamp version %d, want %d", data[0], senderStampVersion)
+	}
+	n := int(data[1])
+	if n == 0 || n > maxUsernameLength {
+		tb.Fatalf("sender stamp username length %d", n)
+	}
+	if padding := data[2+n : senderStampSize]; len(bytes.Trim(padding, "\x00")) != 0 {
+		tb.Fatalf("sender stamp padding % x is not zero", padding)
+	}
+	return string(data[2 : 2+n]), data[senderStampSize:]
+}
+
+func TestSenderStamp(t *testing.T) {
+	longest := strings.Repeat("u", maxUsernameLength)
+	for _, tt := range []struct {
+		from    string
+		payload []byte
+	}{
+		{"alice", []byte("hi")},
+		{"a", nil},
+		{longest, []byte{0, 1, 2, 0xff}},
+		// A payload posing as a stamp stays part of the payload
+		{"mallory", append([]byte{senderStampVersion, 5}, "alice"...)},
+	} {
+		m, err := senderStamp(Message{From: tt.from, Data: tt.payload})
+		if err != nil {
+			t.Fatalf("stamping %q: %v", tt.from, err)
+		}
+		if len(m.Data) != senderStampSize+len(tt.payload) {
+			t.Errorf("%q: stamped message is %d bytes, want %d", tt.from, len(m.Data), senderStampSize+len(tt.payload))
+		}
+		if from, payload := parseSenderStamp(t, m.Data); from != tt.from || !bytes.Equal(payload, tt.payload) {
+			t.Errorf("stamp of %q read back as %q with payload %q", tt.from, from, payload)
+		}
+	}
+	if _, err := senderStamp(Message{From: longest + "x"}); err == nil {
+		t.Error("stamped a sender longer than the stamp holds")
+	}
+}
+
+func TestNewTransformers(t *testing.T) {
+	chain, err := newTransformers([]string{"sender-header", "sender-stamp"})
+	if err != nil || len(chain) != 2 {
+		t.Fatalf("newTransformers = %d transformers, %v", len(chain), err)
+	}
+	if _, err := newTransformers([]string{"sender-stamp", "rot13"}); err == nil || !strings.Contains(err.Error(), "sender-header, sender-stamp") {
+		t.Errorf("unknown transformer error = %v, want it to list the known ones", err)
+	}
+}
+
+func TestSenderStampedMessagesOverWebSocket(t *testing.T) {
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.Hub.Transformers = []Transformer{TransformerFunc(senderStamp)}
+	})
+	receiver := srv.connect(t, "r", "bob", "")
+	sender := srv.connect(t, "r", "alice", "")
+
+	for _, tt := range []struct {
+		messageType int
+		payload     string
+	}{
+		{websocket.BinaryMessage, "\x01\x03bob forged"},
+		{websocket.TextMessage, "hello"},
+	} {
+		sender.WriteMessage(tt.messageType, []byte(tt.payload))
+		messageType, data := readFrame(t, receiver)
+		if messageType != tt.messageType {
+			t.Errorf("message type %d relayed as %d", tt.messageType, messageType)
+		}
+		if from, payload := parseSenderStamp(t, data); from != "alice" || string(payload) != tt.payload {
+			t.Errorf("received %q from %q, want %q from alice", payload, from, tt.payload)
+		}
+	}
+
+	// A sender too long for the stamp, as a peer could supply, is dropped
+	relay(srv.hub, "r", strings.Repeat("p", maxUsernameLength+1), []byte("lost"))
+	waitFor(t, "the transform failure", func() bool { return hubStats(srv.hub).TransformFailures == 1 })
+	expectSilence(t, receiver, 100*time.Millisecond)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxUsernameLength bounds usernames so they stay readable in logs and
+// cheap as map keys.
+const maxUsernameLength = 64
+
+// maxRequestURILength caps the request URI of connect and publish
+// requests. Far longer than any valid username and room need, it rejects
+// pathological paths with 414 before they are parsed or logged.
+const maxRequestURILength = 2048
+
+// checkRequestURI answers 414 and reports false if r's URI is too long.
+func checkRequestURI(w http.ResponseWriter, r *http.Request) bool {
+	if len(r.RequestURI) <= maxRequestURILength {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("Request URI too long: usernames are at most %d characters", maxUsernameLength), http.StatusRequestURITooLong)
+	return false
+}
+
+// reservedUsernames cannot be claimed by clients because they could be
+// mistaken for the server itself in relayed or logged messages.
+var reservedUsernames = map[string]bool{
+	"admin":  true,
+	"server": true,
+	"system": true,
+	"relay":  true,
+}
+
+// validateUsername checks that name is non-empty, at most
+// maxUsernameLength bytes, made only of ASCII letters, digits, '-', '_'
+// and '.', and not reserved.
+func validateUsername(name string) error {
+	if name == "" {
+		return fmt.Errorf("username is required")
+	}
+	if len(name) > maxUsernameLength {
+		return fmt.Errorf("username is %d characters long, the maximum is %d", len(name), maxUsernameLength)
+	}
+	for _, r := range name {
+		if !isUsernameChar(r) {
+			return fmt.Errorf("username may only contain letters, digits, '-', '_' and '.'")
+		}
+	}
+	if reservedUsernames[strings.ToLower(name)] {
+		return fmt.Errorf("username %q is reserved", name)
+	}
+	return nil
+}
+
+func isUsernameChar(r rune) bool {
+	return r >= 'a' && r <= 'z' ||
+		r >= 'A' && r <= 'Z' ||
+		r >= '0' && r <= '9' ||
+		r == '-' || r == '_' || r == '.'
+}
+
+// anonymousPrefix starts the usernames generated with AllowAnonymous.
+const anonymousPrefix = "anon-"
+
+// anonymousUsername generates a username, such as "anon-3f9a2c7d1e04",
+// that no client in room is using, for a client that connected without
+// one.
+func (h *Hub) anonymousUsername(room string) string {
+	b := make([]byte, 6)
+	for {
+		rand.Read(b)
+		name := anonymousPrefix + hex.EncodeToString(b)
+		if h.lookup(room, name) == nil {
+			return name
+		}
+	}
+}
+
+// welcomeFrame tells an anonymous client the username it was given.
+type welcomeFrame struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	Room     string `json:"room"`
+}
+
+// newWelcomeFrame encodes the welcome frame for username in room.
+func newWelcomeFrame(username, room string) []byte {
+	data, _ := json.Marshal(welcomeFrame{Type: "welcome", Username: username, Room: room})
+	return data
+}
+
+// displayUsername shortens name to maxUsernameLength for reports such as
+// /health. Connected usernames have been validated, so this only guards
+// against that check ever being loosened.
+func displayUsername(name string) string {
+	if len(name) <= maxUsernameLength {
+		return name
+	}
+	return name[:maxUsernameLength] + "..."
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"alice", true},
+		{"Bob_99", true},
+		{"a.b-c_d", true},
+		{"x", true},
+		{strings.Repeat("a", maxUsernameLength), true},
+		{strings.Repeat("a", maxUsernameLength+1), false},
+		{"", false},
+		{" ", false},
+		{"\t\n", false},
+		{" alice", false},
+		{"alice bob", false},
+		{"ålice", false},
+		{"用户", false},
+		{"alice\u200b", false},
+		{"emoji😀", false},
+		{"bell\a", false},
+		{"null\x00", false},
+		{"a/b", false},
+		{"a:b", false},
+		{"admin", false},
+		{"Admin", false},
+		{"SYSTEM", false},
+		{"relay", false},
+		{"server", false},
+		{"administrator", true},
+	}
+	for _, tt := range tests {
+		err := validateUsername(tt.name)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateUsername(%q) = %v, want valid %t", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestInvalidUsernameRejectedBeforeUpgrade(t *testing.T) {
+	srv := newTestServer(t, nil)
+	for _, path := range []string{"/ws/r/%20%20", "/ws/r/%C3%A5lice", "/ws/r/admin", "/ws/r/a%0Ab"} {
+		if status, _ := srv.dialStatus(t, path, nil); status != http.StatusBadRequest {
+			t.Errorf("%s: got HTTP %d, want 400", path, status)
+		}
+	}
+}
+
+func TestOverlongRequestURIRejectedWith414(t *testing.T) {
+	srv := newTestServer(t, nil)
+	long := strings.Repeat("a", 10*1024)
+	if status, _ := srv.dialStatus(t, "/ws/r/"+long, nil); status != http.StatusRequestURITooLong {
+		t.Errorf("10KB username got HTTP %d, want 414", status)
+	}
+	if status, _ := srv.dialStatus(t, "/ws/r/alice?x="+long, nil); status != http.StatusRequestURITooLong {
+		t.Errorf("10KB query got HTTP %d, want 414", status)
+	}
+	// Just over the username limit is an ordinary invalid username
+	if status, _ := srv.dialStatus(t, "/ws/r/"+strings.Repeat("a", maxUsernameLength+1), nil); status != http.StatusBadRequest {
+		t.Errorf("65 character username got HTTP %d, want 400", status)
+	}
+}
+
+func TestDisplayUsername(t *testing.T) {
+	short := strings.Repeat("a", maxUsernameLength)
+	if got := displayUsername(short); got != short {
+		t.Errorf("displayUsername shortened a %d character name to %q", len(short), got)
+	}
+	if got := displayUsername(short + "bcd"); got != short+"..." {
+		t.Errorf("displayUsername(%d characters) = %q, want the first %d and an ellipsis", len(short)+3, got, maxUsernameLength)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import "time"
+
+// Without WarmupRate, replayed history is queued on a new client's send
+// buffer like live traffic and cut short once the buffer is full. With
+// it, Run queues the whole replay as a single backlog frame, where the
+// replay belongs among the client's frames, and WritePump writes the
+// backlog at WarmupRate messages per second before moving on to live
+// traffic queued meanwhile, still sending pings and minding its timers.
+// A client catching up thus receives all of the replay without it
+// crowding live messages out of the send buffer, and at a pace it can
+// keep up with; priority frames still go first. HubConfig.Validate
+// refuses a history that would take PongWait or longer to replay.
+
+// queueReplay queues replayed frames on client, oldest first: one by one
+// until the send buffer is full, or with WarmupRate as one paced backlog.
+// Called from Run only.
+func (h *Hub) queueReplay(client *Client, frames []frame) {
+	if len(frames) == 0 {
+		return
+	}
+	if h.config.WarmupRate > 0 {
+		trySend(client, frame{backlog: frames})
+		return
+	}
+	for _, f := range frames {
+		if !trySend(client, f) {
+			return
+		}
+	}
+}
+
+// warmup is a replay backlog being written at WarmupRate. WritePump
+// writes one frame per tick from its main loop, so pings, heartbeats and
+// its timers keep being serviced however long the replay takes.
+type warmup struct {
+	frames []frame
+	ticker *time.Ticker
+}
+
+// startWarmup writes the first frame of a paced replay backlog and leaves
+// the rest to WritePump.
+func (c *Client) startWarmup(frames []frame) error {
+	c.warmup = &warmup{frames: frames, ticker: time.NewTicker(warmupInterval(c.hub.config.WarmupRate))}
+	return c.writeWarmup()
+}
+
+// writeWarmup writes the backlog's next frame, ending the backlog after
+// its last frame or early if the client is evicted or closed meanwhile.
+func (c *Client) writeWarmup() error {
+	if c.drainExpired() || c.closing() {
+		c.stopWarmup()
+		return nil
+	}
+	f := c.warmup.frames[0]
+	c.warmup.frames = c.warmup.frames[1:]
+	if len(c.warmup.frames) == 0 {
+		c.stopWarmup()
+	}
+	if err := c.flushPriority(); err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(c.writeDeadline())
+	if err := c.writeFrame(f); err != nil {
+		return err
+	}
+	c.countSent(1, len(f.data))
+	return nil
+}
+
+// stopWarmup ends the paced backlog, if any.
+func (c *Client) stopWarmup() {
+	if c.warmup != nil {
+		c.warmup.ticker.Stop()
+		c.warmup = nil
+	}
+}
+
+// warmupInterval is the pause between backlog messages at rate per
+// second. Rates over a billion would round it to zero, which tickers
+// refuse, so it is at least a nanosecond.
+func warmupInterval(rate int) time.Duration {
+	return max(time.Second/time.Duration(rate), time.Nanosecond)
+}
+
+// closing reports whether the hub has decided to close the client, e.g.
+// on a kick or at shutdown.
+func (c *Client) closing() bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	return c.closeCode != 0
+}
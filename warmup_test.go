@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWarmupInterval(t *testing.T) {
+	tests := []struct {
+		rate int
+		want time.Duration
+	}{
+		{1, time.Second},
+		{1000, time.Millisecond},
+		{1e9, time.Nanosecond},
+		{2e9, time.Nanosecond},
+		{1 << 62, time.Nanosecond},
+	}
+	for _, tt := range tests {
+		if got := warmupInterval(tt.rate); got != tt.want {
+			t.Errorf("warmupInterval(%d) = %s, want %s", tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestConstrainedClientReceivesWholeReplay(t *testing.T) {
+	const replayed = 300
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.Hub.HistorySize = replayed
+		cfg.Hub.SendBuffer = 4
+		cfg.Hub.WarmupRate = 2e9
+	})
+	for i := 0; i < replayed; i++ {
+		relay(srv.hub, "r", "alice", []byte(fmt.Sprint(i)))
+	}
+	waitFor(t, "the history to fill", func() bool { return hubStats(srv.hub).TotalMessages == replayed })
+
+	// Far more history than bob's send buffer holds, yet all of it arrives,
+	// in order, ahead of live traffic sent while it is written
+	bob := srv.connect(t, "r", "bob", "")
+	relay(srv.hub, "r", "alice", []byte("live"))
+	for i := 0; i < replayed; i++ {
+		if _, data := readFrame(t, bob); string(data) != fmt.Sprint(i) {
+			t.Fatalf("replayed message %d = %q", i, data)
+		}
+	}
+	if _, data := readFrame(t, bob); string(data) != "live" {
+		t.Fatalf("after the replay got %q, want the live message", data)
+	}
+}
+
+func TestValidateRefusesReplayOutlastingPongWait(t *testing.T) {
+	tests := []struct {
+		history, rate int
+		valid         bool
+	}{
+		{100, 0, true},
+		{0, 1, true},
+		{100, 2, true},
+		{100, 1, false},
+		{60, 1, false},
+		{59, 1, true},
+	}
+	for _, tt := range tests {
+		config := DefaultHubConfig()
+		config.HistorySize, config.WarmupRate = tt.history, tt.rate
+		if err := config.Validate(); (err == nil) != tt.valid {
+			t.Errorf("history %d at %d/s with a %s pong wait: Validate() = %v, want valid %t",
+				tt.history, tt.rate, config.PongWait, err, tt.valid)
+		}
+	}
+}
+
+func TestReplayOutlastingPongWaitKeepsConnection(t *testing.T) {
+	// Validate would refuse this; the pump must cope regardless, pinging
+	// the client between replayed messages
+	const replayed = 8
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.Hub.HistorySize = replayed
+		cfg.Hub.WarmupRate = 10
+		cfg.Hub.PingInterval = 100 * time.Millisecond
+		cfg.Hub.PongWait = 300 * time.Millisecond
+	})
+	for i := 0; i < replayed; i++ {
+		relay(srv.hub, "r", "alice", []byte(fmt.Sprint(i)))
+	}
+	waitFor(t, "the history to fill", func() bool { return hubStats(srv.hub).TotalMessages == replayed })
+
+	start := time.Now()
+	bob := srv.connect(t, "r", "bob", "")
+	for i := 0; i < replayed; i++ {
+		if _, data := readFrame(t, bob); string(data) != fmt.Sprint(i) {
+			t.Fatalf("replayed message %d = %q", i, data)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*srv.hub.config.PongWait {
+		t.Fatalf("replay took %s, want it to outlast the pong wait", elapsed)
+	}
+	relay(srv.hub, "r", "alice", []byte("live"))
+	if _, data := readFrame(t, bob); string(data) != "live" {
+		t.Fatalf("after the replay got %q, want the live message", data)
+	}
+}